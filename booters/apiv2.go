@@ -0,0 +1,254 @@
+// Copyright 2024 Kairos contributors
+
+package booters
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/kairos-io/netboot/constants"
+	"github.com/kairos-io/netboot/types"
+	"github.com/kairos-io/netboot/utils"
+)
+
+// APIBooterV2 gets a BootSpec from a remote server over HTTP, using
+// version 2 of the API.
+//
+// Where version 1 only tells the API server a machine's MAC address,
+// version 2 POSTs everything known about the machine to
+// {url}/v2/boot:
+//
+//	{
+//	  "mac": "01:02:03:04:05:06",
+//	  "arch": "X64",
+//	  "firmware": "efi64",
+//	  "guid": "8fa6e2a8-...",
+//	  "vendor-class": "PXEClient:Arch:00007:UNDI:003016",
+//	  "relay": "192.168.1.1",
+//	  "interface": "eth0",
+//	  "ip": "192.168.1.23"
+//	}
+//
+// Firmware, relay and interface describe the machine's latest DHCP
+// request, and are omitted or default when it wasn't seen over DHCP.
+// ip is omitted until the machine makes HTTP requests.
+// The server answers 204 No Content for machines that shouldn't
+// netboot, or with the same JSON object as version 1, which can also
+// have these fields:
+//
+//   - "efi": the URL of an EFI image to boot instead of a kernel,
+//     which gets the "cmdline" as load options, and can load the
+//     "initrd" files by name.
+//   - "uki": the URLs of Unified Kernel Images to boot instead of a
+//     kernel, at most one per architecture. The server boots the one
+//     built for the machine, with "initrd" as addons and "cmdline"
+//     appended to the cmdline embedded in it.
+//   - "menu": entries to choose from at the console, instead of a
+//     kernel or EFI image, as {"entries": [{"name": "...", ...}],
+//     "default": "<name>", "timeout": <seconds>}. Each entry has the
+//     fields of a response that say what to boot, including "efi"
+//     and "uki".
+//     Checksums and signatures cover the files of all entries.
+//   - "checksums": a map of file URL to "sha256:<hex>" digest, which
+//     become the Digests of the Spec.
+//   - "signatures" and "public-key": a map of file URL to signature,
+//     and the key to verify them with, which become the Signatures
+//     and PublicKey of the Spec.
+//   - "boot-once": if true, the server is told when the machine boots
+//     the kernel, by a POST of the same machine object to
+//     {url}/v2/booted, so that it can answer differently next time.
+//   - "cache-ttl": a number of seconds during which the response can
+//     be reused for the same machine without asking again, as long as
+//     it has the same architecture and firmware, and at most for the
+//     URL TTL of the APIOptions.
+//
+// opts are as for APIBooter.
+func APIBooterV2(url string, timeout time.Duration, opts ...utils.HTTPClientOption) (types.Booter, error) {
+	return NewAPIBooter(url, APIOptions{Version: 2, Timeout: timeout, Client: opts})
+}
+
+// apiMachine is the machine context sent to v2 API servers.
+type apiMachine struct {
+	MAC         string `json:"mac"`
+	Arch        string `json:"arch"`
+	Firmware    string `json:"firmware"`
+	GUID        string `json:"guid,omitempty"`
+	VendorClass string `json:"vendor-class,omitempty"`
+	Relay       string `json:"relay,omitempty"`
+	Interface   string `json:"interface,omitempty"`
+	IP          string `json:"ip,omitempty"`
+}
+
+func newAPIMachine(m types.Machine) *apiMachine {
+	ret := &apiMachine{
+		MAC:         m.MAC.String(),
+		Arch:        m.Arch.String(),
+		Firmware:    m.Firmware.String(),
+		VendorClass: m.VendorClass,
+		Interface:   m.Interface,
+	}
+	if len(m.GUID) > 0 {
+		ret.GUID = utils.FormatGUID(m.GUID)
+	}
+	if m.RelayAddr != nil {
+		ret.Relay = m.RelayAddr.String()
+	}
+	if m.IP != nil {
+		ret.IP = m.IP.String()
+	}
+	return ret
+}
+
+// apiSpecV2 is a v2 API server's answer to a boot request.
+type apiSpecV2 struct {
+	apiSpec
+	Efi        string            `json:"efi"`
+	UKI        []string          `json:"uki"`
+	Checksums  map[string]string `json:"checksums"`
+	Signatures map[string]string `json:"signatures"`
+	PublicKey  string            `json:"public-key"`
+	BootOnce   bool              `json:"boot-once"`
+	CacheTTL   int               `json:"cache-ttl"`
+}
+
+type apiCacheEntry struct {
+	// The architecture and firmware of the machine the response is
+	// for, so that a machine that boots differently asks again. The
+	// rest of its context isn't known on every request, e.g. its IP
+	// address is only known over HTTP.
+	arch     constants.Architecture
+	firmware constants.Firmware
+	// The IP address the URLs of spec are bound to, if any. Specs
+	// made before the machine's IP address was known have unbound
+	// URLs, and aren't handed out once it is.
+	ip      net.IP
+	spec    *types.Spec
+	expires time.Time
+}
+
+func (b *apibooter) bootSpecV2(m types.Machine) (*types.Spec, error) {
+	req, err := json.Marshal(newAPIMachine(m))
+	if err != nil {
+		return nil, err
+	}
+	k := m.MAC.String()
+
+	b.mu.Lock()
+	if e := b.cache[k]; e != nil {
+		if e.arch == m.Arch && e.firmware == m.Firmware && (!b.bindIP || e.ip.Equal(m.IP)) && time.Now().Before(e.expires) {
+			b.mu.Unlock()
+			return e.spec, nil
+		}
+		delete(b.cache, k)
+	}
+	b.mu.Unlock()
+
+	reqURL := b.urlPrefix + "/boot"
+	resp, err := b.client.Post(reqURL, "application/json", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%s: %s", reqURL, http.StatusText(resp.StatusCode))
+	}
+
+	var r apiSpecV2
+	if err = json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+	if r.CacheTTL < 0 {
+		return nil, fmt.Errorf("API server returned negative cache-ttl %d", r.CacheTTL)
+	}
+
+	ids := map[string]types.ID{}
+	signed := time.Now()
+	spec, err := b.makeSpec(m, &r.apiSpec, r.Efi, r.UKI, ids)
+	if err != nil {
+		return nil, err
+	}
+	// Checksums and signatures are keyed by URL, the Spec's by ID.
+	byURL := &types.Spec{PublicKey: r.PublicKey, Signatures: map[types.ID]string{}, Digests: map[types.ID]string{}}
+	for u, digest := range r.Checksums {
+		byURL.Digests[types.ID(u)] = digest
+	}
+	for u, sig := range r.Signatures {
+		byURL.Signatures[types.ID(u)] = sig
+	}
+	err = mapVerification(spec, byURL, func(u types.ID) types.ID {
+		abs, err := b.makeURLAbsolute(string(u))
+		if err != nil {
+			return ""
+		}
+		return ids[abs]
+	})
+	if err != nil {
+		return nil, fmt.Errorf("API server response: %s", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if r.BootOnce {
+		b.bootOnce[k] = true
+	} else {
+		delete(b.bootOnce, k)
+	}
+	if r.CacheTTL > 0 {
+		// Not past the expiry of the Spec's IDs.
+		ttl := time.Duration(r.CacheTTL) * time.Second
+		if b.ttl > 0 && b.ttl < ttl {
+			ttl = b.ttl
+		}
+		b.cache[k] = &apiCacheEntry{
+			arch:     m.Arch,
+			firmware: m.Firmware,
+			ip:       m.IP,
+			spec:     spec,
+			expires:  signed.Add(ttl),
+		}
+	}
+	return spec, nil
+}
+
+// Booted tells a v2 API server that m booted, if it was given a
+// boot-once Spec. The cached response for m is dropped, since the
+// server likely wants to boot it differently now.
+func (b *apibooter) Booted(m types.Machine) error {
+	if b.version != 2 {
+		return nil
+	}
+	k := m.MAC.String()
+	b.mu.Lock()
+	once := b.bootOnce[k]
+	delete(b.bootOnce, k)
+	if once {
+		delete(b.cache, k)
+	}
+	b.mu.Unlock()
+	if !once {
+		return nil
+	}
+
+	req, err := json.Marshal(newAPIMachine(m))
+	if err != nil {
+		return err
+	}
+	reqURL := b.urlPrefix + "/booted"
+	resp, err := b.client.Post(reqURL, "application/json", bytes.NewReader(req))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", reqURL, http.StatusText(resp.StatusCode))
+	}
+	return nil
+}
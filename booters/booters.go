@@ -16,9 +16,10 @@
 package booters
 
 import (
-	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/kairos-io/netboot/constants"
 	"github.com/kairos-io/netboot/types"
 	"github.com/kairos-io/netboot/utils"
 	"io"
@@ -26,48 +27,162 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
-	"text/template"
+	"sync"
 	"time"
 )
 
 // StaticBooter boots all machines with the same Spec.
 //
-// IDs in spec should be either local file paths, or HTTP/HTTPS URLs.
+// IDs in spec should be either local file paths, HTTP/HTTPS URLs, or
+// oci:// references to layers in an OCI registry (see OpenOCI).
+// Digests and Signatures in spec are keyed by those same IDs. If spec
+// has a Menu, each entry has its own IDs, Digests and Signatures.
+//
+// To boot machines of different architectures with different Specs,
+// use ArchStaticBooter.
 func StaticBooter(spec *types.Spec) (types.Booter, error) {
+	return StaticBooterWithUploads(spec, "")
+}
+
+// StaticBooterWithUploads is like StaticBooter, and also lets
+// machines upload files (logs, hardware inventory, install
+// results...) into uploadDir, in a subdirectory named after their MAC
+// address, like "01-02-03-04-05-06".
+//
+// The cmdline of spec says where each machine should upload what with
+// {{ Upload "<name>" }}, which expands to a URL that the machine can
+// POST the content of <name> to.
+func StaticBooterWithUploads(spec *types.Spec, uploadDir string) (types.Booter, error) {
 	var ret *staticBooter
-	if spec.Efi != "" {
+	// Our IDs for the spec's, to translate its digests.
+	ids := map[types.ID]types.ID{}
+	if spec.Menu != nil {
+		if spec.Kernel != "" || spec.Efi != "" || len(spec.UKI) > 0 {
+			return nil, errors.New("spec has both a menu and a kernel, EFI image or UKI")
+		}
+		ret = &staticBooter{
+			spec: &types.Spec{
+				Message: spec.Message,
+				Loader:  spec.Loader,
+			},
+		}
+		// Each entry is served by its own staticBooter, under IDs
+		// namespaced by its index, and has its own digests.
+		menu, err := mapMenu(spec.Menu, func(entry *types.Spec) (*types.Spec, error) {
+			b, err := StaticBooterWithUploads(entry, uploadDir)
+			if err != nil {
+				return nil, err
+			}
+			ret.entries = append(ret.entries, b.(*staticBooter))
+			return entry, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		ret.spec.Menu = &types.Menu{Default: menu.Default, Timeout: menu.Timeout}
+		for _, entry := range menu.Entries {
+			ret.spec.Menu.Entries = append(ret.spec.Menu.Entries, types.MenuEntry{Name: entry.Name})
+		}
+	} else if spec.Efi != "" {
 		ret = &staticBooter{
 			efi: string(spec.Efi),
 			spec: &types.Spec{
 				Efi:     "efi",
 				Message: spec.Message,
+				Loader:  spec.Loader,
 			},
 		}
-	} else {
+		ids[spec.Efi] = "efi"
+	} else if len(spec.UKI) > 0 {
+		if spec.Kernel != "" {
+			return nil, errors.New("spec has both UKIs and a kernel")
+		}
+		ret = &staticBooter{
+			spec: &types.Spec{
+				Message: spec.Message,
+				Loader:  spec.Loader,
+			},
+		}
+		for i, uki := range spec.UKI {
+			ret.uki = append(ret.uki, string(uki))
+			ret.spec.UKI = append(ret.spec.UKI, types.ID(fmt.Sprintf("uki-%d", i)))
+			ids[uki] = ret.spec.UKI[i]
+		}
+	} else if spec.Kernel != "" {
 		ret = &staticBooter{
 			kernel: string(spec.Kernel),
 			spec: &types.Spec{
 				Kernel:  "kernel",
 				Message: spec.Message,
+				Loader:  spec.Loader,
+			},
+		}
+		ids[spec.Kernel] = "kernel"
+	} else {
+		// Only an iPXE template, which references its own files.
+		ret = &staticBooter{
+			spec: &types.Spec{
+				Message: spec.Message,
+				Loader:  spec.Loader,
 			},
 		}
+	}
+
+	if ret.spec.Kernel != "" || ret.spec.Efi != "" || len(ret.spec.UKI) > 0 {
 		for i, initrd := range spec.Initrd {
 			ret.initrd = append(ret.initrd, string(initrd))
 			ret.spec.Initrd = append(ret.spec.Initrd, types.ID(fmt.Sprintf("initrd-%d", i)))
+			ids[initrd] = ret.spec.Initrd[i]
+		}
+		ret.spec.InitrdNames = spec.InitrdNames
+	}
+
+	other := func(id string) string {
+		ret.otherIDs = append(ret.otherIDs, id)
+		ids[types.ID(id)] = types.ID(fmt.Sprintf("other-%d", len(ret.otherIDs)-1))
+		return string(ids[types.ID(id)])
+	}
+	upload := func(name string) (string, error) {
+		if uploadDir == "" {
+			return "", errors.New("uploads are not enabled")
 		}
-		f := func(id string) string {
-			ret.otherIDs = append(ret.otherIDs, id)
-			return fmt.Sprintf("{{ ID \"other-%d\" }}", len(ret.otherIDs)-1)
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return "", fmt.Errorf("invalid upload name %q", name)
 		}
-		cmdline, err := utils.ExpandCmdline(spec.Cmdline, template.FuncMap{"ID": f})
+		ret.uploads = append(ret.uploads, name)
+		return fmt.Sprintf("upload-%d", len(ret.uploads)-1), nil
+	}
+	translate := func(fn, arg string) (string, string, error) {
+		if fn == "ID" {
+			return fn, other(arg), nil
+		}
+		id, err := upload(arg)
+		return fn, id, err
+	}
+	if ret.spec.Kernel != "" || ret.spec.Efi != "" || len(ret.spec.UKI) > 0 {
+		cmdline, err := rewriteCalls(spec.Cmdline, utils.CmdlineFuncs, translate)
 		if err != nil {
 			return nil, err
 		}
 		ret.spec.Cmdline = cmdline
 	}
+	if spec.IpxeTemplate != "" {
+		tpl, err := rewriteCalls(spec.IpxeTemplate, utils.IpxeTemplateFuncs, translate)
+		if err != nil {
+			return nil, err
+		}
+		ret.spec.IpxeTemplate = tpl
+	} else if ret.spec.Kernel == "" && ret.spec.Efi == "" && len(ret.spec.UKI) == 0 && ret.spec.Menu == nil {
+		return nil, errors.New("spec has no kernel, EFI image, UKI, menu or iPXE template")
+	}
+	ret.uploadDir = uploadDir
+	if err := mapVerification(ret.spec, spec, func(id types.ID) types.ID { return ids[id] }); err != nil {
+		return nil, err
+	}
 
 	return ret, nil
 }
@@ -77,17 +192,123 @@ type staticBooter struct {
 	initrd   []string
 	otherIDs []string
 	efi      string
+	uki      []string
+
+	// Names of the files machines upload, and where they go.
+	uploads   []string
+	uploadDir string
+
+	// Booters of the menu entries, if spec has a Menu.
+	entries []*staticBooter
 
 	spec *types.Spec
 }
 
 func (s *staticBooter) BootSpec(m types.Machine) (*types.Spec, error) {
-	return s.spec, nil
+	if s.spec.Menu != nil {
+		ret := *s.spec
+		ret.Menu = &types.Menu{Default: s.spec.Menu.Default, Timeout: s.spec.Menu.Timeout}
+		for i, b := range s.entries {
+			spec, err := b.BootSpec(m)
+			if err != nil {
+				return nil, err
+			}
+			if spec, err = namespaceSpec(spec, namespace("entry", i)); err != nil {
+				return nil, err
+			}
+			ret.Menu.Entries = append(ret.Menu.Entries, types.MenuEntry{Name: s.spec.Menu.Entries[i].Name, Spec: *spec})
+		}
+		return &ret, nil
+	}
+	if len(s.uploads) == 0 {
+		return s.ociDigests(s.spec)
+	}
+	// Upload IDs say which machine is uploading.
+	ret := *s.spec
+	f := func(fn, id string) (string, string, error) {
+		if fn == "Upload" {
+			id += "/" + m.MAC.String()
+		}
+		return fn, id, nil
+	}
+	var err error
+	if ret.Cmdline, err = rewriteCalls(s.spec.Cmdline, utils.CmdlineFuncs, f); err != nil {
+		return nil, err
+	}
+	if ret.IpxeTemplate, err = rewriteCalls(s.spec.IpxeTemplate, utils.IpxeTemplateFuncs, f); err != nil {
+		return nil, err
+	}
+	return s.ociDigests(&ret)
+}
+
+// files returns the paths of the files that s serves, by ID.
+func (s *staticBooter) files() map[types.ID]string {
+	ret := map[types.ID]string{}
+	if s.kernel != "" {
+		ret["kernel"] = s.kernel
+	}
+	if s.efi != "" {
+		ret["efi"] = s.efi
+	}
+	for i, p := range s.initrd {
+		ret[types.ID(fmt.Sprintf("initrd-%d", i))] = p
+	}
+	for i, p := range s.uki {
+		ret[types.ID(fmt.Sprintf("uki-%d", i))] = p
+	}
+	for i, p := range s.otherIDs {
+		ret[types.ID(fmt.Sprintf("other-%d", i))] = p
+	}
+	return ret
+}
+
+// ociDigests returns spec, or a copy of it with the digests of its
+// files in OCI registries that it has no digest for, so that the
+// server verifies layers before serving them.
+func (s *staticBooter) ociDigests(spec *types.Spec) (*types.Spec, error) {
+	var ret *types.Spec
+	for id, p := range s.files() {
+		if !strings.HasPrefix(p, "oci://") || spec.Digests[id] != "" {
+			continue
+		}
+		digest, err := OCIDigest(p)
+		if err != nil {
+			return nil, err
+		}
+		if ret == nil {
+			cp := *spec
+			cp.Digests = make(map[types.ID]string, len(spec.Digests)+1)
+			for k, v := range spec.Digests {
+				cp.Digests[k] = v
+			}
+			ret = &cp
+		}
+		ret.Digests[id] = digest
+	}
+	if ret == nil {
+		return spec, nil
+	}
+	return ret, nil
 }
 
+// How long the servers that Booters fetch files from can take to
+// answer, and to send manifests and tokens. Files can be big, reading
+// them isn't bounded.
+const fileTimeout = 30 * time.Second
+
+// fileClient fetches boot files from HTTP servers and OCI registries.
+var fileClient = &http.Client{Transport: func() http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = fileTimeout
+	return transport
+}()}
+
 func (s *staticBooter) serveFile(path string) (io.ReadCloser, int64, error) {
+	if strings.HasPrefix(path, "oci://") {
+		return OpenOCI(path)
+	}
 	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
-		resp, err := http.Get(path)
+		resp, err := fileClient.Get(path)
 		if err != nil {
 			return nil, -1, err
 		}
@@ -109,9 +330,25 @@ func (s *staticBooter) serveFile(path string) (io.ReadCloser, int64, error) {
 	return f, fi.Size(), nil
 }
 
+// entry returns the booter of the menu entry that id belongs to, and
+// the booter's own ID for it.
+func (s *staticBooter) entry(id types.ID) (*staticBooter, types.ID, error) {
+	i, rest, err := splitNamespace(id, "entry")
+	if err != nil || i >= len(s.entries) {
+		return nil, "", fmt.Errorf("no file with ID %q", id)
+	}
+	return s.entries[i], rest, nil
+}
+
 func (s *staticBooter) ReadBootFile(id types.ID) (io.ReadCloser, int64, error) {
 	path := string(id)
 	switch {
+	case strings.HasPrefix(path, "entry-"):
+		b, rest, err := s.entry(id)
+		if err != nil {
+			return nil, -1, err
+		}
+		return b.ReadBootFile(rest)
 	case path == "kernel":
 		return s.serveFile(s.kernel)
 	case path == "efi":
@@ -122,6 +359,12 @@ func (s *staticBooter) ReadBootFile(id types.ID) (io.ReadCloser, int64, error) {
 			return nil, -1, fmt.Errorf("no file with ID %q", id)
 		}
 		return s.serveFile(s.initrd[i])
+	case strings.HasPrefix(path, "uki-"):
+		i, err := strconv.Atoi(path[4:])
+		if err != nil || i < 0 || i >= len(s.uki) {
+			return nil, -1, fmt.Errorf("no file with ID %q", id)
+		}
+		return s.serveFile(s.uki[i])
 
 	case strings.HasPrefix(path, "other-"):
 		i, err := strconv.Atoi(path[6:])
@@ -134,23 +377,257 @@ func (s *staticBooter) ReadBootFile(id types.ID) (io.ReadCloser, int64, error) {
 	return nil, -1, fmt.Errorf("no file with ID %q", id)
 }
 
-func (s *staticBooter) WriteBootFile(types.ID, io.Reader) error {
+func (s *staticBooter) WriteBootFile(id types.ID, body io.Reader) error {
+	if strings.HasPrefix(string(id), "entry-") {
+		b, rest, err := s.entry(id)
+		if err != nil {
+			return err
+		}
+		return b.WriteBootFile(rest, body)
+	}
+	name, mac, err := s.upload(id)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(s.uploadDir, strings.ReplaceAll(mac.String(), ":", "-"))
+	if err = os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// CheckClient only lets machines upload their own files.
+func (s *staticBooter) CheckClient(m types.Machine, id types.ID) error {
+	if strings.HasPrefix(string(id), "entry-") {
+		b, rest, err := s.entry(id)
+		if err != nil {
+			return err
+		}
+		return b.CheckClient(m, rest)
+	}
+	if !strings.HasPrefix(string(id), "upload-") {
+		return nil
+	}
+	_, mac, err := s.upload(id)
+	if err != nil {
+		return err
+	}
+	if m.MAC.String() != mac.String() {
+		return fmt.Errorf("upload %q is for another machine", id)
+	}
 	return nil
 }
 
+// upload returns the name of the upload with ID id, and the MAC
+// address of the machine uploading it.
+func (s *staticBooter) upload(id types.ID) (string, net.HardwareAddr, error) {
+	i, macStr, err := splitNamespace(id, "upload")
+	if err != nil || i >= len(s.uploads) {
+		return "", nil, fmt.Errorf("no upload with ID %q", id)
+	}
+	mac, err := net.ParseMAC(string(macStr))
+	if err != nil {
+		return "", nil, fmt.Errorf("no upload with ID %q", id)
+	}
+	return s.uploads[i], mac, nil
+}
+
+// ArchStaticBooter boots machines with a Spec chosen by their
+// architecture. Machines whose architecture has no Spec in archs boot
+// def, or don't netboot if def is nil.
+//
+// IDs in the specs should be either local file paths, or HTTP/HTTPS
+// URLs, as for StaticBooter.
+func ArchStaticBooter(def *types.Spec, archs map[constants.Architecture]*types.Spec) (types.Booter, error) {
+	ret := &archStaticBooter{
+		archs: make(map[constants.Architecture]types.Booter, len(archs)),
+	}
+	if def != nil {
+		b, err := StaticBooter(def)
+		if err != nil {
+			return nil, err
+		}
+		ret.def = b
+	}
+	for arch, spec := range archs {
+		b, err := StaticBooter(spec)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", arch, err)
+		}
+		ret.archs[arch] = b
+	}
+	return ret, nil
+}
+
+// archStaticBooter serves the files of def under the same IDs as
+// StaticBooter, and the files of the per-architecture specs under
+// IDs namespaced by architecture.
+type archStaticBooter struct {
+	def   types.Booter
+	archs map[constants.Architecture]types.Booter
+}
+
+func (b *archStaticBooter) BootSpec(m types.Machine) (*types.Spec, error) {
+	if booter := b.archs[m.Arch]; booter != nil {
+		spec, err := booter.BootSpec(m)
+		if err != nil {
+			return nil, err
+		}
+		return namespaceSpec(spec, namespace("arch", int(m.Arch)))
+	}
+	if b.def == nil {
+		return nil, nil
+	}
+	return b.def.BootSpec(m)
+}
+
+func (b *archStaticBooter) booter(id types.ID) (types.Booter, types.ID, error) {
+	if !strings.HasPrefix(string(id), "arch-") {
+		if b.def == nil {
+			return nil, "", fmt.Errorf("no file with ID %q", id)
+		}
+		return b.def, id, nil
+	}
+	i, rest, err := splitNamespace(id, "arch")
+	if err != nil {
+		return nil, "", err
+	}
+	booter := b.archs[constants.Architecture(i)]
+	if booter == nil {
+		return nil, "", fmt.Errorf("no file with ID %q", id)
+	}
+	return booter, rest, nil
+}
+
+func (b *archStaticBooter) ReadBootFile(id types.ID) (io.ReadCloser, int64, error) {
+	booter, rest, err := b.booter(id)
+	if err != nil {
+		return nil, -1, err
+	}
+	return booter.ReadBootFile(rest)
+}
+
+func (b *archStaticBooter) WriteBootFile(id types.ID, body io.Reader) error {
+	booter, rest, err := b.booter(id)
+	if err != nil {
+		return err
+	}
+	return booter.WriteBootFile(rest, body)
+}
+
+func (b *archStaticBooter) CheckClient(m types.Machine, id types.ID) error {
+	booter, rest, err := b.booter(id)
+	if err != nil {
+		return err
+	}
+	return checkClient(booter, m, rest)
+}
+
+func (b *archStaticBooter) FileName(id types.ID) (string, error) {
+	booter, rest, err := b.booter(id)
+	if err != nil {
+		return "", err
+	}
+	return fileName(booter, id, rest)
+}
+
+func (b *archStaticBooter) Booted(m types.Machine) error {
+	if booter := b.archs[m.Arch]; booter != nil {
+		return bootedAll(m, booter)
+	}
+	if b.def == nil {
+		return nil
+	}
+	return bootedAll(m, b.def)
+}
+
 // APIBooter gets a BootSpec from a remote server over HTTP.
 //
+// opts configure authentication, TLS and proxying, for both API calls
+// and the fetching of boot files. Headers set by opts, including
+// credentials, are only sent to the API server's host. Boot file
+// fetches aren't subject to timeout, as they can take a while.
+//
 // The API is described in README.api.md
-func APIBooter(url string, timeout time.Duration) (types.Booter, error) {
+func APIBooter(url string, timeout time.Duration, opts ...utils.HTTPClientOption) (types.Booter, error) {
+	return NewAPIBooter(url, APIOptions{Version: 1, Timeout: timeout, Client: opts})
+}
+
+// APIOptions configure NewAPIBooter.
+type APIOptions struct {
+	// Version of the API, 1 (see APIBooter) or 2 (see APIBooterV2).
+	Version int
+	// Timeout of API calls, or 0 for none.
+	Timeout time.Duration
+	// Client configures authentication, TLS and proxying, as for
+	// APIBooter.
+	Client []utils.HTTPClientOption
+
+	// Keys sign the IDs of the boot files, which are their URLs. If
+	// nil, a random key is used, and IDs handed out before a restart
+	// stop working.
+	Keys *utils.KeySet
+	// URLTTL, if non-zero, is how long IDs stay valid for.
+	URLTTL time.Duration
+	// BindMAC and BindIP restrict IDs to the machine they were made
+	// for, identified by its MAC address or its IP address when it
+	// fetched the boot script. The server only knows the MAC address
+	// of a request from its file token, so BindMAC requires
+	// server.Server.FileTokenLifetime, or clients can claim any MAC
+	// address. Binding to the IP address breaks cmdline URLs if the
+	// OS gets a different address.
+	BindMAC bool
+	BindIP  bool
+}
+
+// NewAPIBooter gets a BootSpec from a remote server over HTTP, as
+// APIBooter or APIBooterV2 do depending on opts.Version.
+func NewAPIBooter(url string, opts APIOptions) (types.Booter, error) {
+	if opts.Version != 1 && opts.Version != 2 {
+		return nil, fmt.Errorf("unsupported API version %d", opts.Version)
+	}
 	if !strings.HasSuffix(url, "/") {
 		url += "/"
 	}
-	ret := &apibooter{
-		client:    &http.Client{Timeout: timeout},
-		urlPrefix: url + "v1",
+	client, err := utils.NewHTTPClient(url, opts.Timeout, opts.Client...)
+	if err != nil {
+		return nil, err
+	}
+	files, err := utils.NewHTTPClient(url, 0, opts.Client...)
+	if err != nil {
+		return nil, err
 	}
-	if _, err := io.ReadFull(rand.Reader, ret.key[:]); err != nil {
-		return nil, fmt.Errorf("failed to get randomness for signing key: %s", err)
+	ret := &apibooter{
+		client:    client,
+		files:     files,
+		urlPrefix: fmt.Sprintf("%sv%d", url, opts.Version),
+		version:   opts.Version,
+		keys:      opts.Keys,
+		ttl:       opts.URLTTL,
+		bindMAC:   opts.BindMAC,
+		bindIP:    opts.BindIP,
+		cache:     map[string]*apiCacheEntry{},
+		bootOnce:  map[string]bool{},
+	}
+	if ret.keys == nil {
+		if ret.keys, err = utils.RandomKeySet(); err != nil {
+			return nil, err
+		}
 	}
 
 	return ret, nil
@@ -158,8 +635,22 @@ func APIBooter(url string, timeout time.Duration) (types.Booter, error) {
 
 type apibooter struct {
 	client    *http.Client
+	files     *http.Client
 	urlPrefix string
-	key       [32]byte
+	version   int
+
+	keys    *utils.KeySet
+	ttl     time.Duration
+	bindMAC bool
+	bindIP  bool
+
+	mu sync.Mutex
+	// Responses to v2 requests that the API server allowed us to
+	// cache, by MAC address.
+	cache map[string]*apiCacheEntry
+	// MACs of machines that were given a boot-once Spec, and haven't
+	// booted it yet.
+	bootOnce map[string]bool
 }
 
 func (b *apibooter) getAPIResponse(hw net.HardwareAddr) (io.ReadCloser, error) {
@@ -177,6 +668,9 @@ func (b *apibooter) getAPIResponse(hw net.HardwareAddr) (io.ReadCloser, error) {
 }
 
 func (b *apibooter) BootSpec(m types.Machine) (*types.Spec, error) {
+	if b.version == 2 {
+		return b.bootSpecV2(m)
+	}
 	body, err := b.getAPIResponse(m.MAC)
 	if body != nil {
 		defer body.Close()
@@ -185,16 +679,64 @@ func (b *apibooter) BootSpec(m types.Machine) (*types.Spec, error) {
 		return nil, err
 	}
 
-	r := struct {
-		Kernel     string      `json:"kernel"`
-		Initrd     []string    `json:"initrd"`
-		Cmdline    interface{} `json:"cmdline"`
-		Message    string      `json:"message"`
-		IpxeScript string      `json:"ipxe-script"`
-	}{}
+	var r apiSpec
 	if err = json.NewDecoder(body).Decode(&r); err != nil {
 		return nil, err
 	}
+	return b.makeSpec(m, &r, "", nil, nil)
+}
+
+// apiSpec is the API server's answer to a boot request. It is a
+// types.Spec, except that file URLs in the cmdline and the iPXE
+// template are given as {{ URL "<url>" }}.
+type apiSpec struct {
+	Kernel       string      `json:"kernel"`
+	Initrd       []string    `json:"initrd"`
+	InitrdNames  []string    `json:"initrd-names"`
+	Cmdline      interface{} `json:"cmdline"`
+	Message      string      `json:"message"`
+	Loader       string      `json:"loader"`
+	Menu         *apiMenu    `json:"menu"`
+	IpxeTemplate string      `json:"ipxe-template"`
+	IpxeScript   string      `json:"ipxe-script"`
+}
+
+// apiMenu is the menu of an apiSpec, as a types.Menu.
+type apiMenu struct {
+	Entries []apiMenuEntry `json:"entries"`
+	Default string         `json:"default"`
+	Timeout int            `json:"timeout"`
+}
+
+type apiMenuEntry struct {
+	Name string `json:"name"`
+	apiSpec
+	// Efi and UKI are only used by v2 API servers, as in apiSpecV2.
+	Efi string   `json:"efi"`
+	UKI []string `json:"uki"`
+}
+
+// makeSpec turns r into a Spec for m whose IDs are signed URLs. If
+// efi is set, the machine boots that EFI image instead of a kernel,
+// and if ukis is, one of those Unified Kernel Images. If ids isn't
+// nil, it is filled with the ID of each URL.
+func (b *apibooter) makeSpec(m types.Machine, r *apiSpec, efi string, ukis []string, ids map[string]types.ID) (*types.Spec, error) {
+	opts := utils.SignOptions{TTL: b.ttl}
+	if b.bindMAC {
+		opts.MAC = m.MAC
+	}
+	if b.bindIP {
+		// Unknown when the server only asks whether m netboots, and
+		// won't hand out the Spec.
+		opts.IP = m.IP
+	}
+	sign := func(u string) (types.ID, error) {
+		id, err := b.keys.SignURL(u, opts)
+		if err == nil && ids != nil {
+			ids[u] = id
+		}
+		return id, err
+	}
 
 	if r.IpxeScript != "" {
 		return &types.Spec{
@@ -202,8 +744,70 @@ func (b *apibooter) BootSpec(m types.Machine) (*types.Spec, error) {
 		}, nil
 	}
 
-	r.Kernel, err = b.makeURLAbsolute(r.Kernel)
-	if err != nil {
+	var tmpl string
+	if r.IpxeTemplate != "" {
+		var err error
+		tmpl, err = rewriteCalls(r.IpxeTemplate, []string{"URL", "Upload", "Booting"}, func(fn, u string) (string, string, error) {
+			if fn != "URL" {
+				return fn, u, nil
+			}
+			urlStr, err := b.makeURLAbsolute(u)
+			if err != nil {
+				return "", "", fmt.Errorf("invalid url %q for iPXE template: %s", u, err)
+			}
+			id, err := sign(urlStr)
+			return "ID", string(id), err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if r.Kernel == "" && efi == "" && len(ukis) == 0 && r.Menu == nil {
+			return &types.Spec{
+				Message:      r.Message,
+				Loader:       r.Loader,
+				IpxeTemplate: tmpl,
+			}, nil
+		}
+	}
+
+	if r.Menu != nil {
+		if r.Kernel != "" || efi != "" || len(ukis) > 0 {
+			return nil, errors.New("API server returned both a menu and a kernel, EFI image or UKI")
+		}
+		menu := &types.Menu{Default: r.Menu.Default, Timeout: r.Menu.Timeout}
+		for i := range r.Menu.Entries {
+			entry := &r.Menu.Entries[i]
+			if b.version != 2 {
+				entry.Efi, entry.UKI = "", nil
+			}
+			spec, err := b.makeSpec(m, &entry.apiSpec, entry.Efi, entry.UKI, ids)
+			if err != nil {
+				return nil, fmt.Errorf("menu entry %q: %s", entry.Name, err)
+			}
+			menu.Entries = append(menu.Entries, types.MenuEntry{Name: entry.Name, Spec: *spec})
+		}
+		ret := types.Spec{
+			Message:      r.Message,
+			Loader:       r.Loader,
+			IpxeTemplate: tmpl,
+		}
+		var err error
+		if ret.Menu, err = mapMenu(menu, func(spec *types.Spec) (*types.Spec, error) { return spec, nil }); err != nil {
+			return nil, err
+		}
+		return &ret, nil
+	}
+
+	var err error
+	image := r.Kernel
+	if efi != "" {
+		image = efi
+	}
+	if len(ukis) > 0 {
+		if image != "" {
+			return nil, errors.New("API server returned both UKIs and a kernel or EFI image")
+		}
+	} else if image, err = b.makeURLAbsolute(image); err != nil {
 		return nil, err
 	}
 	for i, img := range r.Initrd {
@@ -214,13 +818,33 @@ func (b *apibooter) BootSpec(m types.Machine) (*types.Spec, error) {
 	}
 
 	ret := types.Spec{
-		Message: r.Message,
+		InitrdNames:  r.InitrdNames,
+		Message:      r.Message,
+		Loader:       r.Loader,
+		IpxeTemplate: tmpl,
 	}
-	if ret.Kernel, err = utils.SignURL(r.Kernel, &b.key); err != nil {
+	switch {
+	case len(ukis) > 0:
+		for _, u := range ukis {
+			if u, err = b.makeURLAbsolute(u); err != nil {
+				return nil, err
+			}
+			uki, err := sign(u)
+			if err != nil {
+				return nil, err
+			}
+			ret.UKI = append(ret.UKI, uki)
+		}
+	case efi != "":
+		ret.Efi, err = sign(image)
+	default:
+		ret.Kernel, err = sign(image)
+	}
+	if err != nil {
 		return nil, err
 	}
 	for _, img := range r.Initrd {
-		initrd, err := utils.SignURL(img, &b.key)
+		initrd, err := sign(img)
 		if err != nil {
 			return nil, err
 		}
@@ -241,18 +865,15 @@ func (b *apibooter) BootSpec(m types.Machine) (*types.Spec, error) {
 		}
 	}
 
-	f := func(u string) (string, error) {
+	f := func(fn, u string) (string, string, error) {
 		urlStr, err := b.makeURLAbsolute(u)
 		if err != nil {
-			return "", fmt.Errorf("invalid url %q for cmdline: %s", urlStr, err)
-		}
-		id, err := utils.SignURL(urlStr, &b.key)
-		if err != nil {
-			return "", err
+			return "", "", fmt.Errorf("invalid url %q for cmdline: %s", urlStr, err)
 		}
-		return fmt.Sprintf("{{ ID %q }}", id), nil
+		id, err := sign(urlStr)
+		return "ID", string(id), err
 	}
-	ret.Cmdline, err = utils.ExpandCmdline(ret.Cmdline, template.FuncMap{"URL": f})
+	ret.Cmdline, err = rewriteCalls(ret.Cmdline, []string{"URL"}, f)
 	if err != nil {
 		return nil, err
 	}
@@ -260,8 +881,22 @@ func (b *apibooter) BootSpec(m types.Machine) (*types.Spec, error) {
 	return &ret, nil
 }
 
+// CheckClient checks that id isn't bound to another machine than m.
+func (b *apibooter) CheckClient(m types.Machine, id types.ID) error {
+	_, err := b.keys.GetURL(id, &m)
+	return err
+}
+
+// FileName returns the URL in id, which is the same for all of the IDs
+// of the file.
+func (b *apibooter) FileName(id types.ID) (string, error) {
+	return b.keys.GetURL(id, nil)
+}
+
+// ReadBootFile returns the file at the URL in id. The machine that id
+// may be bound to is checked by CheckClient.
 func (b *apibooter) ReadBootFile(id types.ID) (io.ReadCloser, int64, error) {
-	urlStr, err := utils.GetURL(id, &b.key)
+	urlStr, err := b.keys.GetURL(id, nil)
 	if err != nil {
 		return nil, -1, err
 	}
@@ -274,6 +909,9 @@ func (b *apibooter) ReadBootFile(id types.ID) (io.ReadCloser, int64, error) {
 		ret io.ReadCloser
 		sz  int64
 	)
+	if u.Scheme == "oci" {
+		return OpenOCI(urlStr)
+	}
 	if u.Scheme == "file" {
 		// TODO serveFile
 		f, err := os.Open(u.Path)
@@ -287,14 +925,15 @@ func (b *apibooter) ReadBootFile(id types.ID) (io.ReadCloser, int64, error) {
 		}
 		ret, sz = f, fi.Size()
 	} else {
-		// urlStr will get reparsed by http.Get, which is mildly
+		// urlStr will get reparsed by Get, which is mildly
 		// wasteful, but the code looks nicer than constructing a
 		// Request.
-		resp, err := http.Get(urlStr)
+		resp, err := b.files.Get(urlStr)
 		if err != nil {
 			return nil, -1, err
 		}
 		if resp.StatusCode != 200 {
+			resp.Body.Close()
 			return nil, -1, fmt.Errorf("GET %q failed: %s", urlStr, resp.Status)
 		}
 
@@ -307,12 +946,12 @@ func (b *apibooter) ReadBootFile(id types.ID) (io.ReadCloser, int64, error) {
 }
 
 func (b *apibooter) WriteBootFile(id types.ID, body io.Reader) error {
-	u, err := utils.GetURL(id, &b.key)
+	u, err := b.keys.GetURL(id, nil)
 	if err != nil {
 		return err
 	}
 
-	resp, err := http.Post(u, "application/octet-stream", body)
+	resp, err := b.files.Post(u, "application/octet-stream", body)
 	if err != nil {
 		return err
 	}
@@ -16,21 +16,37 @@
 package booters
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/kairos-io/netboot/booters/ocitest"
 	"github.com/kairos-io/netboot/constants"
 	"github.com/kairos-io/netboot/types"
+	"github.com/kairos-io/netboot/utils"
 )
 
 func mustMAC(s string) net.HardwareAddr {
@@ -136,6 +152,384 @@ func TestStaticBooter(t *testing.T) {
 	}
 }
 
+func TestStaticBooterEfi(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite(dir, "wimboot", "wimboot")
+	mustWrite(dir, "bcd", "a BCD")
+
+	b, err := StaticBooter(&types.Spec{
+		Efi:         types.ID(filepath.Join(dir, "wimboot")),
+		Initrd:      []types.ID{types.ID(filepath.Join(dir, "bcd"))},
+		InitrdNames: []string{"BCD"},
+		Cmdline:     fmt.Sprintf(`gui conf={{ ID %q }}`, filepath.Join(dir, "bcd")),
+	})
+	if err != nil {
+		t.Fatalf("Constructing StaticBooter: %s", err)
+	}
+	spec, err := b.BootSpec(types.Machine{MAC: mustMAC("01:02:03:04:05:06")})
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	want := &types.Spec{
+		Efi:         "efi",
+		Initrd:      []types.ID{"initrd-0"},
+		InitrdNames: []string{"BCD"},
+		Cmdline:     `gui conf={{ ID "other-0" }}`,
+	}
+	if !reflect.DeepEqual(spec, want) {
+		t.Fatalf("Wrong bootspec\ngot:  %#v\nwant: %#v", spec, want)
+	}
+	for id, want := range map[types.ID]string{"efi": "wimboot", "initrd-0": "a BCD", "other-0": "a BCD"} {
+		if got := mustRead(b.ReadBootFile(id)); got != want {
+			t.Fatalf("Wrong content for %q, got %q, want %q", id, got, want)
+		}
+	}
+}
+
+func TestStaticBooterUKI(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite(dir, "x64.efi", "x64 UKI")
+	mustWrite(dir, "arm64.efi", "arm64 UKI")
+	mustWrite(dir, "addon", "an addon")
+
+	b, err := StaticBooter(&types.Spec{
+		UKI:     []types.ID{types.ID(filepath.Join(dir, "x64.efi")), types.ID(filepath.Join(dir, "arm64.efi"))},
+		Initrd:  []types.ID{types.ID(filepath.Join(dir, "addon"))},
+		Cmdline: "quiet",
+		Digests: map[types.ID]string{types.ID(filepath.Join(dir, "arm64.efi")): ocitest.Digest([]byte("arm64 UKI"))},
+	})
+	if err != nil {
+		t.Fatalf("Constructing StaticBooter: %s", err)
+	}
+	spec, err := b.BootSpec(types.Machine{MAC: mustMAC("01:02:03:04:05:06")})
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	want := &types.Spec{
+		UKI:     []types.ID{"uki-0", "uki-1"},
+		Initrd:  []types.ID{"initrd-0"},
+		Cmdline: "quiet",
+		Digests: map[types.ID]string{"uki-1": ocitest.Digest([]byte("arm64 UKI"))},
+	}
+	if !reflect.DeepEqual(spec, want) {
+		t.Fatalf("Wrong bootspec\ngot:  %#v\nwant: %#v", spec, want)
+	}
+	for id, want := range map[types.ID]string{"uki-0": "x64 UKI", "uki-1": "arm64 UKI", "initrd-0": "an addon"} {
+		if got := mustRead(b.ReadBootFile(id)); got != want {
+			t.Fatalf("Wrong content for %q, got %q, want %q", id, got, want)
+		}
+	}
+
+	if _, err = StaticBooter(&types.Spec{Kernel: "k", UKI: []types.ID{"u"}}); err == nil {
+		t.Fatalf("StaticBooter accepted both a kernel and UKIs")
+	}
+}
+
+func TestSpecDigests(t *testing.T) {
+	sig := base64.StdEncoding.EncodeToString(make([]byte, ed25519.SignatureSize))
+	key := base64.StdEncoding.EncodeToString(make([]byte, ed25519.PublicKeySize))
+	spec := &types.Spec{
+		Kernel:  "/boot/vmlinuz",
+		Initrd:  []types.ID{"/boot/initrd"},
+		Cmdline: `config={{ ID "/boot/config" }}`,
+		Digests: map[types.ID]string{
+			"/boot/vmlinuz": ocitest.Digest([]byte("kernel")),
+			"/boot/config":  ocitest.Digest([]byte("config")),
+		},
+		Signatures: map[types.ID]string{"/boot/initrd": sig},
+		PublicKey:  key,
+	}
+	b, err := StaticBooter(spec)
+	if err != nil {
+		t.Fatalf("Constructing StaticBooter: %s", err)
+	}
+	b = FallbackBooter(b)
+	got, err := b.BootSpec(types.Machine{MAC: mustMAC("01:02:03:04:05:06")})
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	want := &types.Spec{
+		Kernel:  "fallback-0/kernel",
+		Initrd:  []types.ID{"fallback-0/initrd-0"},
+		Cmdline: `config={{ ID "fallback-0/other-0" }}`,
+		Digests: map[types.ID]string{
+			"fallback-0/kernel":  ocitest.Digest([]byte("kernel")),
+			"fallback-0/other-0": ocitest.Digest([]byte("config")),
+		},
+		Signatures: map[types.ID]string{"fallback-0/initrd-0": sig},
+		PublicKey:  key,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Wrong spec\nwant: %#v\ngot:  %#v", want, got)
+	}
+
+	for _, bad := range []*types.Spec{
+		{Kernel: "/k", Digests: map[types.ID]string{"/typo": ocitest.Digest(nil)}},
+		{Kernel: "/k", Digests: map[types.ID]string{"/k": "md5:d41d8cd98f00b204e9800998ecf8427e"}},
+		{Kernel: "/k", Signatures: map[types.ID]string{"/k": sig}},
+		{Kernel: "/k", Signatures: map[types.ID]string{"/k": "c2ln"}, PublicKey: key},
+	} {
+		if _, err := StaticBooter(bad); err == nil {
+			t.Fatalf("StaticBooter(%#v) should have failed", bad)
+		}
+	}
+}
+
+func TestCmdlineVarsPassThrough(t *testing.T) {
+	static, err := StaticBooter(&types.Spec{
+		Kernel:  "/k",
+		Cmdline: `hostname=node-{{ .MAC.Dashed }} {{ if .Hostname }}name={{ .Hostname }}{{ end }} conf={{ ID "/c" }}`,
+	})
+	if err != nil {
+		t.Fatalf("Constructing StaticBooter: %s", err)
+	}
+	spec, err := FallbackBooter(static).BootSpec(types.Machine{MAC: mustMAC("01:02:03:04:05:06")})
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	// Variables are left for the server to expand.
+	want := `hostname=node-{{ .MAC.Dashed }} {{ if .Hostname }}name={{ .Hostname }}{{ end }} conf={{ ID "fallback-0/other-0" }}`
+	if spec.Cmdline != want {
+		t.Fatalf("Wrong cmdline, got %q, want %q", spec.Cmdline, want)
+	}
+}
+
+func TestStaticUploads(t *testing.T) {
+	if _, err := StaticBooter(&types.Spec{Kernel: "/k", Cmdline: `log={{ Upload "install.log" }}`}); err == nil {
+		t.Fatalf("StaticBooter without an upload directory accepted Upload")
+	}
+	if _, err := StaticBooterWithUploads(&types.Spec{Kernel: "/k", Cmdline: `log={{ Upload "../x" }}`}, t.TempDir()); err == nil {
+		t.Fatalf("Upload name outside the machine's directory was accepted")
+	}
+
+	dir := t.TempDir()
+	static, err := StaticBooterWithUploads(&types.Spec{Kernel: "/k", Cmdline: `log={{ Upload "install.log" }} foo`}, dir)
+	if err != nil {
+		t.Fatalf("Constructing StaticBooterWithUploads: %s", err)
+	}
+	// Uploads work through combinators too.
+	b := FallbackBooter(static)
+	m := types.Machine{MAC: mustMAC("01:02:03:04:05:06")}
+	spec, err := b.BootSpec(m)
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	want := `log={{ Upload "fallback-0/upload-0/01:02:03:04:05:06" }} foo`
+	if spec.Cmdline != want {
+		t.Fatalf("Wrong cmdline, got %q, want %q", spec.Cmdline, want)
+	}
+
+	id := types.ID("fallback-0/upload-0/01:02:03:04:05:06")
+	checker := b.(types.ClientChecker)
+	if err = checker.CheckClient(m, id); err != nil {
+		t.Fatalf("Machine can't upload its own file: %s", err)
+	}
+	if err = checker.CheckClient(types.Machine{MAC: mustMAC("01:02:03:04:05:07")}, id); err == nil {
+		t.Fatalf("Machine can upload another machine's file")
+	}
+	if err = b.WriteBootFile(id, strings.NewReader("done")); err != nil {
+		t.Fatalf("Writing upload: %s", err)
+	}
+	bs, err := os.ReadFile(filepath.Join(dir, "01-02-03-04-05-06", "install.log"))
+	if err != nil {
+		t.Fatalf("Reading upload: %s", err)
+	}
+	if string(bs) != "done" {
+		t.Fatalf("Wrong upload content %q", bs)
+	}
+	if err = b.WriteBootFile("fallback-0/upload-1/01:02:03:04:05:06", strings.NewReader("x")); err == nil {
+		t.Fatalf("Write to unknown upload succeeded")
+	}
+}
+
+func TestStaticMenu(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite(dir, "kernel", "a kernel")
+	mustWrite(dir, "initrd", "an initrd")
+	mustWrite(dir, "rescue.efi", "an EFI image")
+
+	for _, spec := range []*types.Spec{
+		{Kernel: "/k", Menu: &types.Menu{Entries: []types.MenuEntry{{Name: "a", Spec: types.Spec{Kernel: "/k"}}}}},
+		{Menu: &types.Menu{}},
+		{Menu: &types.Menu{Entries: []types.MenuEntry{{Name: "a", Spec: types.Spec{Kernel: "/k"}}}, Default: "b"}},
+		{Menu: &types.Menu{Entries: []types.MenuEntry{{Name: "a", Spec: types.Spec{Menu: &types.Menu{}}}}}},
+	} {
+		if _, err := StaticBooter(spec); err == nil {
+			t.Fatalf("StaticBooter accepted bad menu spec %#v", spec)
+		}
+	}
+
+	b, err := StaticBooter(&types.Spec{
+		Message: "Pick one",
+		Menu: &types.Menu{
+			Entries: []types.MenuEntry{
+				{Name: "Install", Spec: types.Spec{
+					Kernel:  types.ID(filepath.Join(dir, "kernel")),
+					Initrd:  []types.ID{types.ID(filepath.Join(dir, "initrd"))},
+					Cmdline: fmt.Sprintf(`conf={{ ID %q }}`, filepath.Join(dir, "initrd")),
+				}},
+				{Name: "Rescue", Spec: types.Spec{Efi: types.ID(filepath.Join(dir, "rescue.efi"))}},
+			},
+			Default: "Rescue",
+			Timeout: 5,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Constructing StaticBooter: %s", err)
+	}
+	spec, err := b.BootSpec(types.Machine{MAC: mustMAC("01:02:03:04:05:06")})
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	want := &types.Spec{
+		Message: "Pick one",
+		Menu: &types.Menu{
+			Entries: []types.MenuEntry{
+				{Name: "Install", Spec: types.Spec{
+					Kernel:  "entry-0/kernel",
+					Initrd:  []types.ID{"entry-0/initrd-0"},
+					Cmdline: `conf={{ ID "entry-0/other-0" }}`,
+				}},
+				{Name: "Rescue", Spec: types.Spec{Efi: "entry-1/efi"}},
+			},
+			Default: "Rescue",
+			Timeout: 5,
+		},
+	}
+	if !reflect.DeepEqual(spec, want) {
+		t.Fatalf("Wrong bootspec\ngot:  %#v\nwant: %#v", spec, want)
+	}
+
+	for id, want := range map[types.ID]string{
+		"entry-0/kernel":   "a kernel",
+		"entry-0/initrd-0": "an initrd",
+		"entry-0/other-0":  "an initrd",
+		"entry-1/efi":      "an EFI image",
+	} {
+		if got := mustRead(b.ReadBootFile(id)); got != want {
+			t.Fatalf("Wrong content for %q, got %q, want %q", id, got, want)
+		}
+	}
+	for _, id := range []types.ID{"kernel", "entry-1/kernel", "entry-2/kernel"} {
+		if _, _, err := b.ReadBootFile(id); err == nil {
+			t.Fatalf("Read of unknown file %q succeeded", id)
+		}
+	}
+}
+
+func TestStaticIpxeTemplate(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite(dir, "ipxe.efi", "an EFI image")
+	path := filepath.Join(dir, "ipxe.efi")
+
+	static, err := StaticBooterWithUploads(&types.Spec{
+		IpxeTemplate: fmt.Sprintf(`#!ipxe
+{{ if eq .Machine.Arch 2 }}chain {{ ID %q }} log={{ Upload "log" }}{{ end }}
+`, path),
+	}, t.TempDir())
+	if err != nil {
+		t.Fatalf("Constructing StaticBooter: %s", err)
+	}
+	// IDs in templates are namespaced by combinators too.
+	b := FallbackBooter(static)
+	spec, err := b.BootSpec(types.Machine{MAC: mustMAC("01:02:03:04:05:06")})
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	want := `#!ipxe
+{{ if eq .Machine.Arch 2 }}chain {{ ID "fallback-0/other-0" }} log={{ Upload "fallback-0/upload-0/01:02:03:04:05:06" }}{{ end }}
+`
+	if spec.IpxeTemplate != want {
+		t.Fatalf("Wrong iPXE template\ngot:  %q\nwant: %q", spec.IpxeTemplate, want)
+	}
+	if got := mustRead(b.ReadBootFile("fallback-0/other-0")); got != "an EFI image" {
+		t.Fatalf("Wrong content for template file, got %q", got)
+	}
+
+	if _, err = StaticBooter(&types.Spec{IpxeTemplate: "{{ ID "}); err == nil {
+		t.Fatalf("StaticBooter accepted a broken iPXE template")
+	}
+}
+
+func TestArchStaticBooter(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite(dir, "x64-kernel", "x64 kernel")
+	mustWrite(dir, "arm-kernel", "arm kernel")
+	mustWrite(dir, "arm-initrd", "arm initrd")
+	mustWrite(dir, "arm-dtb", "arm dtb")
+
+	b, err := ArchStaticBooter(
+		&types.Spec{Kernel: types.ID(filepath.Join(dir, "x64-kernel"))},
+		map[constants.Architecture]*types.Spec{
+			constants.ArchArm64: {
+				Kernel:  types.ID(filepath.Join(dir, "arm-kernel")),
+				Initrd:  []types.ID{types.ID(filepath.Join(dir, "arm-initrd"))},
+				Cmdline: fmt.Sprintf(`dtb={{ ID "%s" }}`, filepath.Join(dir, "arm-dtb")),
+			},
+		})
+	if err != nil {
+		t.Fatalf("Constructing ArchStaticBooter: %s", err)
+	}
+
+	spec, err := b.BootSpec(types.Machine{MAC: mustMAC("01:02:03:04:05:06"), Arch: constants.ArchX64})
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	// The default spec keeps StaticBooter's IDs.
+	expected := &types.Spec{Kernel: "kernel"}
+	if !reflect.DeepEqual(spec, expected) {
+		t.Fatalf("Wrong x64 spec:\nwant: %#v\ngot:  %#v", expected, spec)
+	}
+
+	spec, err = b.BootSpec(types.Machine{MAC: mustMAC("01:02:03:04:05:06"), Arch: constants.ArchArm64})
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	expected = &types.Spec{
+		Kernel:  "arch-2/kernel",
+		Initrd:  []types.ID{"arch-2/initrd-0"},
+		Cmdline: `dtb={{ ID "arch-2/other-0" }}`,
+	}
+	if !reflect.DeepEqual(spec, expected) {
+		t.Fatalf("Wrong arm64 spec:\nwant: %#v\ngot:  %#v", expected, spec)
+	}
+
+	fs := map[types.ID]string{
+		"kernel":          "x64 kernel",
+		"arch-2/kernel":   "arm kernel",
+		"arch-2/initrd-0": "arm initrd",
+		"arch-2/other-0":  "arm dtb",
+	}
+	for id, contents := range fs {
+		if v := mustRead(b.ReadBootFile(id)); v != contents {
+			t.Fatalf("Wrong file contents for %q: wanted %q, got %q", id, contents, v)
+		}
+	}
+	for _, id := range []types.ID{"arch-1/kernel", "arch-2/initrd-1", "arch-x/kernel"} {
+		if _, _, err := b.ReadBootFile(id); err == nil {
+			t.Fatalf("ReadBootFile(%q) should fail", id)
+		}
+	}
+	// Uploads aren't enabled, and mustn't be silently dropped.
+	if err := b.WriteBootFile("arch-2/upload-0/01:02:03:04:05:06", strings.NewReader("log")); err == nil {
+		t.Fatalf("WriteBootFile should fail without uploads")
+	}
+
+	// Without a default, other architectures don't netboot.
+	b, err = ArchStaticBooter(nil, map[constants.Architecture]*types.Spec{
+		constants.ArchArm64: {Kernel: types.ID(filepath.Join(dir, "arm-kernel"))},
+	})
+	if err != nil {
+		t.Fatalf("Constructing ArchStaticBooter: %s", err)
+	}
+	if spec, err = b.BootSpec(types.Machine{MAC: mustMAC("01:02:03:04:05:06"), Arch: constants.ArchX64}); spec != nil || err != nil {
+		t.Fatalf("x64 machine should not netboot, got %#v, %v", spec, err)
+	}
+	if _, _, err := b.ReadBootFile("kernel"); err == nil {
+		t.Fatal("ReadBootFile(\"kernel\") should fail without a default spec")
+	}
+}
+
 func TestAPIBooter(t *testing.T) {
 	// Set up an HTTP server to act as a (terrible) API server
 	l, err := net.Listen("tcp", "127.0.0.1:0")
@@ -200,4 +594,1097 @@ func TestAPIBooter(t *testing.T) {
 			t.Fatalf("Wrong file contents for %q: wanted %q, got %q", id, contents, v)
 		}
 	}
+
+	// Every ID of a file has the same name, also through combinators.
+	fb := FallbackBooter(b)
+	fspec, err := fb.BootSpec(m)
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	want := fmt.Sprintf("http://%s/foo", l.Addr())
+	if name, err := b.(types.FileNamer).FileName(spec.Kernel); err != nil || name != want {
+		t.Fatalf("Wrong name for the kernel, want %q, got %q (%v)", want, name, err)
+	}
+	if name, err := fb.(types.FileNamer).FileName(fspec.Kernel); err != nil || name != "fallback-0/"+want {
+		t.Fatalf("Wrong name for the kernel through FallbackBooter, want %q, got %q (%v)", "fallback-0/"+want, name, err)
+	}
+}
+
+func TestAPIBooterV2(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []map[string]string
+		booted   []map[string]string
+	)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m map[string]string
+		if r.Method == "POST" {
+			if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/v2/boot":
+			requests = append(requests, m)
+			switch m["mac"] {
+			case "01:02:03:04:05:06":
+				fmt.Fprintf(w, `{
+  "kernel": "/kernel",
+  "initrd": ["/initrd"],
+  "cmdline": {"foo": "bar"},
+  "checksums": {"/kernel": %q, "/initrd": "sha256:%064x"},
+  "boot-once": true,
+  "cache-ttl": 60
+}`, ocitest.Digest([]byte("kernel")), 0)
+			case "01:02:03:04:05:07":
+				w.Write([]byte(`{"efi": "/efi"}`))
+			default:
+				w.WriteHeader(http.StatusNoContent)
+			}
+		case "/v2/booted":
+			booted = append(booted, m)
+		case "/kernel":
+			w.Write([]byte("kernel"))
+		case "/initrd":
+			w.Write([]byte("corrupted initrd"))
+		case "/efi":
+			w.Write([]byte("efi"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	b, err := APIBooterV2(api.URL, time.Second)
+	if err != nil {
+		t.Fatalf("Constructing APIBooterV2: %s", err)
+	}
+
+	m := types.Machine{
+		MAC:         mustMAC("01:02:03:04:05:06"),
+		Arch:        constants.ArchX64,
+		Firmware:    constants.FirmwareEFI64,
+		GUID:        []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10},
+		VendorClass: "PXEClient:Arch:00007:UNDI:003016",
+		RelayAddr:   net.IPv4(192, 168, 1, 1),
+		Interface:   "eth0",
+	}
+	spec, err := b.BootSpec(m)
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	want := map[string]string{
+		"mac":          "01:02:03:04:05:06",
+		"arch":         "X64",
+		"firmware":     "efi64",
+		"guid":         "04030201-0605-0807-090a-0b0c0d0e0f10",
+		"vendor-class": "PXEClient:Arch:00007:UNDI:003016",
+		"relay":        "192.168.1.1",
+		"interface":    "eth0",
+	}
+	if len(requests) != 1 || !reflect.DeepEqual(requests[0], want) {
+		t.Fatalf("Wrong API request %v, want %v", requests, want)
+	}
+	if spec.Cmdline != `foo="bar"` {
+		t.Fatalf("Wrong cmdline %q", spec.Cmdline)
+	}
+	if v := mustRead(b.ReadBootFile(spec.Kernel)); v != "kernel" {
+		t.Fatalf("Wrong kernel %q", v)
+	}
+	wantDigests := map[types.ID]string{
+		spec.Kernel:    ocitest.Digest([]byte("kernel")),
+		spec.Initrd[0]: fmt.Sprintf("sha256:%064x", 0),
+	}
+	if !reflect.DeepEqual(spec.Digests, wantDigests) {
+		t.Fatalf("Wrong digests %v, want %v", spec.Digests, wantDigests)
+	}
+
+	// The response is cached, also once the machine's IP address is
+	// known, until the machine boots it.
+	m.IP = net.IPv4(192, 168, 1, 23)
+	if _, err = b.BootSpec(m); err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("Cached response wasn't used, got %d API requests", len(requests))
+	}
+	m.Firmware = constants.FirmwarePixiecoreIpxe
+	if _, err = b.BootSpec(m); err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("Cached response was used for another firmware, got %d API requests", len(requests))
+	}
+	if err = b.(types.BootNotifier).Booted(m); err != nil {
+		t.Fatalf("Booted: %s", err)
+	}
+	if len(booted) != 1 || booted[0]["mac"] != "01:02:03:04:05:06" {
+		t.Fatalf("Wrong booted notifications %v", booted)
+	}
+	if _, err = b.BootSpec(m); err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	if len(requests) != 3 {
+		t.Fatalf("Cached response was used after boot, got %d API requests", len(requests))
+	}
+
+	// Cached responses don't outlive the IDs in them.
+	short, err := NewAPIBooter(api.URL, APIOptions{Version: 2, Timeout: time.Second, URLTTL: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Constructing APIBooterV2: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err = short.BootSpec(m); err != nil {
+			t.Fatalf("Getting bootspec: %s", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(requests) != 5 {
+		t.Fatalf("Cached response outlived its URL TTL, got %d API requests", len(requests))
+	}
+
+	// With URLs bound to IP addresses, responses signed before the
+	// machine's IP address was known aren't used once it is.
+	keys, err := utils.LoadKeySet(filepath.Join(t.TempDir(), "keys"), 0)
+	if err != nil {
+		t.Fatalf("Creating keys: %s", err)
+	}
+	bound, err := NewAPIBooter(api.URL, APIOptions{Version: 2, Timeout: time.Second, Keys: keys, URLTTL: time.Minute, BindIP: true})
+	if err != nil {
+		t.Fatalf("Constructing APIBooterV2: %s", err)
+	}
+	for _, c := range []struct {
+		ip       net.IP
+		requests int
+	}{
+		{nil, 6},
+		{net.IPv4(192, 168, 1, 23), 7},
+		{net.IPv4(192, 168, 1, 23), 7},
+	} {
+		m.IP = c.ip
+		if _, err = bound.BootSpec(m); err != nil {
+			t.Fatalf("Getting bootspec: %s", err)
+		}
+		if len(requests) != c.requests {
+			t.Fatalf("Wrong use of cached responses with IP %s, got %d API requests, want %d", c.ip, len(requests), c.requests)
+		}
+	}
+
+	spec, err = b.BootSpec(types.Machine{MAC: mustMAC("01:02:03:04:05:07")})
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	if spec.Kernel != "" || spec.Efi == "" {
+		t.Fatalf("Wrong EFI spec %#v", spec)
+	}
+	if v := mustRead(b.ReadBootFile(spec.Efi)); v != "efi" {
+		t.Fatalf("Wrong EFI image %q", v)
+	}
+
+	spec, err = b.BootSpec(types.Machine{MAC: mustMAC("01:02:03:04:05:08")})
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	if spec != nil {
+		t.Fatalf("Machine shouldn't netboot, got %#v", spec)
+	}
+}
+
+func TestAPIBooterBoundURLs(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/boot/01:02:03:04:05:06":
+			w.Write([]byte(`{"kernel": "/kernel"}`))
+		case "/kernel":
+			w.Write([]byte("kernel"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	keys, err := utils.LoadKeySet(filepath.Join(t.TempDir(), "keys"), 0)
+	if err != nil {
+		t.Fatalf("Creating keys: %s", err)
+	}
+	opts := APIOptions{Version: 1, Keys: keys, URLTTL: time.Minute, BindMAC: true, BindIP: true}
+	b, err := NewAPIBooter(api.URL, opts)
+	if err != nil {
+		t.Fatalf("Constructing APIBooter: %s", err)
+	}
+	b = FallbackBooter(b)
+	m := types.Machine{MAC: mustMAC("01:02:03:04:05:06"), IP: net.IPv4(192, 168, 1, 23)}
+	spec, err := b.BootSpec(m)
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+
+	checker := b.(types.ClientChecker)
+	if err = checker.CheckClient(m, spec.Kernel); err != nil {
+		t.Fatalf("Kernel refused to the machine it's for: %s", err)
+	}
+	other := types.Machine{MAC: m.MAC, IP: net.IPv4(192, 168, 1, 24)}
+	if err = checker.CheckClient(other, spec.Kernel); err == nil {
+		t.Fatal("Kernel allowed to another machine")
+	}
+
+	// With the same keys, IDs survive a restart.
+	b, err = NewAPIBooter(api.URL, opts)
+	if err != nil {
+		t.Fatalf("Constructing APIBooter: %s", err)
+	}
+	b = FallbackBooter(b)
+	if v := mustRead(b.ReadBootFile(spec.Kernel)); v != "kernel" {
+		t.Fatalf("Wrong kernel %q", v)
+	}
+}
+
+func TestRulesBooter(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite(dir, "x64-kernel", "x64 kernel")
+	mustWrite(dir, "arm-kernel", "arm kernel")
+	mustWrite(dir, "lab-kernel", "lab kernel")
+	mustWrite(dir, "rules.yaml", fmt.Sprintf(`
+- name: blocked
+  mac: ["01:02:03:00:00:00..01-02-03-00-00-ff"]
+  ignore: true
+- name: lab
+  mac: ["01-02-03"]
+  guid: ["030201000504070608090A0B0C0D0E0F"]
+  spec:
+    kernel: %[1]s/lab-kernel
+    cmdline: 'conf={{ ID "%[1]s/x64-kernel" }}'
+- name: arm
+  arch: [arm64]
+  vendor-class: ["PXEClient:Arch:0000b:*"]
+  spec: {kernel: %[1]s/arm-kernel}
+- name: default
+  arch: [x64]
+  spec: {kernel: %[1]s/x64-kernel}
+`, dir))
+
+	rules, err := LoadRules(filepath.Join(dir, "rules.yaml"))
+	if err != nil {
+		t.Fatalf("Loading rules: %s", err)
+	}
+	b, err := RulesBooter(rules)
+	if err != nil {
+		t.Fatalf("Constructing RulesBooter: %s", err)
+	}
+
+	guid := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	for _, tc := range []struct {
+		m       types.Machine
+		kernel  string
+		cmdline string
+	}{
+		// MAC range
+		{m: types.Machine{MAC: mustMAC("01:02:03:00:00:10"), Arch: constants.ArchX64, GUID: guid}},
+		// OUI and GUID
+		{m: types.Machine{MAC: mustMAC("01:02:03:04:05:06"), Arch: constants.ArchX64, GUID: guid}, kernel: "lab kernel", cmdline: `conf={{ ID "rule-1/other-0" }}`},
+		// Arch and vendor class
+		{m: types.Machine{MAC: mustMAC("01:02:03:04:05:06"), Arch: constants.ArchArm64, VendorClass: "PXEClient:Arch:0000b:UNDI:003016"}, kernel: "arm kernel"},
+		{m: types.Machine{MAC: mustMAC("02:02:03:04:05:06"), Arch: constants.ArchArm64, VendorClass: "HTTPClient"}},
+		// Fallthrough
+		{m: types.Machine{MAC: mustMAC("02:02:03:04:05:06"), Arch: constants.ArchX64}, kernel: "x64 kernel"},
+		{m: types.Machine{MAC: mustMAC("02:02:03:04:05:06"), Arch: constants.ArchIA32}},
+	} {
+		spec, err := b.BootSpec(tc.m)
+		if err != nil {
+			t.Fatalf("Getting bootspec for %+v: %s", tc.m, err)
+		}
+		if tc.kernel == "" {
+			if spec != nil {
+				t.Fatalf("Machine %+v should be ignored, got %#v", tc.m, spec)
+			}
+			continue
+		}
+		if spec == nil {
+			t.Fatalf("Machine %+v should boot %q, but is ignored", tc.m, tc.kernel)
+		}
+		if v := mustRead(b.ReadBootFile(spec.Kernel)); v != tc.kernel {
+			t.Fatalf("Machine %+v got kernel %q, want %q", tc.m, v, tc.kernel)
+		}
+		if spec.Cmdline != tc.cmdline {
+			t.Fatalf("Machine %+v got cmdline %q, want %q", tc.m, spec.Cmdline, tc.cmdline)
+		}
+	}
+	if v := mustRead(b.ReadBootFile("rule-1/other-0")); v != "x64 kernel" {
+		t.Fatalf("Wrong file for cmdline ID: %q", v)
+	}
+	for _, id := range []types.ID{"kernel", "rule-0/kernel", "rule-9/kernel", "rule-x/kernel"} {
+		if _, _, err := b.ReadBootFile(id); err == nil {
+			t.Fatalf("ReadBootFile(%q) should fail", id)
+		}
+	}
+}
+
+func TestDirBooter(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"profiles/default", "profiles/installer", "machines/01:02:03:04:05:06", "machines/02-02-03-04-05-06", "machines/03:02:03:04:05:06"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustWrite(root, "profiles/default/kernel", "default kernel")
+	mustWrite(root, "profiles/default/initrd-b", "default initrd b")
+	mustWrite(root, "profiles/default/initrd-a", "default initrd a")
+	mustWrite(root, "profiles/default/cmdline", "console=ttyS0 conf={{ ID \"config\" }}\n")
+	mustWrite(root, "profiles/default/config", "default config")
+	mustWrite(root, "profiles/installer/vmlinuz", "installer kernel")
+	mustWrite(root, "profiles/installer/spec.yaml", "kernel: vmlinuz\ncmdline: install\n")
+	mustWrite(root, "machines/01:02:03:04:05:06/spec.yaml", "profile: installer\ncmdline: 'install conf={{ ID \"config\" }}'\n")
+	mustWrite(root, "machines/01:02:03:04:05:06/config", "machine config")
+	mustWrite(root, "machines/02-02-03-04-05-06/spec.yaml", "ignore: true\n")
+	mustWrite(root, "machines/03:02:03:04:05:06/spec.yaml", "kernel: ../../profiles/installer/vmlinuz\ninitrd: [../../../etc/passwd]\n")
+
+	b, err := DirBooter(root)
+	if err != nil {
+		t.Fatalf("Constructing DirBooter: %s", err)
+	}
+
+	for _, tc := range []struct {
+		mac  string
+		spec *types.Spec
+	}{
+		{
+			mac: "04:02:03:04:05:06",
+			spec: &types.Spec{
+				Kernel:  "profiles/default/kernel",
+				Initrd:  []types.ID{"profiles/default/initrd-a", "profiles/default/initrd-b"},
+				Cmdline: `console=ttyS0 conf={{ ID "profiles/default/config" }}`,
+			},
+		},
+		{
+			mac: "01:02:03:04:05:06",
+			spec: &types.Spec{
+				Kernel:  "profiles/installer/vmlinuz",
+				Cmdline: `install conf={{ ID "machines/01:02:03:04:05:06/config" }}`,
+			},
+		},
+		{mac: "02:02:03:04:05:06"},
+	} {
+		spec, err := b.BootSpec(types.Machine{MAC: mustMAC(tc.mac)})
+		if err != nil {
+			t.Fatalf("Getting bootspec for %s: %s", tc.mac, err)
+		}
+		if !reflect.DeepEqual(spec, tc.spec) {
+			t.Fatalf("Wrong spec for %s:\nwant: %#v\ngot:  %#v", tc.mac, tc.spec, spec)
+		}
+	}
+
+	if _, err := b.BootSpec(types.Machine{MAC: mustMAC("03:02:03:04:05:06")}); err == nil {
+		t.Fatal("Spec referencing files outside of the root should fail")
+	}
+
+	fs := map[types.ID]string{
+		"profiles/default/initrd-a":         "default initrd a",
+		"profiles/installer/vmlinuz":        "installer kernel",
+		"machines/01:02:03:04:05:06/config": "machine config",
+		"../profiles/default/config":        "default config",
+		"/../../profiles/installer/vmlinuz": "installer kernel",
+	}
+	for id, contents := range fs {
+		if v := mustRead(b.ReadBootFile(id)); v != contents {
+			t.Fatalf("Wrong file contents for %q: wanted %q, got %q", id, contents, v)
+		}
+	}
+	for _, id := range []types.ID{"profiles", "profiles/nope", "../../../../etc/passwd"} {
+		if _, _, err := b.ReadBootFile(id); err == nil {
+			t.Fatalf("ReadBootFile(%q) should fail", id)
+		}
+	}
+	// Machines only get the files of their own spec, not the specs
+	// themselves.
+	for _, id := range []types.ID{"profiles/default/cmdline", "machines/01:02:03:04:05:06/spec.yaml"} {
+		if err := b.(types.ClientChecker).CheckClient(types.Machine{MAC: mustMAC("01:02:03:04:05:06")}, id); err == nil {
+			t.Fatalf("CheckClient allows %q", id)
+		}
+	}
+	if err := b.(types.ClientChecker).CheckClient(types.Machine{MAC: mustMAC("01:02:03:04:05:06")}, "machines/01:02:03:04:05:06/config"); err != nil {
+		t.Fatalf("Machine can't get its own config: %s", err)
+	}
+	if err := b.(types.ClientChecker).CheckClient(types.Machine{MAC: mustMAC("04:02:03:04:05:06")}, "machines/01:02:03:04:05:06/config"); err == nil {
+		t.Fatal("Machine can get the config of another machine")
+	}
+	if err := b.WriteBootFile("profiles/default/config", strings.NewReader("x")); err == nil {
+		t.Fatal("WriteBootFile should fail")
+	}
+
+	// Symlinks out of the root aren't followed.
+	outside := t.TempDir()
+	mustWrite(outside, "secret", "secret")
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "profiles/default/initrd-c")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.ReadBootFile("profiles/default/initrd-c"); err == nil {
+		t.Fatal("ReadBootFile followed a symlink out of the root")
+	}
+	os.Remove(filepath.Join(root, "profiles/default/initrd-c"))
+
+	// Kernel and efi are exclusive.
+	mustWrite(root, "machines/03:02:03:04:05:06/spec.yaml", "kernel: ../../profiles/installer/vmlinuz\nefi: ../../profiles/installer/vmlinuz\n")
+	if _, err := b.BootSpec(types.Machine{MAC: mustMAC("03:02:03:04:05:06")}); err == nil {
+		t.Fatal("Spec with both a kernel and an efi should fail")
+	}
+
+	// Changes are picked up without constructing a new Booter.
+	// Upload IDs are relative to the directory too.
+	mustWrite(root, "profiles/default/cmdline", `quiet log={{ Upload "log" }}`)
+	spec, err := b.BootSpec(types.Machine{MAC: mustMAC("04:02:03:04:05:06")})
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	if spec.Cmdline != `quiet log={{ Upload "profiles/default/log" }}` {
+		t.Fatalf("Changed cmdline not picked up, got %q", spec.Cmdline)
+	}
+}
+
+func TestOCIBootFiles(t *testing.T) {
+	reg := ocitest.NewRegistry()
+	defer reg.Close()
+	reg.RequireToken = true
+
+	reg.Push("kairos/boot", "v1",
+		ocitest.Layer{Title: "vmlinuz", Data: []byte("oci kernel")},
+		ocitest.Layer{MediaType: "application/vnd.kairos.initrd", Data: []byte("oci initrd")},
+	)
+	amd64 := reg.Push("kairos/efi", "amd64", ocitest.Layer{Data: []byte("amd64 efi")})
+	arm64 := reg.Push("kairos/efi", "arm64", ocitest.Layer{Data: []byte("arm64 efi")})
+	reg.PushIndex("kairos/efi", "latest", map[string]string{"linux/amd64": amd64, "linux/arm64": arm64})
+
+	b, err := StaticBooter(&types.Spec{
+		Kernel:  types.ID(fmt.Sprintf("oci://%s/kairos/boot:v1#vmlinuz", reg.Host())),
+		Initrd:  []types.ID{types.ID(fmt.Sprintf("oci://%s/kairos/boot:v1#application/vnd.kairos.initrd", reg.Host()))},
+		Cmdline: fmt.Sprintf(`efi={{ ID "oci://%s/kairos/efi?platform=linux/arm64" }}`, reg.Host()),
+	})
+	if err != nil {
+		t.Fatalf("Constructing StaticBooter: %s", err)
+	}
+	// The server verifies layers against the digests of their
+	// manifest before serving them.
+	spec, err := b.BootSpec(types.Machine{MAC: mustMAC("01:02:03:04:05:06")})
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	digests := map[types.ID]string{
+		"kernel":   ocitest.Digest([]byte("oci kernel")),
+		"initrd-0": ocitest.Digest([]byte("oci initrd")),
+		"other-0":  ocitest.Digest([]byte("arm64 efi")),
+	}
+	if !reflect.DeepEqual(spec.Digests, digests) {
+		t.Fatalf("Wrong digests\ngot:  %v\nwant: %v", spec.Digests, digests)
+	}
+
+	fs := map[types.ID]string{
+		"kernel":   "oci kernel",
+		"initrd-0": "oci initrd",
+		"other-0":  "arm64 efi",
+	}
+	for id, contents := range fs {
+		if v := mustRead(b.ReadBootFile(id)); v != contents {
+			t.Fatalf("Wrong file contents for %q: wanted %q, got %q", id, contents, v)
+		}
+	}
+
+	for _, ref := range []string{
+		// Several layers, none selected.
+		"oci://%s/kairos/boot:v1",
+		"oci://%s/kairos/boot:v1#nope",
+		"oci://%s/kairos/boot:v2#vmlinuz",
+		// Several platforms, none selected.
+		"oci://%s/kairos/efi",
+		"oci://%s/kairos/efi?platform=linux/riscv64",
+	} {
+		if _, _, err := OpenOCI(fmt.Sprintf(ref, reg.Host())); err == nil {
+			t.Fatalf("OpenOCI(%q) should fail", ref)
+		}
+	}
+
+	// Manifests pulled by digest must match it.
+	reg.SetManifest("kairos/efi", arm64, []byte(`{"layers": []}`))
+	if _, _, err := OpenOCI(fmt.Sprintf("oci://%s/kairos/efi@%s", reg.Host(), arm64)); err == nil {
+		t.Fatal("OpenOCI should fail on a corrupted manifest")
+	}
+	if _, _, err := OpenOCI(fmt.Sprintf("oci://%s/kairos/efi?platform=linux/arm64", reg.Host())); err == nil {
+		t.Fatal("OpenOCI should fail on a corrupted platform manifest")
+	}
+
+	// Corrupted layers fail when read to the end.
+	reg.Push("kairos/bad", "latest", ocitest.Layer{Data: []byte("good")})
+	f, _, err := OpenOCI(fmt.Sprintf("oci://%s/kairos/bad", reg.Host()))
+	if err != nil {
+		t.Fatalf("Opening layer: %s", err)
+	}
+	f.Close()
+	reg.SetBlob(ocitest.Digest([]byte("good")), []byte("evil"))
+	f, _, err = OpenOCI(fmt.Sprintf("oci://%s/kairos/bad", reg.Host()))
+	if err != nil {
+		t.Fatalf("Opening layer: %s", err)
+	}
+	defer f.Close()
+	if _, err = ioutil.ReadAll(f); err == nil {
+		t.Fatal("Reading corrupted layer should fail")
+	}
+
+	// Digests are remembered for a while, rather than asked for with
+	// every Spec.
+	reg.Push("kairos/moving", "latest", ocitest.Layer{Data: []byte("old")})
+	b, err = StaticBooter(&types.Spec{Kernel: types.ID(fmt.Sprintf("oci://%s/kairos/moving", reg.Host()))})
+	if err != nil {
+		t.Fatalf("Constructing StaticBooter: %s", err)
+	}
+	for _, data := range []string{"old", "new"} {
+		reg.Push("kairos/moving", "latest", ocitest.Layer{Data: []byte(data)})
+		spec, err := b.BootSpec(types.Machine{MAC: mustMAC("01:02:03:04:05:06")})
+		if err != nil {
+			t.Fatalf("Getting bootspec: %s", err)
+		}
+		if want := ocitest.Digest([]byte("old")); spec.Digests["kernel"] != want {
+			t.Fatalf("Wrong kernel digest after pushing %q, got %q, want %q", data, spec.Digests["kernel"], want)
+		}
+	}
+}
+
+// mustISO writes an ISO9660 image containing files, and returns its
+// path. If rockRidge is set, files get their names from Rock Ridge NM
+// entries, and upper case ISO9660 names otherwise. If boot is set,
+// the image has an El Torito boot catalog listing that file.
+func mustISO(dir string, files map[string]string, rockRidge bool, boot string) string {
+	const sector = 2048
+
+	type node struct {
+		name     string
+		children map[string]*node
+		data     []byte
+		lba      uint32
+		size     uint32
+	}
+	root := &node{children: map[string]*node{}}
+	for p, contents := range files {
+		cur := root
+		parts := strings.Split(p, "/")
+		for _, part := range parts[:len(parts)-1] {
+			if cur.children[part] == nil {
+				cur.children[part] = &node{name: part, children: map[string]*node{}}
+			}
+			cur = cur.children[part]
+		}
+		name := parts[len(parts)-1]
+		cur.children[name] = &node{name: name, data: []byte(contents)}
+	}
+
+	// Directories get one sector each, then files follow.
+	var dirs, regular []*node
+	var walk func(n *node)
+	walk = func(n *node) {
+		dirs = append(dirs, n)
+		var names []string
+		for name := range n.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if c := n.children[name]; c.children != nil {
+				walk(c)
+			} else {
+				regular = append(regular, c)
+			}
+		}
+	}
+	walk(root)
+	// Volume descriptors, then the boot catalog.
+	next := uint32(20)
+	for _, d := range dirs {
+		d.lba, d.size = next, sector
+		next++
+	}
+	for _, f := range regular {
+		f.lba, f.size = next, uint32(len(f.data))
+		next += (f.size + sector - 1) / sector
+		if f.size == 0 {
+			next++
+		}
+	}
+
+	record := func(name []byte, n *node, rr string) []byte {
+		l := 33 + len(name)
+		if len(name)%2 == 0 {
+			l++
+		}
+		var su []byte
+		if rr != "" {
+			su = append([]byte{'N', 'M', byte(5 + len(rr)), 1, 0}, rr...)
+		}
+		rec := make([]byte, l+len(su)+(l+len(su))%2)
+		rec[0] = byte(len(rec))
+		binary.LittleEndian.PutUint32(rec[2:], n.lba)
+		binary.BigEndian.PutUint32(rec[6:], n.lba)
+		binary.LittleEndian.PutUint32(rec[10:], n.size)
+		binary.BigEndian.PutUint32(rec[14:], n.size)
+		if n.children != nil {
+			rec[25] = 2
+		}
+		rec[32] = byte(len(name))
+		copy(rec[33:], name)
+		copy(rec[l:], su)
+		return rec
+	}
+
+	img := make([]byte, int(next)*sector)
+	pvd := img[16*sector:]
+	pvd[0] = 1
+	copy(pvd[1:], "CD001")
+	pvd[6] = 1
+	copy(pvd[156:], record([]byte{0}, root, ""))
+	term := img[18*sector:]
+	term[0] = 255
+	copy(term[1:], "CD001")
+	if boot != "" {
+		br := img[17*sector:]
+		copy(br[1:], "CD001")
+		br[6] = 1
+		copy(br[7:], "EL TORITO SPECIFICATION")
+		binary.LittleEndian.PutUint32(br[71:], 19)
+		cat := img[19*sector:]
+		cat[0] = 1
+		cat[30], cat[31] = 0x55, 0xaa
+		cat[32] = 0x88
+		cur := root
+		for _, part := range strings.Split(boot, "/") {
+			cur = cur.children[part]
+		}
+		binary.LittleEndian.PutUint32(cat[40:], cur.lba)
+	} else {
+		// An unused descriptor.
+		copy(img[17*sector+1:], "CD001")
+		img[17*sector] = 3
+	}
+
+	parents := map[*node]*node{root: root}
+	for _, d := range dirs {
+		for _, c := range d.children {
+			parents[c] = d
+		}
+	}
+	for _, d := range dirs {
+		out := img[d.lba*sector : (d.lba+1)*sector]
+		pos := copy(out, record([]byte{0}, d, ""))
+		pos += copy(out[pos:], record([]byte{1}, parents[d], ""))
+		var names []string
+		for name := range d.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			c := d.children[name]
+			isoName, rr := strings.ToUpper(name), ""
+			if rockRidge {
+				isoName, rr = fmt.Sprintf("F%d", c.lba), name
+			}
+			if c.children == nil {
+				isoName += ";1"
+			}
+			pos += copy(out[pos:], record([]byte(isoName), c, rr))
+		}
+	}
+	for _, f := range regular {
+		copy(img[f.lba*sector:], f.data)
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("test-%d.iso", len(files)))
+	if err := ioutil.WriteFile(path, img, 0644); err != nil {
+		panic(err)
+	}
+	return path
+}
+
+func TestISOBooter(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		files     map[string]string
+		rockRidge bool
+		boot      string
+		cmdline   string
+		spec      *types.Spec
+		contents  map[types.ID]string
+	}{
+		{
+			files: map[string]string{
+				"isolinux/isolinux.cfg": "ui vesamenu.c32\ndefault live\nlabel check\n  kernel /casper/vmlinuz-lts\n  append integrity-check\nlabel live\n  kernel ../casper/vmlinuz-lts\n  append initrd=/casper/initrd.lz boot=casper quiet\n",
+				"casper/vmlinuz-lts":    "casper kernel",
+				"casper/initrd.lz":      "casper initrd",
+				"preseed/auto.cfg":      "preseed",
+			},
+			rockRidge: true,
+			cmdline:   `url={{ ISO }} file={{ ID "/preseed/auto.cfg" }}`,
+			spec: &types.Spec{
+				Kernel:  "kernel",
+				Initrd:  []types.ID{"initrd-0"},
+				Cmdline: `{{ "boot=casper quiet" }} url={{ ID "other-0" }} file={{ ID "other-1" }}`,
+			},
+			contents: map[types.ID]string{
+				"kernel":   "casper kernel",
+				"initrd-0": "casper initrd",
+				"other-1":  "preseed",
+			},
+		},
+		{
+			files: map[string]string{
+				"boot/grub/grub.cfg": "menuentry 'Variable' {\n  linux $kernel\n}\nmenuentry 'Install' --class os {\n  linux /boot/vmlinuz root=live:CDLABEL=TEST\n  initrd /boot/initrd.img /boot/extra.img\n}\n",
+				"boot/vmlinuz":       "grub kernel",
+				"boot/initrd.img":    "grub initrd",
+				"boot/extra.img":     "grub extra",
+			},
+			spec: &types.Spec{
+				Kernel:  "kernel",
+				Initrd:  []types.ID{"initrd-0", "initrd-1"},
+				Cmdline: `{{ "root=live:CDLABEL=TEST" }}`,
+			},
+			contents: map[types.ID]string{
+				"kernel":   "grub kernel",
+				"initrd-0": "grub initrd",
+				"initrd-1": "grub extra",
+			},
+		},
+		{
+			// Configuration next to the El Torito boot image, with a
+			// cmdline that looks like a template.
+			files: map[string]string{
+				"x86/loader.bin":   "isolinux",
+				"x86/syslinux.cfg": "default x\nlabel x\n  kernel linux\n  append quiet tpl={{x}}\n",
+				"x86/linux":        "x86 kernel",
+			},
+			boot: "x86/loader.bin",
+			spec: &types.Spec{
+				Kernel:  "kernel",
+				Cmdline: `{{ "quiet tpl={{x}}" }}`,
+			},
+			contents: map[types.ID]string{
+				"kernel": "x86 kernel",
+			},
+		},
+		{
+			files: map[string]string{
+				"efi/boot/bootx64.efi": "efi loader",
+			},
+			spec: &types.Spec{Efi: "efi"},
+			contents: map[types.ID]string{
+				"efi": "efi loader",
+			},
+		},
+	} {
+		path := mustISO(dir, tc.files, tc.rockRidge, tc.boot)
+		b, err := ISOBooter(path, tc.cmdline)
+		if err != nil {
+			t.Fatalf("Constructing ISOBooter: %s", err)
+		}
+		spec, err := b.BootSpec(types.Machine{MAC: mustMAC("01:02:03:04:05:06")})
+		if err != nil {
+			t.Fatalf("Getting bootspec: %s", err)
+		}
+		if !reflect.DeepEqual(spec, tc.spec) {
+			t.Fatalf("Wrong spec:\nwant: %#v\ngot:  %#v", tc.spec, spec)
+		}
+		for id, contents := range tc.contents {
+			if v := mustRead(b.ReadBootFile(id)); v != contents {
+				t.Fatalf("Wrong file contents for %q: wanted %q, got %q", id, contents, v)
+			}
+		}
+		iso, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := mustRead(b.ReadBootFile("other-0")); v != string(iso) {
+			t.Fatal("other-0 isn't the whole image")
+		}
+	}
+
+	if _, err := ISOBooter(mustISO(dir, map[string]string{"README": "no kernel here"}, false, ""), ""); err == nil {
+		t.Fatal("ISOBooter should fail on an image with nothing to boot")
+	}
+
+	// Files can't claim to be bigger than the image.
+	path := mustISO(dir, map[string]string{"boot/vmlinuz": "kernel", "boot/initrd": "initrd"}, false, "")
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := strings.Index(string(bs), "VMLINUZ;1")
+	binary.LittleEndian.PutUint32(bs[i-33+10:], 1<<31)
+	if err = ioutil.WriteFile(path, bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ISOBooter(path, ""); err == nil {
+		t.Fatal("ISOBooter should fail on a file extending past the image")
+	}
+}
+
+func TestCombinators(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite(dir, "a", "a kernel")
+	mustWrite(dir, "b", "b kernel")
+	mustWrite(dir, "c", "c kernel")
+	mustWrite(dir, "conf", "c conf")
+
+	arm, err := RulesBooter([]Rule{{Arch: []string{"arm64"}, Spec: &types.Spec{Kernel: types.ID(filepath.Join(dir, "a"))}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := StaticBooter(&types.Spec{Kernel: types.ID(filepath.Join(dir, "b"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallback := FallbackBooter(arm, all)
+	override, err := OverrideBooter(fallback, map[string]*types.Spec{
+		"01-02-03-04-05-06": {
+			Kernel:  types.ID(filepath.Join(dir, "c")),
+			Cmdline: fmt.Sprintf(`conf={{ ID "%s" }}`, filepath.Join(dir, "conf")),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Constructing OverrideBooter: %s", err)
+	}
+	b, err := DenyListBooter(override, []string{"02:02:03:04:05:06"})
+	if err != nil {
+		t.Fatalf("Constructing DenyListBooter: %s", err)
+	}
+
+	for _, tc := range []struct {
+		m    types.Machine
+		spec *types.Spec
+	}{
+		{
+			m:    types.Machine{MAC: mustMAC("03:02:03:04:05:06"), Arch: constants.ArchArm64},
+			spec: &types.Spec{Kernel: "base/fallback-0/rule-0/kernel"},
+		},
+		{
+			m:    types.Machine{MAC: mustMAC("03:02:03:04:05:06"), Arch: constants.ArchX64},
+			spec: &types.Spec{Kernel: "base/fallback-1/kernel"},
+		},
+		{
+			m:    types.Machine{MAC: mustMAC("01:02:03:04:05:06"), Arch: constants.ArchArm64},
+			spec: &types.Spec{Kernel: "override-0/kernel", Cmdline: `conf={{ ID "override-0/other-0" }}`},
+		},
+		{
+			m: types.Machine{MAC: mustMAC("02:02:03:04:05:06"), Arch: constants.ArchX64},
+		},
+	} {
+		spec, err := b.BootSpec(tc.m)
+		if err != nil {
+			t.Fatalf("Getting bootspec for %s: %s", tc.m.MAC, err)
+		}
+		if !reflect.DeepEqual(spec, tc.spec) {
+			t.Fatalf("Wrong spec for %s:\nwant: %#v\ngot:  %#v", tc.m.MAC, tc.spec, spec)
+		}
+	}
+
+	fs := map[types.ID]string{
+		"base/fallback-0/rule-0/kernel": "a kernel",
+		"base/fallback-1/kernel":        "b kernel",
+		"override-0/kernel":             "c kernel",
+		"override-0/other-0":            "c conf",
+	}
+	for id, contents := range fs {
+		if v := mustRead(b.ReadBootFile(id)); v != contents {
+			t.Fatalf("Wrong file contents for %q: wanted %q, got %q", id, contents, v)
+		}
+	}
+	for _, id := range []types.ID{"kernel", "fallback-1/kernel", "base/fallback-2/kernel", "override-1/kernel"} {
+		if _, _, err := b.ReadBootFile(id); err == nil {
+			t.Fatalf("ReadBootFile(%q) should fail", id)
+		}
+	}
+
+	if _, err := OverrideBooter(all, map[string]*types.Spec{"01:02:03:04:05:06": {}, "01-02-03-04-05-06": {}}); err == nil {
+		t.Fatal("OverrideBooter should reject duplicate MACs")
+	}
+	if _, err := DenyListBooter(all, []string{"nope"}); err == nil {
+		t.Fatal("DenyListBooter should reject invalid MACs")
+	}
+}
+
+func TestOnceBooter(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite(dir, "kernel", "kernel")
+	state := filepath.Join(dir, "once.json")
+
+	static, err := StaticBooter(&types.Spec{Kernel: types.ID(filepath.Join(dir, "kernel"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	once, err := OnceBooter(static, state)
+	if err != nil {
+		t.Fatalf("Constructing OnceBooter: %s", err)
+	}
+	// Wrapped, to check that the notification makes it through.
+	b, err := DenyListBooter(once, []string{"02:02:03:04:05:06"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := b.(types.BootNotifier)
+
+	m := types.Machine{MAC: mustMAC("01:02:03:04:05:06")}
+	other := types.Machine{MAC: mustMAC("03:02:03:04:05:06")}
+	if spec, err := b.BootSpec(m); spec == nil || err != nil {
+		t.Fatalf("Armed machine should netboot, got %v, %v", spec, err)
+	}
+	// Retrying before booting still netboots.
+	if spec, err := b.BootSpec(m); spec == nil || err != nil {
+		t.Fatalf("Armed machine should netboot, got %v, %v", spec, err)
+	}
+	if err = n.Booted(m); err != nil {
+		t.Fatalf("Recording boot: %s", err)
+	}
+	// A machine that never asked for a spec isn't marked booted.
+	if err = n.Booted(other); err != nil {
+		t.Fatalf("Recording boot: %s", err)
+	}
+	if spec, err := b.BootSpec(m); spec != nil || err != nil {
+		t.Fatalf("Booted machine should boot from disk, got %v, %v", spec, err)
+	}
+	if spec, err := b.BootSpec(other); spec == nil || err != nil {
+		t.Fatalf("Other machine should netboot, got %v, %v", spec, err)
+	}
+
+	// State survives restarts.
+	once, err = OnceBooter(static, state)
+	if err != nil {
+		t.Fatalf("Reloading OnceBooter: %s", err)
+	}
+	if at, err := once.BootedAt(m.MAC); at.IsZero() || err != nil {
+		t.Fatalf("Boot of %s not persisted: %v", m.MAC, err)
+	}
+	if spec, err := once.BootSpec(m); spec != nil || err != nil {
+		t.Fatalf("Booted machine should boot from disk after restart, got %v, %v", spec, err)
+	}
+
+	if err = once.Rearm(m.MAC); err != nil {
+		t.Fatalf("Rearming: %s", err)
+	}
+	if spec, err := once.BootSpec(m); spec == nil || err != nil {
+		t.Fatalf("Rearmed machine should netboot, got %v, %v", spec, err)
+	}
+	if err = once.Booted(m); err != nil {
+		t.Fatalf("Recording boot: %s", err)
+	}
+
+	// Machines given a spec before a restart are recorded when they
+	// boot after it.
+	third := types.Machine{MAC: mustMAC("04:02:03:04:05:06")}
+	if spec, err := once.BootSpec(third); spec == nil || err != nil {
+		t.Fatalf("Armed machine should netboot, got %v, %v", spec, err)
+	}
+	restarted, err := OnceBooter(static, state)
+	if err != nil {
+		t.Fatalf("Reloading OnceBooter: %s", err)
+	}
+	if err = restarted.Booted(third); err != nil {
+		t.Fatalf("Recording boot: %s", err)
+	}
+	if at, err := restarted.BootedAt(third.MAC); at.IsZero() || err != nil {
+		t.Fatalf("Boot of %s across a restart not recorded: %v", third.MAC, err)
+	}
+
+	// Editing the state file by hand also rearms.
+	mustWrite(dir, "once.json", `{"booted": {}}`)
+	future := time.Now().Add(time.Hour)
+	if err = os.Chtimes(state, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if spec, err := once.BootSpec(m); spec == nil || err != nil {
+		t.Fatalf("Machine removed from state file should netboot, got %v, %v", spec, err)
+	}
+}
+
+// mustClientCert returns a self-signed client certificate.
+func mustClientCert() (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "netboot"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, cert
+}
+
+func TestAPIBooterClientOptions(t *testing.T) {
+	// Boot files live on a separate server, which must not see the
+	// API's credentials.
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			http.Error(w, "leaked credentials", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("kernel from file server"))
+	}))
+	defer files.Close()
+
+	api := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" || r.Header.Get("X-Site") != "lab" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/boot/01:02:03:04:05:06":
+			fmt.Fprintf(w, `{"kernel": %q, "initrd": ["/initrd"]}`, files.URL+"/kernel")
+		case "/initrd":
+			w.Write([]byte("initrd from API server"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	clientCert, clientX509 := mustClientCert()
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientX509)
+	api.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	api.StartTLS()
+	defer api.Close()
+	serverCAs := x509.NewCertPool()
+	serverCAs.AddCert(api.Certificate())
+
+	// Without the client certificate, the API is unreachable.
+	b, err := APIBooter(api.URL, time.Second, utils.WithRootCAs(serverCAs), utils.WithBearerToken("s3cret"))
+	if err != nil {
+		t.Fatalf("Constructing APIBooter: %s", err)
+	}
+	if _, err = b.BootSpec(types.Machine{MAC: mustMAC("01:02:03:04:05:06")}); err == nil {
+		t.Fatal("BootSpec should fail without a client certificate")
+	}
+
+	b, err = APIBooter(api.URL, time.Second,
+		utils.WithRootCAs(serverCAs),
+		utils.WithClientCertificate(clientCert),
+		utils.WithBearerToken("s3cret"),
+		utils.WithHeader("X-Site", "lab"))
+	if err != nil {
+		t.Fatalf("Constructing APIBooter: %s", err)
+	}
+	spec, err := b.BootSpec(types.Machine{MAC: mustMAC("01:02:03:04:05:06")})
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	if v := mustRead(b.ReadBootFile(spec.Kernel)); v != "kernel from file server" {
+		t.Fatalf("Wrong kernel %q", v)
+	}
+	if v := mustRead(b.ReadBootFile(spec.Initrd[0])); v != "initrd from API server" {
+		t.Fatalf("Wrong initrd %q", v)
+	}
 }
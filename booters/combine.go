@@ -0,0 +1,275 @@
+// Copyright 2024 Kairos contributors
+
+package booters
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/kairos-io/netboot/types"
+)
+
+// FallbackBooter asks each of booters in turn how to boot a machine,
+// until one of them returns a Spec. Machines that none of them boot
+// don't netboot.
+//
+// An error from one of the booters stops the search: the machine
+// might be one it would have booted, so falling through to the next
+// one could boot it with the wrong Spec.
+func FallbackBooter(booters ...types.Booter) types.Booter {
+	return &fallbackBooter{booters}
+}
+
+type fallbackBooter struct {
+	booters []types.Booter
+}
+
+func (b *fallbackBooter) BootSpec(m types.Machine) (*types.Spec, error) {
+	for i, booter := range b.booters {
+		spec, err := booter.BootSpec(m)
+		if err != nil {
+			return nil, err
+		}
+		if spec != nil {
+			return namespaceSpec(spec, namespace("fallback", i))
+		}
+	}
+	return nil, nil
+}
+
+// Booted passes the news on to all of the booters, since the one that
+// booted m isn't known.
+func (b *fallbackBooter) Booted(m types.Machine) error {
+	return bootedAll(m, b.booters...)
+}
+
+func (b *fallbackBooter) booter(id types.ID) (types.Booter, types.ID, error) {
+	i, rest, err := splitNamespace(id, "fallback")
+	if err != nil {
+		return nil, "", err
+	}
+	if i >= len(b.booters) {
+		return nil, "", fmt.Errorf("no file with ID %q", id)
+	}
+	return b.booters[i], rest, nil
+}
+
+func (b *fallbackBooter) CheckClient(m types.Machine, id types.ID) error {
+	booter, rest, err := b.booter(id)
+	if err != nil {
+		return err
+	}
+	return checkClient(booter, m, rest)
+}
+
+func (b *fallbackBooter) FileName(id types.ID) (string, error) {
+	booter, rest, err := b.booter(id)
+	if err != nil {
+		return "", err
+	}
+	return fileName(booter, id, rest)
+}
+
+func (b *fallbackBooter) ReadBootFile(id types.ID) (io.ReadCloser, int64, error) {
+	booter, rest, err := b.booter(id)
+	if err != nil {
+		return nil, -1, err
+	}
+	return booter.ReadBootFile(rest)
+}
+
+func (b *fallbackBooter) WriteBootFile(id types.ID, body io.Reader) error {
+	booter, rest, err := b.booter(id)
+	if err != nil {
+		return err
+	}
+	return booter.WriteBootFile(rest, body)
+}
+
+// OverrideBooter boots the machines whose MAC address is in overrides
+// with the matching Spec, and asks base about all others. The override
+// specs are served as with StaticBooter.
+func OverrideBooter(base types.Booter, overrides map[string]*types.Spec) (types.Booter, error) {
+	ret := &overrideBooter{
+		base:      base,
+		overrides: make(map[string]int, len(overrides)),
+	}
+	macs := make([]string, 0, len(overrides))
+	for mac := range overrides {
+		macs = append(macs, mac)
+	}
+	// Sorted, so that IDs don't change between runs.
+	sort.Strings(macs)
+	for _, s := range macs {
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := ret.overrides[mac.String()]; ok {
+			return nil, fmt.Errorf("duplicate override for %s", mac)
+		}
+		b, err := StaticBooter(overrides[s])
+		if err != nil {
+			return nil, fmt.Errorf("override for %s: %s", mac, err)
+		}
+		ret.overrides[mac.String()] = len(ret.booters)
+		ret.booters = append(ret.booters, b)
+	}
+	return ret, nil
+}
+
+// overrideBooter serves the files of the override specs under
+// "override-N/" IDs, and those of base under "base/" IDs.
+type overrideBooter struct {
+	base      types.Booter
+	overrides map[string]int
+	booters   []types.Booter
+}
+
+func (b *overrideBooter) BootSpec(m types.Machine) (*types.Spec, error) {
+	if i, ok := b.overrides[m.MAC.String()]; ok {
+		spec, err := b.booters[i].BootSpec(m)
+		if err != nil || spec == nil {
+			return spec, err
+		}
+		return namespaceSpec(spec, namespace("override", i))
+	}
+	spec, err := b.base.BootSpec(m)
+	if err != nil || spec == nil {
+		return spec, err
+	}
+	return namespaceSpec(spec, "base/")
+}
+
+func (b *overrideBooter) Booted(m types.Machine) error {
+	if i, ok := b.overrides[m.MAC.String()]; ok {
+		return bootedAll(m, b.booters[i])
+	}
+	return bootedAll(m, b.base)
+}
+
+func (b *overrideBooter) booter(id types.ID) (types.Booter, types.ID, error) {
+	if rest, ok := strings.CutPrefix(string(id), "base/"); ok {
+		return b.base, types.ID(rest), nil
+	}
+	i, rest, err := splitNamespace(id, "override")
+	if err != nil {
+		return nil, "", err
+	}
+	if i >= len(b.booters) {
+		return nil, "", fmt.Errorf("no file with ID %q", id)
+	}
+	return b.booters[i], rest, nil
+}
+
+func (b *overrideBooter) CheckClient(m types.Machine, id types.ID) error {
+	booter, rest, err := b.booter(id)
+	if err != nil {
+		return err
+	}
+	return checkClient(booter, m, rest)
+}
+
+func (b *overrideBooter) FileName(id types.ID) (string, error) {
+	booter, rest, err := b.booter(id)
+	if err != nil {
+		return "", err
+	}
+	return fileName(booter, id, rest)
+}
+
+func (b *overrideBooter) ReadBootFile(id types.ID) (io.ReadCloser, int64, error) {
+	booter, rest, err := b.booter(id)
+	if err != nil {
+		return nil, -1, err
+	}
+	return booter.ReadBootFile(rest)
+}
+
+func (b *overrideBooter) WriteBootFile(id types.ID, body io.Reader) error {
+	booter, rest, err := b.booter(id)
+	if err != nil {
+		return err
+	}
+	return booter.WriteBootFile(rest, body)
+}
+
+// DenyListBooter doesn't netboot the machines whose MAC address is in
+// macs, and asks base about all others. File IDs are base's.
+func DenyListBooter(base types.Booter, macs []string) (types.Booter, error) {
+	ret := &denyListBooter{
+		Booter: base,
+		deny:   make(map[string]bool, len(macs)),
+	}
+	for _, s := range macs {
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			return nil, err
+		}
+		ret.deny[mac.String()] = true
+	}
+	return ret, nil
+}
+
+type denyListBooter struct {
+	types.Booter
+	deny map[string]bool
+}
+
+func (b *denyListBooter) BootSpec(m types.Machine) (*types.Spec, error) {
+	if b.deny[m.MAC.String()] {
+		return nil, nil
+	}
+	return b.Booter.BootSpec(m)
+}
+
+func (b *denyListBooter) Booted(m types.Machine) error {
+	return bootedAll(m, b.Booter)
+}
+
+func (b *denyListBooter) CheckClient(m types.Machine, id types.ID) error {
+	return checkClient(b.Booter, m, id)
+}
+
+func (b *denyListBooter) FileName(id types.ID) (string, error) {
+	return fileName(b.Booter, id, id)
+}
+
+// bootedAll notifies each of booters that implements
+// types.BootNotifier that m booted.
+func bootedAll(m types.Machine, booters ...types.Booter) error {
+	var errs []error
+	for _, b := range booters {
+		if n, ok := b.(types.BootNotifier); ok {
+			errs = append(errs, n.Booted(m))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkClient asks b whether the file with ID id can be served to m,
+// if b implements types.ClientChecker.
+func checkClient(b types.Booter, m types.Machine, id types.ID) error {
+	if c, ok := b.(types.ClientChecker); ok {
+		return c.CheckClient(m, id)
+	}
+	return nil
+}
+
+// fileName returns the name that b, which serves the file with ID id
+// as rest, gives the file if b implements types.FileNamer, or rest,
+// either with the namespace that id has and rest hasn't.
+func fileName(b types.Booter, id, rest types.ID) (string, error) {
+	name := string(rest)
+	if n, ok := b.(types.FileNamer); ok {
+		var err error
+		if name, err = n.FileName(rest); err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSuffix(string(id), string(rest)) + name, nil
+}
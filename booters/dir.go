@@ -0,0 +1,368 @@
+// Copyright 2024 Kairos contributors
+
+package booters
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kairos-io/netboot/types"
+	"github.com/kairos-io/netboot/utils"
+	"sigs.k8s.io/yaml"
+)
+
+// DirBooter boots machines with specs read from a directory tree:
+//
+//	root/
+//	  machines/<mac>/      how to boot the machine with that MAC address
+//	  profiles/<name>/     a spec shared by several machines
+//	  profiles/default/    how to boot machines with no machines/ entry
+//
+// Machine directories are named after the MAC address, either as
+// "01:02:03:04:05:06" or "01-02-03-04-05-06". Machines with neither a
+// machine directory nor a default profile don't netboot.
+//
+// Each machine or profile directory describes a spec either with a
+// spec.yaml file (a YAML or JSON types.Spec), or by convention with
+// files named kernel (or efi, or uki-* for Unified Kernel Images),
+// initrd or initrd-* (served in name order), and cmdline. Paths in
+// spec.yaml (including the keys of its digests and signatures) and in
+// {{ ID }} references of the cmdline and ipxe-template are relative
+// to the directory they're in, and must not leave root.
+//
+// A machine's spec.yaml can also say "profile: <name>" to boot like
+// the named profile, overriding any of its kernel, initrd, cmdline,
+// efi, uki, menu, ipxe-template or message, adding to its digests and
+// signatures, or "ignore: true" to not netboot the machine.
+//
+// Only the files that specs reference are served, and only to the
+// machines whose spec references them, so spec.yaml and cmdline files
+// aren't readable by machines. Symlinks must not point out of root.
+//
+// The tree is re-read every time a machine asks what to boot, so
+// changes take effect without restarting the server.
+func DirBooter(root string) (types.Booter, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	st, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return nil, fmt.Errorf("%q is not a directory", root)
+	}
+	return &dirBooter{root}, nil
+}
+
+type dirBooter struct {
+	root string
+}
+
+// dirSpec is the content of a spec.yaml file.
+type dirSpec struct {
+	types.Spec
+	// Profile names the profile to start from, only in machine
+	// directories.
+	Profile string `json:"profile,omitempty"`
+	// Ignore makes the machine not netboot, only in machine
+	// directories.
+	Ignore bool `json:"ignore,omitempty"`
+}
+
+func (b *dirBooter) BootSpec(m types.Machine) (*types.Spec, error) {
+	for _, name := range []string{m.MAC.String(), strings.ReplaceAll(m.MAC.String(), ":", "-")} {
+		if b.isDir(path.Join("machines", name)) {
+			return b.machine(path.Join("machines", name))
+		}
+	}
+	if !b.isDir("profiles/default") {
+		return nil, nil
+	}
+	return b.profile("default")
+}
+
+// machine returns the spec of the machine directory dir, with IDs
+// relative to root.
+func (b *dirBooter) machine(dir string) (*types.Spec, error) {
+	spec, err := b.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if spec.Ignore {
+		return nil, nil
+	}
+	if spec.Profile == "" {
+		return b.finish(dir, spec)
+	}
+	ret, err := b.profile(spec.Profile)
+	if err != nil {
+		return nil, err
+	}
+	own, err := b.resolve(dir, spec)
+	if err != nil {
+		return nil, err
+	}
+	if own.Kernel != "" || own.Efi != "" || own.UKI != nil || own.Menu != nil {
+		ret.Kernel, ret.Efi, ret.UKI, ret.Menu = own.Kernel, own.Efi, own.UKI, own.Menu
+	}
+	if own.Initrd != nil {
+		ret.Initrd, ret.InitrdNames = own.Initrd, own.InitrdNames
+	}
+	if own.Cmdline != "" {
+		ret.Cmdline = own.Cmdline
+	}
+	if own.Message != "" {
+		ret.Message = own.Message
+	}
+	if own.Loader != "" {
+		ret.Loader = own.Loader
+	}
+	if own.IpxeTemplate != "" {
+		ret.IpxeTemplate = own.IpxeTemplate
+	}
+	if own.PublicKey != "" {
+		ret.PublicKey = own.PublicKey
+	}
+	for id, digest := range own.Digests {
+		if ret.Digests == nil {
+			ret.Digests = map[types.ID]string{}
+		}
+		ret.Digests[id] = digest
+	}
+	for id, sig := range own.Signatures {
+		if ret.Signatures == nil {
+			ret.Signatures = map[types.ID]string{}
+		}
+		ret.Signatures[id] = sig
+	}
+	return ret, nil
+}
+
+// profile returns the spec of the named profile, with IDs relative to
+// root.
+func (b *dirBooter) profile(name string) (*types.Spec, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return nil, fmt.Errorf("invalid profile name %q", name)
+	}
+	dir := path.Join("profiles", name)
+	if !b.isDir(dir) {
+		return nil, fmt.Errorf("no profile named %q", name)
+	}
+	spec, err := b.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if spec.Profile != "" || spec.Ignore {
+		return nil, fmt.Errorf("%s/spec.yaml: profile and ignore can only be set for machines", dir)
+	}
+	return b.finish(dir, spec)
+}
+
+// readDir reads the spec described by dir, with IDs relative to dir.
+func (b *dirBooter) readDir(dir string) (*dirSpec, error) {
+	bs, err := os.ReadFile(b.path(path.Join(dir, "spec.yaml")))
+	if err == nil {
+		var spec dirSpec
+		if err = yaml.UnmarshalStrict(bs, &spec); err != nil {
+			return nil, fmt.Errorf("parsing %s/spec.yaml: %s", dir, err)
+		}
+		return &spec, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	var spec dirSpec
+	entries, err := os.ReadDir(b.path(dir))
+	if err != nil {
+		return nil, err
+	}
+	var initrds, ukis []string
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		switch name := e.Name(); {
+		case name == "kernel":
+			spec.Kernel = types.ID(name)
+		case name == "efi":
+			spec.Efi = types.ID(name)
+		case name == "initrd" || strings.HasPrefix(name, "initrd-"):
+			initrds = append(initrds, name)
+		case strings.HasPrefix(name, "uki-"):
+			ukis = append(ukis, name)
+		case name == "cmdline":
+			bs, err := os.ReadFile(b.path(path.Join(dir, name)))
+			if err != nil {
+				return nil, err
+			}
+			spec.Cmdline = strings.TrimSpace(string(bs))
+		}
+	}
+	sort.Strings(initrds)
+	for _, initrd := range initrds {
+		spec.Initrd = append(spec.Initrd, types.ID(initrd))
+	}
+	sort.Strings(ukis)
+	for _, uki := range ukis {
+		spec.UKI = append(spec.UKI, types.ID(uki))
+	}
+	return &spec, nil
+}
+
+// finish checks that spec is bootable, and resolves it.
+func (b *dirBooter) finish(dir string, spec *dirSpec) (*types.Spec, error) {
+	if spec.Kernel == "" && spec.Efi == "" && len(spec.UKI) == 0 && spec.Menu == nil && spec.IpxeTemplate == "" {
+		return nil, fmt.Errorf("%s: no kernel, efi, uki, menu or ipxe-template", dir)
+	}
+	return b.resolve(dir, spec)
+}
+
+// resolve makes the IDs in spec relative to root instead of dir.
+func (b *dirBooter) resolve(dir string, spec *dirSpec) (*types.Spec, error) {
+	var resolveErr error
+	resolve := func(id types.ID) types.ID {
+		p := string(id)
+		if path.IsAbs(p) {
+			resolveErr = fmt.Errorf("%s: path %q must be relative", dir, p)
+			return ""
+		}
+		p = path.Join(dir, p)
+		if p == ".." || strings.HasPrefix(p, "../") {
+			resolveErr = fmt.Errorf("%s: path %q is outside of the boot directory", dir, id)
+			return ""
+		}
+		return types.ID(p)
+	}
+
+	n := 0
+	for _, set := range []bool{spec.Kernel != "", spec.Efi != "", len(spec.UKI) > 0} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
+		return nil, fmt.Errorf("%s: only one of kernel, efi or uki can be set", dir)
+	}
+	ret := &types.Spec{Message: spec.Message, Loader: spec.Loader}
+	if spec.Efi != "" {
+		ret.Efi = resolve(spec.Efi)
+	}
+	if spec.Kernel != "" {
+		ret.Kernel = resolve(spec.Kernel)
+	}
+	for _, uki := range spec.UKI {
+		ret.UKI = append(ret.UKI, resolve(uki))
+	}
+	for _, initrd := range spec.Initrd {
+		ret.Initrd = append(ret.Initrd, resolve(initrd))
+	}
+	ret.InitrdNames = spec.InitrdNames
+	f := func(fn, id string) (string, string, error) {
+		return fn, string(resolve(types.ID(id))), nil
+	}
+	cmdline, err := rewriteCalls(spec.Cmdline, utils.CmdlineFuncs, f)
+	if err != nil {
+		return nil, err
+	}
+	ret.Cmdline = cmdline
+	if ret.IpxeTemplate, err = rewriteCalls(spec.IpxeTemplate, utils.IpxeTemplateFuncs, f); err != nil {
+		return nil, fmt.Errorf("%s: %s", dir, err)
+	}
+	if err = mapVerification(ret, &spec.Spec, resolve); err != nil {
+		return nil, fmt.Errorf("%s: %s", dir, err)
+	}
+	if spec.Menu != nil && (spec.Kernel != "" || spec.Efi != "" || len(spec.UKI) > 0) {
+		return nil, fmt.Errorf("%s: both a menu and a kernel, efi or uki", dir)
+	}
+	if ret.Menu, err = mapMenu(spec.Menu, func(entry *types.Spec) (*types.Spec, error) {
+		return b.resolve(dir, &dirSpec{Spec: *entry})
+	}); err != nil {
+		return nil, fmt.Errorf("%s: %s", dir, err)
+	}
+	if resolveErr != nil {
+		return nil, resolveErr
+	}
+	return ret, nil
+}
+
+// path returns the on-disk path of the slash-separated path p,
+// relative to root. As in tftp.FilesystemHandler, joining p with "/"
+// first gets rid of directory traversal attempts.
+func (b *dirBooter) path(p string) string {
+	return filepath.Join(b.root, filepath.FromSlash(path.Join("/", p)))
+}
+
+func (b *dirBooter) isDir(p string) bool {
+	st, err := os.Stat(b.path(p))
+	return err == nil && st.IsDir()
+}
+
+// clean returns id as a path relative to root, without traversal.
+func clean(id types.ID) types.ID {
+	return types.ID(strings.TrimPrefix(path.Join("/", string(id)), "/"))
+}
+
+// referenced reports whether spec references the file with ID id.
+func referenced(spec *types.Spec, id types.ID) bool {
+	found := false
+	utils.SpecIDs(spec, func(ref types.ID) {
+		if ref == id {
+			found = true
+		}
+	})
+	return found
+}
+
+// CheckClient only serves m the files that its own spec references.
+func (b *dirBooter) CheckClient(m types.Machine, id types.ID) error {
+	spec, err := b.BootSpec(m)
+	if err != nil {
+		return err
+	}
+	if spec == nil || !referenced(spec, clean(id)) {
+		return fmt.Errorf("file %q isn't in the spec of %s", id, m.MAC)
+	}
+	return nil
+}
+
+// ReadBootFile returns the file at id, relative to root. Which
+// machines can read which files is checked by CheckClient.
+func (b *dirBooter) ReadBootFile(id types.ID) (io.ReadCloser, int64, error) {
+	id = clean(id)
+	p, err := filepath.EvalSymlinks(b.path(string(id)))
+	if err != nil {
+		return nil, -1, err
+	}
+	root, err := filepath.EvalSymlinks(b.root)
+	if err != nil {
+		return nil, -1, err
+	}
+	if !strings.HasPrefix(p, root+string(filepath.Separator)) {
+		return nil, -1, fmt.Errorf("file %q is a symlink out of the boot directory", id)
+	}
+	st, err := os.Stat(p)
+	if err != nil {
+		return nil, -1, err
+	}
+	if !st.Mode().IsRegular() {
+		return nil, -1, fmt.Errorf("no file with ID %q", id)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, -1, err
+	}
+	return f, st.Size(), nil
+}
+
+func (b *dirBooter) WriteBootFile(id types.ID, _ io.Reader) error {
+	return fmt.Errorf("can't write %q, DirBooter doesn't accept uploads", id)
+}
@@ -0,0 +1,621 @@
+// Copyright 2024 Kairos contributors
+
+package booters
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/kairos-io/netboot/types"
+	"github.com/kairos-io/netboot/utils"
+)
+
+// ISOBooter boots all machines with the kernel and initrds of an
+// ISO9660 image, served straight out of the image without unpacking
+// it.
+//
+// The kernel, initrds and kernel commandline are discovered from the
+// image's isolinux/syslinux or GRUB configuration, looked for next to
+// the boot images of its El Torito boot catalog first, then at the
+// usual places, or failing that from well-known paths used by common
+// distributions. If the image
+// has no kernel but has a removable media EFI boot loader
+// (/EFI/BOOT/BOOTX64.EFI and friends), that is booted instead.
+//
+// cmdline is appended to the discovered commandline. In it,
+// {{ ISO }} expands to the URL of the whole image, for installers
+// that fetch it over HTTP, and {{ ID "/path" }} to the URL of a file
+// within the image.
+func ISOBooter(isoPath, cmdline string) (types.Booter, error) {
+	f, err := os.Open(isoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	img, err := readISO(f, fi.Size())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", isoPath, err)
+	}
+
+	ret := &isoBooter{
+		path: isoPath,
+		// The whole image is always other-0.
+		others: []isoExtent{{0, fi.Size()}},
+	}
+	found, err := img.discover()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", isoPath, err)
+	}
+	spec := &types.Spec{}
+	if found.efi != "" {
+		e, err := img.lookup(found.efi)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", isoPath, err)
+		}
+		ret.efi = e.extent()
+		spec.Efi = "efi"
+	} else {
+		e, err := img.lookup(found.kernel)
+		if err != nil {
+			return nil, fmt.Errorf("%s: kernel: %s", isoPath, err)
+		}
+		ret.kernel = e.extent()
+		spec.Kernel = "kernel"
+		for i, initrd := range found.initrd {
+			e, err := img.lookup(initrd)
+			if err != nil {
+				return nil, fmt.Errorf("%s: initrd: %s", isoPath, err)
+			}
+			ret.initrd = append(ret.initrd, e.extent())
+			spec.Initrd = append(spec.Initrd, types.ID(fmt.Sprintf("initrd-%d", i)))
+		}
+	}
+
+	extra, err := utils.RewriteTemplateCalls(cmdline, []string{"ISO", "ID"}, func(fn string, args []string) (string, error) {
+		switch {
+		case fn == "ISO" && len(args) == 0:
+			return `ID "other-0"`, nil
+		case fn == "ID" && len(args) == 1:
+			e, err := img.lookup(args[0])
+			if err != nil {
+				return "", fmt.Errorf("%s: cmdline: %s", isoPath, err)
+			}
+			ret.others = append(ret.others, e.extent())
+			return fmt.Sprintf(`ID "other-%d"`, len(ret.others)-1), nil
+		}
+		return "", fmt.Errorf("%s: cmdline: bad call to %s", isoPath, fn)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The discovered cmdline is the image's, not a template.
+	if found.cmdline != "" {
+		spec.Cmdline = "{{ " + strconv.Quote(found.cmdline) + " }}"
+	}
+	spec.Cmdline = strings.TrimSpace(spec.Cmdline + " " + extra)
+	ret.spec = spec
+	return ret, nil
+}
+
+type isoBooter struct {
+	path   string
+	kernel isoExtent
+	initrd []isoExtent
+	efi    isoExtent
+	others []isoExtent
+	spec   *types.Spec
+}
+
+// isoExtent is a contiguous range of bytes in the image.
+type isoExtent struct {
+	offset int64
+	size   int64
+}
+
+func (b *isoBooter) BootSpec(m types.Machine) (*types.Spec, error) {
+	return b.spec, nil
+}
+
+func (b *isoBooter) ReadBootFile(id types.ID) (io.ReadCloser, int64, error) {
+	var e isoExtent
+	switch name := string(id); {
+	case name == "kernel" && b.spec.Kernel != "":
+		e = b.kernel
+	case name == "efi" && b.spec.Efi != "":
+		e = b.efi
+	case strings.HasPrefix(name, "initrd-"):
+		i, err := strconv.Atoi(name[7:])
+		if err != nil || i < 0 || i >= len(b.initrd) {
+			return nil, -1, fmt.Errorf("no file with ID %q", id)
+		}
+		e = b.initrd[i]
+	case strings.HasPrefix(name, "other-"):
+		i, err := strconv.Atoi(name[6:])
+		if err != nil || i < 0 || i >= len(b.others) {
+			return nil, -1, fmt.Errorf("no file with ID %q", id)
+		}
+		e = b.others[i]
+	default:
+		return nil, -1, fmt.Errorf("no file with ID %q", id)
+	}
+
+	f, err := os.Open(b.path)
+	if err != nil {
+		return nil, -1, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, e.offset, e.size), f}, e.size, nil
+}
+
+func (b *isoBooter) WriteBootFile(id types.ID, _ io.Reader) error {
+	return fmt.Errorf("can't write %q, ISOBooter doesn't accept uploads", id)
+}
+
+// isoSectorSize is the logical sector size of ISO9660 images. Other
+// sizes are allowed by the standard, but never used in practice.
+const isoSectorSize = 2048
+
+// isoImage reads files out of an ISO9660 image, using Rock Ridge
+// names when present.
+type isoImage struct {
+	r    io.ReaderAt
+	size int64
+	root isoEntry
+	// Sector of the El Torito boot catalog, or 0.
+	catalog uint32
+}
+
+type isoEntry struct {
+	name string
+	lba  uint32
+	size uint32
+	dir  bool
+}
+
+func (e isoEntry) extent() isoExtent {
+	return isoExtent{int64(e.lba) * isoSectorSize, int64(e.size)}
+}
+
+func readISO(r io.ReaderAt, size int64) (*isoImage, error) {
+	ret := &isoImage{r: r, size: size}
+	// Volume descriptors start at sector 16, and end with a
+	// terminator of type 255.
+	for sector := int64(16); ; sector++ {
+		var vd [isoSectorSize]byte
+		if _, err := r.ReadAt(vd[:], sector*isoSectorSize); err != nil {
+			return nil, fmt.Errorf("reading volume descriptor: %s", err)
+		}
+		if string(vd[1:6]) != "CD001" {
+			return nil, errors.New("not an ISO9660 image")
+		}
+		switch vd[0] {
+		case 0:
+			// Boot record, El Torito's points at its boot catalog.
+			if strings.TrimRight(string(vd[7:39]), "\x00") == "EL TORITO SPECIFICATION" {
+				ret.catalog = binary.LittleEndian.Uint32(vd[71:75])
+			}
+		case 1:
+			// Primary volume descriptor, the root directory record
+			// is at offset 156.
+			entries := parseISODir(vd[156:190])
+			if len(entries) != 1 || !entries[0].dir {
+				return nil, errors.New("invalid root directory record")
+			}
+			ret.root = entries[0]
+		case 255:
+			if !ret.root.dir {
+				return nil, errors.New("no primary volume descriptor")
+			}
+			return ret, nil
+		}
+	}
+}
+
+// bootImages returns the sectors of the boot images listed in the El
+// Torito boot catalog, if any.
+func (img *isoImage) bootImages() []uint32 {
+	if img.catalog == 0 {
+		return nil
+	}
+	var cat [isoSectorSize]byte
+	if _, err := img.r.ReadAt(cat[:], int64(img.catalog)*isoSectorSize); err != nil {
+		return nil
+	}
+	// The validation entry comes first, and ends with 55 AA.
+	if cat[0] != 1 || cat[30] != 0x55 || cat[31] != 0xaa {
+		return nil
+	}
+	var ret []uint32
+	// Then the default entry, then sections of entries, each with a
+	// header saying how many entries follow. Entries all have the
+	// sector of their image at offset 8.
+	entries := 1
+	for pos := 32; pos+32 <= len(cat); pos += 32 {
+		entry := cat[pos : pos+32]
+		if entries == 0 {
+			if entry[0] != 0x90 && entry[0] != 0x91 {
+				break
+			}
+			entries = int(binary.LittleEndian.Uint16(entry[2:4]))
+			continue
+		}
+		entries--
+		if entry[0] == 0x88 {
+			ret = append(ret, binary.LittleEndian.Uint32(entry[8:12]))
+		}
+	}
+	return ret
+}
+
+// findSector returns the path of the file that starts at sector lba,
+// looking only at the first levels of directories.
+func (img *isoImage) findSector(lba uint32) (string, bool) {
+	type dir struct {
+		path  string
+		entry isoEntry
+	}
+	queue := []dir{{"", img.root}}
+	for depth := 0; depth < 4 && len(queue) > 0; depth++ {
+		var next []dir
+		for _, d := range queue {
+			entries, err := img.readDir(d.entry)
+			if err != nil {
+				continue
+			}
+			for _, e := range entries {
+				if e.name == "." || e.name == ".." {
+					continue
+				}
+				p := d.path + "/" + e.name
+				if e.dir {
+					next = append(next, dir{p, e})
+				} else if e.lba == lba {
+					return p, true
+				}
+			}
+		}
+		queue = next
+	}
+	return "", false
+}
+
+// checkExtent returns an error if e isn't within the image, so that
+// corrupted or malicious images can't make us allocate or serve more
+// than their size.
+func (img *isoImage) checkExtent(e isoEntry) error {
+	if x := e.extent(); x.offset+x.size > img.size {
+		return fmt.Errorf("%q extends past the end of the image", e.name)
+	}
+	return nil
+}
+
+// parseISODir parses the directory records in bs. The "." and ".."
+// records are returned with those names.
+func parseISODir(bs []byte) []isoEntry {
+	var ret []isoEntry
+	for pos := 0; pos < len(bs); {
+		n := int(bs[pos])
+		if n == 0 {
+			// Records don't cross sector boundaries, the rest of
+			// the sector is padding.
+			pos = (pos/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+		if n < 34 || pos+n > len(bs) {
+			break
+		}
+		rec := bs[pos : pos+n]
+		pos += n
+
+		nameLen := int(rec[32])
+		if 33+nameLen > len(rec) {
+			continue
+		}
+		e := isoEntry{
+			lba:  binary.LittleEndian.Uint32(rec[2:6]),
+			size: binary.LittleEndian.Uint32(rec[10:14]),
+			dir:  rec[25]&2 != 0,
+		}
+		switch name := rec[33 : 33+nameLen]; {
+		case nameLen == 1 && name[0] == 0:
+			e.name = "."
+		case nameLen == 1 && name[0] == 1:
+			e.name = ".."
+		default:
+			e.name = string(name)
+			if i := strings.IndexByte(e.name, ';'); i >= 0 {
+				e.name = e.name[:i]
+			}
+			e.name = strings.TrimSuffix(e.name, ".")
+		}
+
+		// The system use area follows the name, padded to an even
+		// length. Rock Ridge puts the real file name in an NM entry.
+		var su []byte
+		if start := 33 + nameLen + (1 - nameLen%2); start < len(rec) {
+			su = rec[start:]
+		}
+		var rrName []byte
+		for len(su) >= 4 && int(su[2]) >= 4 && int(su[2]) <= len(su) {
+			entry := su[:su[2]]
+			if string(entry[:2]) == "NM" && len(entry) >= 5 {
+				rrName = append(rrName, entry[5:]...)
+			}
+			su = su[su[2]:]
+		}
+		if rrName != nil {
+			e.name = string(rrName)
+		}
+		ret = append(ret, e)
+	}
+	return ret
+}
+
+func (img *isoImage) readDir(dir isoEntry) ([]isoEntry, error) {
+	if err := img.checkExtent(dir); err != nil {
+		return nil, err
+	}
+	bs := make([]byte, dir.size)
+	if _, err := img.r.ReadAt(bs, int64(dir.lba)*isoSectorSize); err != nil {
+		return nil, err
+	}
+	return parseISODir(bs), nil
+}
+
+// lookup finds the file at p. Names are compared case insensitively,
+// since plain ISO9660 names are upper case but configuration files
+// tend to refer to them in lower case.
+func (img *isoImage) lookup(p string) (isoEntry, error) {
+	cur := img.root
+	for _, name := range strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if !cur.dir {
+			return isoEntry{}, fmt.Errorf("%q not found in image", p)
+		}
+		entries, err := img.readDir(cur)
+		if err != nil {
+			return isoEntry{}, err
+		}
+		found := false
+		for _, e := range entries {
+			if e.name != "." && e.name != ".." && strings.EqualFold(e.name, name) {
+				cur, found = e, true
+				break
+			}
+		}
+		if !found {
+			return isoEntry{}, fmt.Errorf("%q not found in image", p)
+		}
+	}
+	if cur.dir {
+		return isoEntry{}, fmt.Errorf("%q is a directory", p)
+	}
+	if err := img.checkExtent(cur); err != nil {
+		return isoEntry{}, err
+	}
+	return cur, nil
+}
+
+func (img *isoImage) exists(p string) bool {
+	_, err := img.lookup(p)
+	return err == nil
+}
+
+// readFile reads a small file, such as a boot loader configuration.
+func (img *isoImage) readFile(p string) ([]byte, error) {
+	e, err := img.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if e.size > 1<<20 {
+		return nil, fmt.Errorf("%q is too large", p)
+	}
+	bs := make([]byte, e.size)
+	_, err = img.r.ReadAt(bs, int64(e.lba)*isoSectorSize)
+	return bs, err
+}
+
+// isoBoot is what an image boots, as paths within the image.
+type isoBoot struct {
+	kernel  string
+	initrd  []string
+	cmdline string
+	efi     string
+}
+
+var (
+	isolinuxConfigs = []string{
+		"/isolinux/isolinux.cfg",
+		"/boot/isolinux/isolinux.cfg",
+		"/isolinux.cfg",
+		"/syslinux/syslinux.cfg",
+		"/boot/syslinux/syslinux.cfg",
+		"/syslinux.cfg",
+	}
+	grubConfigs = []string{
+		"/boot/grub/grub.cfg",
+		"/boot/grub2/grub.cfg",
+		"/EFI/BOOT/grub.cfg",
+	}
+	// Kernel and initrd paths of common distributions.
+	wellKnownBoots = []isoBoot{
+		{kernel: "/casper/vmlinuz", initrd: []string{"/casper/initrd"}},
+		{kernel: "/images/pxeboot/vmlinuz", initrd: []string{"/images/pxeboot/initrd.img"}},
+		{kernel: "/isolinux/vmlinuz", initrd: []string{"/isolinux/initrd.img"}},
+		{kernel: "/boot/kernel", initrd: []string{"/boot/initrd"}},
+		{kernel: "/boot/vmlinuz", initrd: []string{"/boot/initrd"}},
+	}
+	efiLoaders = []string{
+		"/EFI/BOOT/BOOTX64.EFI",
+		"/EFI/BOOT/BOOTAA64.EFI",
+		"/EFI/BOOT/BOOTIA32.EFI",
+	}
+)
+
+// discover finds what the image boots.
+func (img *isoImage) discover() (*isoBoot, error) {
+	// Boot loaders usually have their configuration next to them.
+	isolinux, grub := isolinuxConfigs, grubConfigs
+	for _, lba := range img.bootImages() {
+		if p, ok := img.findSector(lba); ok {
+			dir := path.Dir(p)
+			isolinux = append([]string{path.Join(dir, "isolinux.cfg"), path.Join(dir, "syslinux.cfg")}, isolinux...)
+			grub = append([]string{path.Join(dir, "grub.cfg")}, grub...)
+		}
+	}
+	for _, cfg := range isolinux {
+		if bs, err := img.readFile(cfg); err == nil {
+			if ret := parseIsolinux(bs, path.Dir(cfg)); ret != nil && img.bootable(ret) {
+				return ret, nil
+			}
+		}
+	}
+	for _, cfg := range grub {
+		if bs, err := img.readFile(cfg); err == nil {
+			if ret := parseGrub(bs); ret != nil && img.bootable(ret) {
+				return ret, nil
+			}
+		}
+	}
+	for _, b := range wellKnownBoots {
+		b := b
+		if img.bootable(&b) {
+			return &b, nil
+		}
+	}
+	for _, loader := range efiLoaders {
+		if img.exists(loader) {
+			return &isoBoot{efi: loader}, nil
+		}
+	}
+	return nil, errors.New("no kernel found in image")
+}
+
+// bootable reports whether all of b's files are in the image.
+func (img *isoImage) bootable(b *isoBoot) bool {
+	if !img.exists(b.kernel) {
+		return false
+	}
+	for _, initrd := range b.initrd {
+		if !img.exists(initrd) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseIsolinux returns the default entry of an isolinux/syslinux
+// configuration, or the first one if there is no usable default.
+// Relative paths are resolved against dir.
+func parseIsolinux(cfg []byte, dir string) *isoBoot {
+	var (
+		def     string
+		entries []*isoBoot
+		labels  []string
+		cur     *isoBoot
+	)
+	abs := func(p string) string {
+		if strings.HasPrefix(p, "/") {
+			return p
+		}
+		return path.Join(dir, p)
+	}
+	s := bufio.NewScanner(bytes.NewReader(cfg))
+	for s.Scan() {
+		keyword, args, _ := strings.Cut(strings.TrimSpace(s.Text()), " ")
+		args = strings.TrimSpace(args)
+		switch strings.ToLower(keyword) {
+		case "default":
+			def = args
+		case "label":
+			cur = &isoBoot{}
+			entries = append(entries, cur)
+			labels = append(labels, args)
+		case "kernel", "linux":
+			if cur != nil {
+				cur.kernel = abs(args)
+			}
+		case "initrd":
+			if cur != nil {
+				for _, initrd := range strings.Split(args, ",") {
+					cur.initrd = append(cur.initrd, abs(initrd))
+				}
+			}
+		case "append":
+			if cur == nil {
+				continue
+			}
+			var cmdline []string
+			for _, arg := range strings.Fields(args) {
+				if v, ok := strings.CutPrefix(arg, "initrd="); ok {
+					for _, initrd := range strings.Split(v, ",") {
+						cur.initrd = append(cur.initrd, abs(initrd))
+					}
+					continue
+				}
+				cmdline = append(cmdline, arg)
+			}
+			cur.cmdline = strings.Join(cmdline, " ")
+		}
+	}
+	for i, e := range entries {
+		if labels[i] == def && e.kernel != "" {
+			return e
+		}
+	}
+	for _, e := range entries {
+		// Menu modules like vesamenu.c32 are also "kernels".
+		if e.kernel != "" && !strings.HasSuffix(e.kernel, ".c32") {
+			return e
+		}
+	}
+	return nil
+}
+
+// parseGrub returns the first menu entry of a GRUB configuration that
+// doesn't depend on GRUB variables.
+func parseGrub(cfg []byte) *isoBoot {
+	var cur *isoBoot
+	s := bufio.NewScanner(bytes.NewReader(cfg))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "menuentry":
+			cur = &isoBoot{}
+		case "}":
+			if cur != nil && cur.kernel != "" && !strings.Contains(cur.kernel, "$") {
+				return cur
+			}
+			cur = nil
+		case "linux", "linuxefi", "linux16":
+			if cur != nil && len(fields) > 1 {
+				cur.kernel = fields[1]
+				cur.cmdline = strings.Join(fields[2:], " ")
+			}
+		case "initrd", "initrdefi", "initrd16":
+			if cur != nil {
+				cur.initrd = append(cur.initrd, fields[1:]...)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+// Copyright 2024 Kairos contributors
+
+package booters
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kairos-io/netboot/types"
+	"github.com/kairos-io/netboot/utils"
+)
+
+// namespaceSpec returns a copy of spec with all its IDs prefixed by
+// prefix, so that Booters combining several other Booters can tell in
+// ReadBootFile which one an ID belongs to.
+func namespaceSpec(spec *types.Spec, prefix string) (*types.Spec, error) {
+	ret := *spec
+	ret.Initrd, ret.UKI = nil, nil
+	if spec.Kernel != "" {
+		ret.Kernel = types.ID(prefix + string(spec.Kernel))
+	}
+	if spec.Efi != "" {
+		ret.Efi = types.ID(prefix + string(spec.Efi))
+	}
+	for _, initrd := range spec.Initrd {
+		ret.Initrd = append(ret.Initrd, types.ID(prefix+string(initrd)))
+	}
+	for _, uki := range spec.UKI {
+		ret.UKI = append(ret.UKI, types.ID(prefix+string(uki)))
+	}
+	f := func(fn, id string) (string, string, error) {
+		return fn, prefix + id, nil
+	}
+	var err error
+	if ret.Cmdline, err = rewriteCalls(spec.Cmdline, utils.CmdlineFuncs, f); err != nil {
+		return nil, err
+	}
+	if ret.IpxeTemplate, err = rewriteCalls(spec.IpxeTemplate, utils.IpxeTemplateFuncs, f); err != nil {
+		return nil, err
+	}
+	if err = mapVerification(&ret, spec, func(id types.ID) types.ID { return types.ID(prefix + string(id)) }); err != nil {
+		return nil, err
+	}
+	if ret.Menu, err = mapMenu(spec.Menu, func(entry *types.Spec) (*types.Spec, error) {
+		return namespaceSpec(entry, prefix)
+	}); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// rewriteCalls rewrites the calls in the template tpl to funcs with a
+// single constant argument, like {{ ID "foo" }}, to calls to the
+// function and with the argument that f returns. Calls without
+// arguments are left alone.
+func rewriteCalls(tpl string, funcs []string, f func(fn, arg string) (string, string, error)) (string, error) {
+	return utils.RewriteTemplateCalls(tpl, funcs, func(fn string, args []string) (string, error) {
+		switch len(args) {
+		case 0:
+			return "", nil
+		case 1:
+		default:
+			return "", fmt.Errorf("%s takes a single argument", fn)
+		}
+		fn, arg, err := f(fn, args[0])
+		return fmt.Sprintf("%s %q", fn, arg), err
+	})
+}
+
+// mapMenu returns a copy of menu, with the Spec of each entry replaced
+// by what f returns for it, or nil if menu is nil.
+func mapMenu(menu *types.Menu, f func(*types.Spec) (*types.Spec, error)) (*types.Menu, error) {
+	if menu == nil {
+		return nil, nil
+	}
+	if len(menu.Entries) == 0 {
+		return nil, errors.New("menu has no entries")
+	}
+	ret := &types.Menu{Default: menu.Default, Timeout: menu.Timeout}
+	found := menu.Default == ""
+	for i, entry := range menu.Entries {
+		if entry.Menu != nil {
+			return nil, fmt.Errorf("menu entry %q has a menu", entry.Name)
+		}
+		if entry.IpxeScript != "" || entry.IpxeTemplate != "" {
+			return nil, fmt.Errorf("menu entry %q has an iPXE script", entry.Name)
+		}
+		if entry.Name == menu.Default {
+			found = true
+		}
+		spec, err := f(&entry.Spec)
+		if err != nil {
+			return nil, fmt.Errorf("menu entry #%d: %s", i, err)
+		}
+		ret.Entries = append(ret.Entries, types.MenuEntry{Name: entry.Name, Spec: *spec})
+	}
+	if !found {
+		return nil, fmt.Errorf("default menu entry %q doesn't exist", menu.Default)
+	}
+	return ret, nil
+}
+
+// mapVerification sets the Digests, Signatures and PublicKey of ret
+// to those of spec, with IDs translated by f. f returns "" for IDs
+// that aren't files of ret, which is an error, since the digest of a
+// mistyped ID would otherwise silently verify nothing.
+func mapVerification(ret, spec *types.Spec, f func(types.ID) types.ID) error {
+	ret.Digests, ret.Signatures, ret.PublicKey = nil, nil, spec.PublicKey
+	if len(spec.Signatures) > 0 {
+		if err := checkPublicKey(spec.PublicKey); err != nil {
+			return err
+		}
+	}
+	for id, digest := range spec.Digests {
+		to := f(id)
+		if to == "" {
+			return fmt.Errorf("digest for %q, which isn't a file of the spec", id)
+		}
+		if _, err := parseDigest(digest); err != nil {
+			return fmt.Errorf("digest for %q: %s", id, err)
+		}
+		if ret.Digests == nil {
+			ret.Digests = map[types.ID]string{}
+		}
+		ret.Digests[to] = digest
+	}
+	for id, sig := range spec.Signatures {
+		to := f(id)
+		if to == "" {
+			return fmt.Errorf("signature for %q, which isn't a file of the spec", id)
+		}
+		if bs, err := base64.StdEncoding.DecodeString(sig); err != nil || len(bs) != ed25519.SignatureSize {
+			return fmt.Errorf("signature for %q: not a base64 encoded Ed25519 signature", id)
+		}
+		if ret.Signatures == nil {
+			ret.Signatures = map[types.ID]string{}
+		}
+		ret.Signatures[to] = sig
+	}
+	return nil
+}
+
+func checkPublicKey(key string) error {
+	if key == "" {
+		return errors.New("signatures require a public-key")
+	}
+	if bs, err := base64.StdEncoding.DecodeString(key); err != nil || len(bs) != ed25519.PublicKeySize {
+		return fmt.Errorf("public-key %q is not a base64 encoded Ed25519 public key", key)
+	}
+	return nil
+}
+
+// splitNamespace splits an ID created by namespaceSpec into the index
+// of the Booter it belongs to, and the Booter's own ID.
+func splitNamespace(id types.ID, name string) (int, types.ID, error) {
+	s := string(id)
+	slash := strings.Index(s, "/")
+	if !strings.HasPrefix(s, name+"-") || slash < 0 {
+		return 0, "", fmt.Errorf("no file with ID %q", id)
+	}
+	i, err := strconv.Atoi(s[len(name)+1 : slash])
+	if err != nil || i < 0 {
+		return 0, "", fmt.Errorf("no file with ID %q", id)
+	}
+	return i, types.ID(s[slash+1:]), nil
+}
+
+// namespace returns the ID prefix that namespaceSpec and
+// splitNamespace use for the i-th Booter.
+func namespace(name string, i int) string {
+	return fmt.Sprintf("%s-%d/", name, i)
+}
@@ -0,0 +1,463 @@
+// Copyright 2024 Kairos contributors
+
+package booters
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Media types of the manifests OpenOCI understands.
+const (
+	ociManifest       = "application/vnd.oci.image.manifest.v1+json"
+	ociIndex          = "application/vnd.oci.image.index.v1+json"
+	dockerManifest    = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerManifestSet = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// ociTitle is the layer annotation that tools like ORAS set to
+	// the name of the file the layer was pushed from.
+	ociTitle = "org.opencontainers.image.title"
+)
+
+// OpenOCI streams one layer of an artifact in an OCI registry. ref
+// looks like:
+//
+//	oci://registry[:port]/repository[:tag|@digest][?platform=os/arch][#layer]
+//
+// The tag defaults to "latest". layer selects the layer to stream,
+// either by its org.opencontainers.image.title annotation, or by its
+// media type. It can be omitted if the artifact has a single layer.
+//
+// If the reference points to a multi-platform index, platform selects
+// which manifest to use, and can be omitted if the index has a single
+// manifest.
+//
+// Registries are accessed over HTTPS, except for loopback addresses
+// and "localhost" which use plain HTTP. Anonymous bearer tokens are
+// requested when the registry asks for them, which is enough to pull
+// public images from Docker Hub, GHCR, Quay and the like.
+//
+// Manifests pulled by digest are checked against it. The layer's
+// digest is verified as it is read, Read fails at the end of the
+// layer if it doesn't match. Booters also put the layer's digest in
+// the Digests of their Spec (see OCIDigest), so that the server
+// verifies the whole layer before serving any of it.
+func OpenOCI(ref string) (io.ReadCloser, int64, error) {
+	return defaultOCIClient.open(ref)
+}
+
+// OCIDigest returns the digest of the layer that OpenOCI streams for
+// ref, as found in its manifest. Digests are remembered for
+// ociDigestTTL, so that Booters can put them in every Spec without
+// asking the registry every time.
+func OCIDigest(ref string) (string, error) {
+	return defaultOCIClient.digest(ref)
+}
+
+// How long OCIDigest remembers digests. A tag that moves within that
+// time fails verification until it's over.
+const ociDigestTTL = time.Minute
+
+var defaultOCIClient = &ociClient{client: fileClient}
+
+type ociClient struct {
+	client *http.Client
+
+	mu sync.Mutex
+	// Bearer tokens, by registry and repository.
+	tokens map[string]string
+	// Layer digests, by reference.
+	digests map[string]ociCachedDigest
+}
+
+type ociCachedDigest struct {
+	digest  string
+	expires time.Time
+}
+
+// ociRef is a parsed OpenOCI reference.
+type ociRef struct {
+	registry   string
+	repository string
+	reference  string
+	platform   string
+	layer      string
+}
+
+func parseOCIRef(ref string) (*ociRef, error) {
+	u, err := url.Parse(ref)
+	if err != nil || u.Scheme != "oci" || u.Host == "" {
+		return nil, fmt.Errorf("invalid OCI reference %q", ref)
+	}
+	ret := &ociRef{
+		registry: u.Host,
+		platform: u.Query().Get("platform"),
+		layer:    u.Fragment,
+	}
+	repo := strings.TrimPrefix(u.Path, "/")
+	if i := strings.Index(repo, "@"); i >= 0 {
+		repo, ret.reference = repo[:i], repo[i+1:]
+	} else if i := strings.LastIndex(repo, ":"); i >= 0 {
+		repo, ret.reference = repo[:i], repo[i+1:]
+	} else {
+		ret.reference = "latest"
+	}
+	if repo == "" || ret.reference == "" {
+		return nil, fmt.Errorf("invalid OCI reference %q", ref)
+	}
+	if ret.registry == "docker.io" {
+		// Docker Hub's short name isn't where its API lives.
+		ret.registry = "registry-1.docker.io"
+		if !strings.Contains(repo, "/") {
+			repo = "library/" + repo
+		}
+	}
+	ret.repository = repo
+	return ret, nil
+}
+
+func (r *ociRef) baseURL() string {
+	scheme := "https"
+	host, _, err := net.SplitHostPort(r.registry)
+	if err != nil {
+		host = r.registry
+	}
+	if ip := net.ParseIP(strings.Trim(host, "[]")); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s", scheme, r.registry, r.repository)
+}
+
+// ociDescriptor is the part of an OCI content descriptor we need.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+		Variant      string `json:"variant,omitempty"`
+	} `json:"platform,omitempty"`
+}
+
+// ociManifestBody is either an image manifest or an index.
+type ociManifestBody struct {
+	MediaType string          `json:"mediaType"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// digest returns the digest of the layer that refStr points at, from
+// the cache if it's still fresh.
+func (c *ociClient) digest(refStr string) (string, error) {
+	now := time.Now()
+	c.mu.Lock()
+	cached, ok := c.digests[refStr]
+	c.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.digest, nil
+	}
+
+	_, layer, err := c.layer(refStr)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.digests == nil {
+		c.digests = make(map[string]ociCachedDigest)
+	}
+	for k, v := range c.digests {
+		if !now.Before(v.expires) {
+			delete(c.digests, k)
+		}
+	}
+	c.digests[refStr] = ociCachedDigest{digest: layer.Digest, expires: now.Add(ociDigestTTL)}
+	return layer.Digest, nil
+}
+
+func (c *ociClient) open(refStr string) (io.ReadCloser, int64, error) {
+	ref, layer, err := c.layer(refStr)
+	if err != nil {
+		return nil, -1, err
+	}
+	resp, err := c.get(context.Background(), ref, "/blobs/"+layer.Digest, "")
+	if err != nil {
+		return nil, -1, fmt.Errorf("%s: %s", refStr, err)
+	}
+	body, err := verifyDigest(resp.Body, layer.Digest)
+	if err != nil {
+		resp.Body.Close()
+		return nil, -1, fmt.Errorf("%s: %s", refStr, err)
+	}
+	return body, layer.Size, nil
+}
+
+// layer returns the parsed refStr, and the descriptor of the layer it
+// points at.
+func (c *ociClient) layer(refStr string) (*ociRef, *ociDescriptor, error) {
+	ref, err := parseOCIRef(refStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest, err := c.manifest(ref, ref.reference)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", refStr, err)
+	}
+	if manifest.MediaType == ociIndex || manifest.MediaType == dockerManifestSet {
+		desc, err := selectPlatform(manifest.Manifests, ref.platform)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", refStr, err)
+		}
+		if manifest, err = c.manifest(ref, desc.Digest); err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", refStr, err)
+		}
+	}
+	layer, err := selectLayer(manifest.Layers, ref.layer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", refStr, err)
+	}
+	if _, err = parseDigest(layer.Digest); err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", refStr, err)
+	}
+	return ref, layer, nil
+}
+
+// manifest fetches the manifest named by reference, a tag or a
+// digest. Manifests fetched by digest are checked against it.
+func (c *ociClient) manifest(ref *ociRef, reference string) (*ociManifestBody, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), fileTimeout)
+	defer cancel()
+	accept := strings.Join([]string{ociManifest, ociIndex, dockerManifest, dockerManifestSet}, ", ")
+	resp, err := c.get(ctx, ref, "/manifests/"+reference, accept)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// Manifests are small, anything bigger than this isn't one.
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest: %s", err)
+	}
+	if strings.Contains(reference, ":") {
+		want, err := parseDigest(reference)
+		if err != nil {
+			return nil, err
+		}
+		if got := sha256.Sum256(body); hex.EncodeToString(got[:]) != want {
+			return nil, fmt.Errorf("manifest digest mismatch, got sha256:%x, want %s", got, reference)
+		}
+	}
+	var ret ociManifestBody
+	if err = json.Unmarshal(body, &ret); err != nil {
+		return nil, fmt.Errorf("parsing manifest: %s", err)
+	}
+	if ret.MediaType == "" {
+		ret.MediaType = resp.Header.Get("Content-Type")
+	}
+	return &ret, nil
+}
+
+func selectPlatform(manifests []ociDescriptor, platform string) (*ociDescriptor, error) {
+	if platform == "" {
+		if len(manifests) != 1 {
+			return nil, fmt.Errorf("index has %d manifests, select one with ?platform=os/arch", len(manifests))
+		}
+		return &manifests[0], nil
+	}
+	for i, m := range manifests {
+		if m.Platform == nil {
+			continue
+		}
+		p := m.Platform.OS + "/" + m.Platform.Architecture
+		if platform == p || (m.Platform.Variant != "" && platform == p+"/"+m.Platform.Variant) {
+			return &manifests[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no manifest for platform %q", platform)
+}
+
+func selectLayer(layers []ociDescriptor, name string) (*ociDescriptor, error) {
+	if name == "" {
+		if len(layers) != 1 {
+			return nil, fmt.Errorf("artifact has %d layers, select one with #title or #media-type", len(layers))
+		}
+		return &layers[0], nil
+	}
+	for i, l := range layers {
+		if l.Annotations[ociTitle] == name {
+			return &layers[i], nil
+		}
+	}
+	var ret *ociDescriptor
+	for i, l := range layers {
+		if l.MediaType == name {
+			if ret != nil {
+				return nil, fmt.Errorf("several layers have media type %q", name)
+			}
+			ret = &layers[i]
+		}
+	}
+	if ret == nil {
+		return nil, fmt.Errorf("no layer titled or of media type %q", name)
+	}
+	return ret, nil
+}
+
+// get fetches path under ref's repository, getting a bearer token if
+// the registry wants one.
+func (c *ociClient) get(ctx context.Context, ref *ociRef, path, accept string) (*http.Response, error) {
+	key := ref.registry + "/" + ref.repository
+	c.mu.Lock()
+	token := c.tokens[key]
+	c.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", ref.baseURL()+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			return resp, nil
+		case resp.StatusCode == http.StatusUnauthorized && attempt == 0:
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			if token, err = c.token(ctx, challenge); err != nil {
+				return nil, err
+			}
+			c.mu.Lock()
+			if c.tokens == nil {
+				c.tokens = make(map[string]string)
+			}
+			c.tokens[key] = token
+			c.mu.Unlock()
+		default:
+			resp.Body.Close()
+			return nil, fmt.Errorf("GET %s: %s", req.URL, resp.Status)
+		}
+	}
+}
+
+// token gets an anonymous bearer token, as asked for by the
+// WWW-Authenticate challenge.
+func (c *ociClient) token(ctx context.Context, challenge string) (string, error) {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", fmt.Errorf("unsupported registry authentication %q", challenge)
+	}
+	var realm string
+	q := url.Values{}
+	for _, param := range strings.Split(params, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok {
+			continue
+		}
+		v = strings.Trim(v, `"`)
+		switch k {
+		case "realm":
+			realm = v
+		case "service", "scope":
+			q.Set(k, v)
+		}
+	}
+	if realm == "" {
+		return "", fmt.Errorf("registry authentication challenge %q has no realm", challenge)
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("invalid token realm %q", realm)
+	}
+	u.RawQuery = q.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, fileTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("getting registry token: %s", resp.Status)
+	}
+	var r struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return "", fmt.Errorf("parsing registry token: %s", err)
+	}
+	if r.Token != "" {
+		return r.Token, nil
+	}
+	if r.AccessToken != "" {
+		return r.AccessToken, nil
+	}
+	return "", errors.New("registry returned an empty token")
+}
+
+// verifyDigest wraps r so that reading it to the end fails unless its
+// content matches digest.
+func verifyDigest(r io.ReadCloser, digest string) (io.ReadCloser, error) {
+	want, err := parseDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	return &digestReader{ReadCloser: r, h: sha256.New(), want: want}, nil
+}
+
+// parseDigest returns the hex encoded hash of a "sha256:<hex>" digest.
+func parseDigest(digest string) (string, error) {
+	algo, want, ok := strings.Cut(digest, ":")
+	if !ok || algo != "sha256" {
+		return "", fmt.Errorf("unsupported digest %q", digest)
+	}
+	if bs, err := hex.DecodeString(want); err != nil || len(bs) != sha256.Size {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return strings.ToLower(want), nil
+}
+
+type digestReader struct {
+	io.ReadCloser
+	h    hash.Hash
+	want string
+}
+
+func (d *digestReader) Read(bs []byte) (int, error) {
+	n, err := d.ReadCloser.Read(bs)
+	d.h.Write(bs[:n])
+	if err == io.EOF {
+		if got := hex.EncodeToString(d.h.Sum(nil)); got != d.want {
+			return n, fmt.Errorf("digest mismatch, got sha256:%s, want sha256:%s", got, d.want)
+		}
+	}
+	return n, err
+}
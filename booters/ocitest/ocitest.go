@@ -0,0 +1,250 @@
+// Copyright 2024 Kairos contributors
+
+// Package ocitest provides an in-memory OCI registry, to test code
+// that pulls boot files from registries.
+package ocitest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Token is the bearer token that a Registry with RequireToken set
+// hands out, and expects.
+const Token = "ocitest-token"
+
+// A Layer is a file in an artifact.
+type Layer struct {
+	// MediaType defaults to application/octet-stream.
+	MediaType string
+	// Title is set as the org.opencontainers.image.title annotation,
+	// if not empty.
+	Title string
+	Data  []byte
+}
+
+// A Registry serves the pull side of the OCI distribution API over
+// plain HTTP on a loopback address.
+type Registry struct {
+	*httptest.Server
+
+	// RequireToken makes the registry require a bearer token, which
+	// clients get from its anonymous token endpoint.
+	RequireToken bool
+
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string]manifest
+}
+
+type manifest struct {
+	mediaType string
+	body      []byte
+}
+
+// NewRegistry starts a Registry. Callers should Close it when done.
+func NewRegistry() *Registry {
+	r := &Registry{
+		blobs:     make(map[string][]byte),
+		manifests: make(map[string]manifest),
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	return r
+}
+
+// Host returns the registry's address, for use in oci:// references.
+func (r *Registry) Host() string {
+	u, _ := url.Parse(r.URL)
+	return u.Host
+}
+
+// Push stores an artifact made of layers in repo, tagged tag, and
+// returns the digest of its manifest.
+func (r *Registry) Push(repo, tag string, layers ...Layer) string {
+	type descriptor struct {
+		MediaType   string            `json:"mediaType"`
+		Digest      string            `json:"digest"`
+		Size        int64             `json:"size"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+	}
+	m := struct {
+		SchemaVersion int          `json:"schemaVersion"`
+		MediaType     string       `json:"mediaType"`
+		Config        descriptor   `json:"config"`
+		Layers        []descriptor `json:"layers"`
+	}{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.oci.image.manifest.v1+json",
+		Config: descriptor{
+			MediaType: "application/vnd.oci.empty.v1+json",
+			Digest:    r.putBlob([]byte("{}")),
+			Size:      2,
+		},
+	}
+	for _, l := range layers {
+		d := descriptor{
+			MediaType: l.MediaType,
+			Digest:    r.putBlob(l.Data),
+			Size:      int64(len(l.Data)),
+		}
+		if d.MediaType == "" {
+			d.MediaType = "application/octet-stream"
+		}
+		if l.Title != "" {
+			d.Annotations = map[string]string{"org.opencontainers.image.title": l.Title}
+		}
+		m.Layers = append(m.Layers, d)
+	}
+	return r.putManifest(repo, tag, m.MediaType, m)
+}
+
+// PushIndex stores a multi-platform index in repo, tagged tag.
+// manifests maps "os/arch" platforms to the digests returned by Push.
+func (r *Registry) PushIndex(repo, tag string, manifests map[string]string) string {
+	type platform struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	}
+	type descriptor struct {
+		MediaType string   `json:"mediaType"`
+		Digest    string   `json:"digest"`
+		Size      int64    `json:"size"`
+		Platform  platform `json:"platform"`
+	}
+	idx := struct {
+		SchemaVersion int          `json:"schemaVersion"`
+		MediaType     string       `json:"mediaType"`
+		Manifests     []descriptor `json:"manifests"`
+	}{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.oci.image.index.v1+json",
+	}
+	var platforms []string
+	for p := range manifests {
+		platforms = append(platforms, p)
+	}
+	sort.Strings(platforms)
+
+	r.mu.Lock()
+	for _, p := range platforms {
+		os, arch, _ := strings.Cut(p, "/")
+		digest := manifests[p]
+		idx.Manifests = append(idx.Manifests, descriptor{
+			MediaType: r.manifests[repo+"@"+digest].mediaType,
+			Digest:    digest,
+			Size:      int64(len(r.manifests[repo+"@"+digest].body)),
+			Platform:  platform{os, arch},
+		})
+	}
+	r.mu.Unlock()
+	return r.putManifest(repo, tag, idx.MediaType, idx)
+}
+
+// SetBlob replaces the content of the blob digest, to test how
+// clients deal with corrupted registries.
+func (r *Registry) SetBlob(digest string, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blobs[digest] = data
+}
+
+// SetManifest replaces the body of the manifest stored in repo under
+// digest, to test how clients deal with corrupted registries.
+func (r *Registry) SetManifest(repo, digest string, body []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := r.manifests[repo+"@"+digest]
+	m.body = body
+	r.manifests[repo+"@"+digest] = m
+}
+
+func (r *Registry) putBlob(data []byte) string {
+	digest := Digest(data)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blobs[digest] = data
+	return digest
+}
+
+func (r *Registry) putManifest(repo, tag, mediaType string, v interface{}) string {
+	body, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	digest := Digest(body)
+	m := manifest{mediaType, body}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.manifests[repo+"@"+digest] = m
+	r.manifests[repo+":"+tag] = m
+	return digest
+}
+
+// Digest returns the digest under which the Registry stores data.
+func Digest(data []byte) string {
+	h := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+func (r *Registry) serve(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		json.NewEncoder(w).Encode(map[string]string{"token": Token})
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if path == req.URL.Path {
+		http.NotFound(w, req)
+		return
+	}
+
+	var repo, kind, ref string
+	for _, k := range []string{"/manifests/", "/blobs/"} {
+		if i := strings.LastIndex(path, k); i >= 0 {
+			repo, kind, ref = path[:i], k, path[i+len(k):]
+			break
+		}
+	}
+	if repo == "" {
+		http.NotFound(w, req)
+		return
+	}
+
+	if r.RequireToken && req.Header.Get("Authorization") != "Bearer "+Token {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="ocitest",scope="repository:%s:pull"`, r.URL, repo))
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch kind {
+	case "/manifests/":
+		sep := ":"
+		if strings.HasPrefix(ref, "sha256:") {
+			sep = "@"
+		}
+		m, ok := r.manifests[repo+sep+ref]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Write(m.body)
+	case "/blobs/":
+		data, ok := r.blobs[ref]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data)
+	}
+}
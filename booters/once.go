@@ -0,0 +1,248 @@
+// Copyright 2024 Kairos contributors
+
+package booters
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/kairos-io/netboot/log"
+	"github.com/kairos-io/netboot/types"
+)
+
+// OnceBooter wraps a Booter so that each machine netboots its Spec
+// once, and then boots from its local disk: once a machine reports
+// that it is booting the kernel it was given, BootSpec returns nil for
+// it until it is re-armed.
+//
+// Booted machines are recorded in the JSON file at statePath, so they
+// stay booted across restarts. The file is re-read when it changes, so
+// removing a machine from it (or the whole file) by hand also re-arms
+// it, which is logged.
+//
+// Machines that boot custom iPXE scripts, or iPXE templates that
+// don't use Booting, never report that they are booting, and so keep
+// netbooting.
+func OnceBooter(base types.Booter, statePath string) (*Once, error) {
+	ret := &Once{
+		base:  base,
+		path:  statePath,
+		state: onceState{Booted: map[string]time.Time{}, Pending: map[string]time.Time{}},
+	}
+	if err := ret.load(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Once is the Booter returned by OnceBooter.
+type Once struct {
+	base types.Booter
+	path string
+
+	mu    sync.Mutex
+	state onceState
+	// Modification time of the state file when it was last read or
+	// written.
+	modTime time.Time
+}
+
+// onceState is the content of the state file.
+type onceState struct {
+	// Booted maps MAC addresses to the time they booted.
+	Booted map[string]time.Time `json:"booted"`
+	// Pending maps the MAC addresses of machines that were given a
+	// Spec and haven't booted it yet to when they were first given
+	// it, so that boots are recorded across restarts.
+	Pending map[string]time.Time `json:"pending,omitempty"`
+}
+
+// How long a machine that was given a Spec has to boot it.
+const oncePendingTTL = 24 * time.Hour
+
+// load re-reads the state file if it changed. Must be called with mu
+// held, or before o is shared.
+func (o *Once) load() error {
+	fi, err := os.Stat(o.path)
+	if errors.Is(err, os.ErrNotExist) {
+		if len(o.state.Booted) > 0 {
+			log.Log.Warn().Str("subsystem", "Once").Msgf("%s was removed, re-arming %d machines", o.path, len(o.state.Booted))
+		}
+		o.state = onceState{Booted: map[string]time.Time{}, Pending: map[string]time.Time{}}
+		o.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(o.modTime) {
+		return nil
+	}
+	bs, err := os.ReadFile(o.path)
+	if err != nil {
+		return err
+	}
+	var state onceState
+	if err = json.Unmarshal(bs, &state); err != nil {
+		return fmt.Errorf("parsing %s: %s", o.path, err)
+	}
+	if state.Booted == nil {
+		state.Booted = map[string]time.Time{}
+	}
+	if state.Pending == nil {
+		state.Pending = map[string]time.Time{}
+	}
+	for mac := range o.state.Booted {
+		if _, ok := state.Booted[mac]; !ok {
+			log.Log.Warn().Str("subsystem", "Once").Msgf("%s changed, re-arming %s", o.path, mac)
+		}
+	}
+	o.state = state
+	o.modTime = fi.ModTime()
+	return nil
+}
+
+// save writes the state file. Must be called with mu held.
+func (o *Once) save() error {
+	for mac, at := range o.state.Pending {
+		if time.Since(at) > oncePendingTTL {
+			delete(o.state.Pending, mac)
+		}
+	}
+	bs, err := json.MarshalIndent(o.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write and rename, so that a crash doesn't leave a truncated
+	// file behind.
+	tmp, err := os.CreateTemp(filepath.Dir(o.path), filepath.Base(o.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(append(bs, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), o.path); err != nil {
+		return err
+	}
+	fi, err := os.Stat(o.path)
+	if err != nil {
+		return err
+	}
+	o.modTime = fi.ModTime()
+	return nil
+}
+
+// BootSpec returns nil for machines that already booted, and asks the
+// wrapped Booter about the others.
+func (o *Once) BootSpec(m types.Machine) (*types.Spec, error) {
+	o.mu.Lock()
+	if err := o.load(); err != nil {
+		o.mu.Unlock()
+		return nil, err
+	}
+	_, booted := o.state.Booted[m.MAC.String()]
+	o.mu.Unlock()
+	if booted {
+		return nil, nil
+	}
+
+	spec, err := o.base.BootSpec(m)
+	if err != nil || spec == nil {
+		return spec, err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err = o.load(); err != nil {
+		return nil, err
+	}
+	if _, ok := o.state.Pending[m.MAC.String()]; !ok {
+		o.state.Pending[m.MAC.String()] = time.Now().UTC()
+		if err = o.save(); err != nil {
+			return nil, err
+		}
+	}
+	return spec, nil
+}
+
+// Booted records that m booted the Spec it was given, if it was given
+// one.
+func (o *Once) Booted(m types.Machine) error {
+	if n, ok := o.base.(types.BootNotifier); ok {
+		if err := n.Booted(m); err != nil {
+			return err
+		}
+	}
+
+	k := m.MAC.String()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.load(); err != nil {
+		return err
+	}
+	if _, ok := o.state.Pending[k]; !ok {
+		return nil
+	}
+	delete(o.state.Pending, k)
+	o.state.Booted[k] = time.Now().UTC()
+	return o.save()
+}
+
+// Rearm makes mac netboot again the next time it asks, e.g. to
+// reinstall it.
+func (o *Once) Rearm(mac net.HardwareAddr) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.load(); err != nil {
+		return err
+	}
+	if _, ok := o.state.Booted[mac.String()]; !ok {
+		return nil
+	}
+	delete(o.state.Booted, mac.String())
+	return o.save()
+}
+
+// BootedAt returns when mac booted, or the zero time if it is armed.
+func (o *Once) BootedAt(mac net.HardwareAddr) (time.Time, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.load(); err != nil {
+		return time.Time{}, err
+	}
+	return o.state.Booted[mac.String()], nil
+}
+
+// CheckClient asks the wrapped Booter whether the file with ID id can
+// be served to m.
+func (o *Once) CheckClient(m types.Machine, id types.ID) error {
+	return checkClient(o.base, m, id)
+}
+
+// FileName asks the wrapped Booter for the name of the file with ID
+// id.
+func (o *Once) FileName(id types.ID) (string, error) {
+	return fileName(o.base, id, id)
+}
+
+// ReadBootFile returns the wrapped Booter's files.
+func (o *Once) ReadBootFile(id types.ID) (io.ReadCloser, int64, error) {
+	return o.base.ReadBootFile(id)
+}
+
+// WriteBootFile writes to the wrapped Booter's files.
+func (o *Once) WriteBootFile(id types.ID, body io.Reader) error {
+	return o.base.WriteBootFile(id, body)
+}
@@ -0,0 +1,276 @@
+// Copyright 2024 Kairos contributors
+
+package booters
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/kairos-io/netboot/constants"
+	"github.com/kairos-io/netboot/types"
+	"github.com/kairos-io/netboot/utils"
+	"sigs.k8s.io/yaml"
+)
+
+// A Rule matches machines, and says how to boot them.
+//
+// Each of the matcher fields that is set must match the machine. A
+// matcher field matches if any of the values in it match. A Rule
+// with no matchers matches every machine.
+type Rule struct {
+	// Name identifies the rule in errors.
+	Name string `json:"name,omitempty"`
+
+	// MAC matches MAC addresses. Values are either a full address
+	// ("01:02:03:04:05:06"), a prefix of one or more octets such as
+	// an OUI ("01:02:03"), or an inclusive range of full addresses
+	// ("01:02:03:00:00:00..01:02:03:00:00:ff"). Octets can also be
+	// separated by dashes ("01-02-03"), which is why ranges use "..".
+	MAC []string `json:"mac,omitempty"`
+	// Arch matches architectures by name: "ia32", "x64" or "arm64".
+	Arch []string `json:"arch,omitempty"`
+	// GUID matches client GUIDs, in the notation of
+	// utils.FormatGUID, with or without dashes.
+	GUID []string `json:"guid,omitempty"`
+	// VendorClass matches DHCP vendor classes, using path.Match
+	// patterns (e.g. "PXEClient:Arch:00007:*").
+	VendorClass []string `json:"vendor-class,omitempty"`
+
+	// Spec is what matching machines boot. IDs in it are local file
+	// paths or HTTP/HTTPS URLs, as for StaticBooter.
+	Spec *types.Spec `json:"spec,omitempty"`
+	// Ignore makes matching machines not netboot. Exactly one of
+	// Spec and Ignore must be set.
+	Ignore bool `json:"ignore,omitempty"`
+}
+
+// LoadRules reads a YAML or JSON list of Rules from path.
+func LoadRules(path string) ([]Rule, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err = yaml.UnmarshalStrict(bs, &rules); err != nil {
+		return nil, fmt.Errorf("parsing rules %s: %s", path, err)
+	}
+	return rules, nil
+}
+
+// RulesBooter boots each machine according to the first of rules that
+// matches it. Machines that match no rule don't netboot.
+func RulesBooter(rules []Rule) (types.Booter, error) {
+	ret := &rulesBooter{}
+	for i, rule := range rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		r, err := compileRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %s", name, err)
+		}
+		ret.rules = append(ret.rules, r)
+	}
+	return ret, nil
+}
+
+type rulesBooter struct {
+	rules []*compiledRule
+}
+
+type compiledRule struct {
+	matchers []func(types.Machine) bool
+	// nil if the rule ignores machines.
+	booter types.Booter
+}
+
+func (r *compiledRule) match(m types.Machine) bool {
+	for _, f := range r.matchers {
+		if !f(m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *rulesBooter) BootSpec(m types.Machine) (*types.Spec, error) {
+	for i, r := range b.rules {
+		if !r.match(m) {
+			continue
+		}
+		if r.booter == nil {
+			return nil, nil
+		}
+		spec, err := r.booter.BootSpec(m)
+		if err != nil || spec == nil {
+			return spec, err
+		}
+		return namespaceSpec(spec, namespace("rule", i))
+	}
+	return nil, nil
+}
+
+func (b *rulesBooter) ruleBooter(id types.ID) (types.Booter, types.ID, error) {
+	i, rest, err := splitNamespace(id, "rule")
+	if err != nil {
+		return nil, "", err
+	}
+	if i >= len(b.rules) || b.rules[i].booter == nil {
+		return nil, "", fmt.Errorf("no file with ID %q", id)
+	}
+	return b.rules[i].booter, rest, nil
+}
+
+func (b *rulesBooter) ReadBootFile(id types.ID) (io.ReadCloser, int64, error) {
+	booter, rest, err := b.ruleBooter(id)
+	if err != nil {
+		return nil, -1, err
+	}
+	return booter.ReadBootFile(rest)
+}
+
+func (b *rulesBooter) WriteBootFile(id types.ID, body io.Reader) error {
+	booter, rest, err := b.ruleBooter(id)
+	if err != nil {
+		return err
+	}
+	return booter.WriteBootFile(rest, body)
+}
+
+func compileRule(rule Rule) (*compiledRule, error) {
+	ret := &compiledRule{}
+	switch {
+	case rule.Spec != nil && rule.Ignore:
+		return nil, errors.New("only one of spec and ignore can be set")
+	case rule.Spec != nil:
+		b, err := StaticBooter(rule.Spec)
+		if err != nil {
+			return nil, err
+		}
+		ret.booter = b
+	case !rule.Ignore:
+		return nil, errors.New("one of spec or ignore must be set")
+	}
+
+	if len(rule.MAC) > 0 {
+		var fs []func(net.HardwareAddr) bool
+		for _, s := range rule.MAC {
+			f, err := macMatcher(s)
+			if err != nil {
+				return nil, err
+			}
+			fs = append(fs, f)
+		}
+		ret.matchers = append(ret.matchers, func(m types.Machine) bool {
+			for _, f := range fs {
+				if f(m.MAC) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+
+	if len(rule.Arch) > 0 {
+		var archs []constants.Architecture
+		for _, s := range rule.Arch {
+			a, err := constants.ParseArchitecture(s)
+			if err != nil {
+				return nil, err
+			}
+			archs = append(archs, a)
+		}
+		ret.matchers = append(ret.matchers, func(m types.Machine) bool {
+			for _, a := range archs {
+				if m.Arch == a {
+					return true
+				}
+			}
+			return false
+		})
+	}
+
+	if len(rule.GUID) > 0 {
+		var guids []string
+		for _, s := range rule.GUID {
+			// In the dashed form of utils.FormatGUID, which is a
+			// string rather than byte order.
+			h := strings.ToLower(strings.ReplaceAll(s, "-", ""))
+			if bs, err := hex.DecodeString(h); err != nil || len(bs) != 16 {
+				return nil, fmt.Errorf("invalid GUID %q", s)
+			}
+			guids = append(guids, h[:8]+"-"+h[8:12]+"-"+h[12:16]+"-"+h[16:20]+"-"+h[20:])
+		}
+		ret.matchers = append(ret.matchers, func(m types.Machine) bool {
+			if m.GUID == nil {
+				return false
+			}
+			guid := utils.FormatGUID(m.GUID)
+			for _, s := range guids {
+				if strings.EqualFold(s, guid) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+
+	if len(rule.VendorClass) > 0 {
+		for _, s := range rule.VendorClass {
+			if _, err := path.Match(s, ""); err != nil {
+				return nil, fmt.Errorf("invalid vendor class pattern %q: %s", s, err)
+			}
+		}
+		ret.matchers = append(ret.matchers, func(m types.Machine) bool {
+			for _, s := range rule.VendorClass {
+				if ok, _ := path.Match(s, m.VendorClass); ok {
+					return true
+				}
+			}
+			return false
+		})
+	}
+
+	return ret, nil
+}
+
+// macMatcher parses one of the MAC address forms described in
+// Rule.MAC.
+func macMatcher(s string) (func(net.HardwareAddr) bool, error) {
+	if lo, hi, ok := strings.Cut(s, ".."); ok {
+		from, err := net.ParseMAC(strings.TrimSpace(lo))
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC range %q: %s", s, err)
+		}
+		to, err := net.ParseMAC(strings.TrimSpace(hi))
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC range %q: %s", s, err)
+		}
+		if len(from) != len(to) || bytes.Compare(from, to) > 0 {
+			return nil, fmt.Errorf("invalid MAC range %q: start is after end", s)
+		}
+		return func(mac net.HardwareAddr) bool {
+			return len(mac) == len(from) && bytes.Compare(mac, from) >= 0 && bytes.Compare(mac, to) <= 0
+		}, nil
+	}
+
+	var prefix []byte
+	for _, octet := range strings.Split(strings.ReplaceAll(s, "-", ":"), ":") {
+		bs, err := hex.DecodeString(octet)
+		if err != nil || len(bs) != 1 {
+			return nil, fmt.Errorf("invalid MAC address or prefix %q", s)
+		}
+		prefix = append(prefix, bs[0])
+	}
+	return func(mac net.HardwareAddr) bool {
+		return bytes.HasPrefix(mac, prefix)
+	}, nil
+}
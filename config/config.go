@@ -0,0 +1,932 @@
+// Copyright 2024 Kairos contributors
+
+// Package config builds Servers from a declarative YAML or JSON
+// document.
+//
+// A minimal configuration boots every machine into the same kernel:
+//
+//	booter:
+//	  static:
+//	    kernel: /srv/boot/vmlinuz
+//	    initrd: [/srv/boot/initrd]
+//	    cmdline: console=ttyS0
+package config
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/netboot/booters"
+	"github.com/kairos-io/netboot/constants"
+	"github.com/kairos-io/netboot/dhcp6"
+	"github.com/kairos-io/netboot/dhcp6/pool"
+	"github.com/kairos-io/netboot/server"
+	"github.com/kairos-io/netboot/types"
+	"github.com/kairos-io/netboot/utils"
+	"sigs.k8s.io/yaml"
+)
+
+// Config describes a boot server.
+type Config struct {
+	// Address to listen on, or empty for all interfaces.
+	Address string `json:"address,omitempty"`
+	// Ports overrides the standard ports. Only useful for testing,
+	// firmwares hardcode the standard ports.
+	Ports Ports `json:"ports,omitempty"`
+	// DHCPNoBind listens for DHCP traffic without binding to the
+	// DHCP port, to coexist with another DHCP server.
+	DHCPNoBind bool `json:"dhcp-no-bind,omitempty"`
+	// Firmware maps firmware names (see FirmwareNames) to the iPXE
+	// binary to serve them. Firmwares not listed get the bundled
+	// binaries.
+	Firmware map[string]string `json:"firmware,omitempty"`
+	// Grub maps EFI firmware names to the GRUB and shim binaries to
+	// boot them with instead of iPXE, for Secure Boot machines.
+	Grub map[string]*Grub `json:"grub,omitempty"`
+	// Loaders maps EFI firmware names to the boot chain ("ipxe" or
+	// "grub") of machines whose spec doesn't pick one. Firmwares not
+	// listed boot GRUB if Grub has them, iPXE otherwise.
+	Loaders map[string]string `json:"loaders,omitempty"`
+	// MachineLoaders maps MAC addresses to the boot chain of that
+	// machine, when its spec doesn't pick one. It takes precedence
+	// over Loaders.
+	MachineLoaders map[string]string `json:"machine-loaders,omitempty"`
+	// Booter decides what machines boot.
+	Booter Booter `json:"booter"`
+	// DHCPv6, if set, also runs a DHCPv6 server.
+	DHCPv6 *DHCPv6 `json:"dhcpv6,omitempty"`
+	// TLS, if set, also serves HTTPS and has iPXE use it.
+	TLS *TLS `json:"tls,omitempty"`
+	// VerifyCacheDir and VerifyLogOnly configure how boot files are
+	// checked against the digests and signatures of their spec, see
+	// server.Server.
+	VerifyCacheDir string `json:"verify-cache-dir,omitempty"`
+	VerifyLogOnly  bool   `json:"verify-log-only,omitempty"`
+	// FileTokenLifetime, if set, only serves boot files to machines
+	// that got an iPXE script in the last FileTokenLifetime, see
+	// server.Server.
+	FileTokenLifetime Duration `json:"file-token-lifetime,omitempty"`
+	// UploadMaxSize, if set, accepts uploads from machines of up to
+	// that many bytes. Requires FileTokenLifetime.
+	UploadMaxSize int64 `json:"upload-max-size,omitempty"`
+	// ShutdownTimeout is how long in-flight transfers get to finish
+	// when the server stops, see server.Server.
+	ShutdownTimeout Duration `json:"shutdown-timeout,omitempty"`
+
+	// Directory that relative file paths are relative to.
+	baseDir string
+}
+
+// Grub configures a server.GrubLoader.
+type Grub struct {
+	// Shim is a signed shim EFI binary. If empty, GRUB is booted
+	// directly.
+	Shim string `json:"shim,omitempty"`
+	// Grub is a network-enabled GRUB EFI binary, signed for shim if
+	// shim is set.
+	Grub string `json:"grub"`
+}
+
+// Ports are the ports a Server listens on. Zero means the standard
+// port.
+type Ports struct {
+	DHCP  int `json:"dhcp,omitempty"`
+	TFTP  int `json:"tftp,omitempty"`
+	PXE   int `json:"pxe,omitempty"`
+	HTTP  int `json:"http,omitempty"`
+	HTTPS int `json:"https,omitempty"`
+}
+
+// TLS configures serving boot scripts and files over HTTPS. Either
+// Cert and Key, or CACert and CAKey must be set.
+type TLS struct {
+	// Cert and Key are the PEM server certificate and private key.
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+
+	// CACert and CAKey are a PEM CA certificate and private key, which
+	// issue a server certificate at startup. They are created if
+	// neither exists, see utils.LoadOrCreateCA.
+	CACert string `json:"ca-cert,omitempty"`
+	CAKey  string `json:"ca-key,omitempty"`
+	// Hosts are the IP addresses and DNS names that the issued
+	// certificate is valid for. Defaults to address, or to all the
+	// addresses of the machine's network interfaces.
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+// Booter selects one of the Booter implementations. Exactly one of
+// the fields above Fallback must be set, the others wrap that Booter.
+type Booter struct {
+	// Static boots every machine with the same spec.
+	Static *types.Spec `json:"static,omitempty"`
+	// Uploads is the directory that machines booted with Static
+	// store the files they upload in, see
+	// booters.StaticBooterWithUploads. Uploads also need
+	// upload-max-size.
+	Uploads string `json:"uploads,omitempty"`
+	// StaticArch overrides Static for machines of the given
+	// architectures ("ia32", "x64" or "arm64"). If Static is not set,
+	// machines of other architectures don't netboot.
+	StaticArch map[string]*types.Spec `json:"static-arch,omitempty"`
+	// API asks a remote HTTP server what to boot.
+	API *APIBooter `json:"api,omitempty"`
+	// Rules picks a spec for each machine from a list of rules.
+	Rules []booters.Rule `json:"rules,omitempty"`
+	// RulesFile is like Rules, but reads the rules from a YAML or
+	// JSON file.
+	RulesFile string `json:"rules-file,omitempty"`
+	// Dir reads per-machine specs and profiles from a directory
+	// tree, see booters.DirBooter.
+	Dir string `json:"dir,omitempty"`
+	// ISO boots the kernel found in an ISO image.
+	ISO *ISOBooter `json:"iso,omitempty"`
+
+	// Fallback is asked about machines that this Booter doesn't
+	// boot.
+	Fallback *Booter `json:"fallback,omitempty"`
+	// Overrides boots the machines with the given MAC addresses with
+	// a fixed spec, instead of asking this Booter.
+	Overrides map[string]*types.Spec `json:"overrides,omitempty"`
+	// Once makes each machine netboot only once, and then boot from
+	// disk. Booted machines are recorded in the JSON file at this
+	// path, see booters.OnceBooter.
+	Once string `json:"once,omitempty"`
+	// Deny lists MAC addresses of machines that must not netboot.
+	Deny []string `json:"deny,omitempty"`
+}
+
+// ISOBooter configures booters.ISOBooter.
+type ISOBooter struct {
+	// Path of the ISO image.
+	Path string `json:"path"`
+	// Cmdline is appended to the commandline found in the image.
+	Cmdline string `json:"cmdline,omitempty"`
+}
+
+// APIBooter configures a booters.APIBooter.
+type APIBooter struct {
+	URL     string   `json:"url"`
+	Timeout Duration `json:"timeout,omitempty"`
+	// Version of the API protocol, 1 (the default) or 2. Only the
+	// booter supports version 2, not dhcpv6.api.
+	Version int `json:"version,omitempty"`
+
+	// Headers are added to every request to the API.
+	Headers map[string]string `json:"headers,omitempty"`
+	// BearerToken, or the content of BearerTokenFile, is sent as an
+	// OAuth2 style bearer token.
+	BearerToken     string `json:"bearer-token,omitempty"`
+	BearerTokenFile string `json:"bearer-token-file,omitempty"`
+	// Username and Password are sent with HTTP basic authentication.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// CA is a PEM bundle of the certificate authorities to verify
+	// the API server against, instead of the system's.
+	CA string `json:"ca,omitempty"`
+	// Cert and Key are a PEM client certificate and its private key,
+	// for APIs that require mutual TLS.
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+
+	// Proxy is the URL of an HTTP proxy to use, instead of the one
+	// set by the environment.
+	Proxy string `json:"proxy,omitempty"`
+
+	// KeysFile holds the keys that boot file URLs are signed with,
+	// so that they stay valid across restarts, see
+	// utils.LoadKeySet. It is created if missing. KeyRotation, if
+	// set, replaces the signing key that often.
+	KeysFile    string   `json:"keys-file,omitempty"`
+	KeyRotation Duration `json:"key-rotation,omitempty"`
+	// URLTTL, BindMAC and BindIP restrict the use of boot file URLs,
+	// see booters.APIOptions. BindMAC requires FileTokenLifetime,
+	// the MAC address is whatever the client claims otherwise.
+	URLTTL  Duration `json:"url-ttl,omitempty"`
+	BindMAC bool     `json:"bind-mac,omitempty"`
+	BindIP  bool     `json:"bind-ip,omitempty"`
+}
+
+// DHCPv6 configures a ServerV6.
+type DHCPv6 struct {
+	// Address is the IPv6 address to listen on.
+	Address string `json:"address"`
+	Port    int    `json:"port,omitempty"`
+
+	// Boot file URLs handed out to clients. Either these or API must
+	// be set.
+	HTTPBootURL string `json:"http-boot-url,omitempty"`
+	IpxeBootURL string `json:"ipxe-boot-url,omitempty"`
+	// API asks a remote HTTP server for boot file URLs.
+	API *APIBooter `json:"api,omitempty"`
+
+	DNS        []string `json:"dns,omitempty"`
+	Preference *uint8   `json:"preference,omitempty"`
+
+	// Pool of addresses to assign to clients.
+	Pool Pool `json:"pool"`
+	// Lifetimes of assigned addresses, in seconds.
+	PreferredLifetime uint32 `json:"preferred-lifetime,omitempty"`
+	ValidLifetime     uint32 `json:"valid-lifetime,omitempty"`
+}
+
+// Pool is a range of IPv6 addresses.
+type Pool struct {
+	Start string `json:"start"`
+	Size  uint64 `json:"size"`
+}
+
+// Default address lifetimes for DHCPv6.
+const (
+	DefaultPreferredLifetime = 1800
+	DefaultValidLifetime     = 3600
+)
+
+// Duration is a time.Duration written as a string like "1m30s".
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(bs []byte) error {
+	var s string
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\", got %s", bs)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// FirmwareNames maps the firmware names used in Config.Firmware to
+// firmware types.
+var FirmwareNames = map[string]constants.Firmware{
+	"x86-pc":    constants.FirmwareX86PC,
+	"x86-ipxe":  constants.FirmwareX86Ipxe,
+	"efi32":     constants.FirmwareEFI32,
+	"efi64":     constants.FirmwareEFI64,
+	"efibc":     constants.FirmwareEFIBC,
+	"efi-arm64": constants.FirmwareEfiArm64,
+}
+
+// A ValidationError lists everything that is wrong with a Config.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid config: " + strings.Join(e.Problems, "; ")
+}
+
+// Load reads and validates the configuration in path. Relative file
+// paths in the configuration are relative to the directory of path.
+func Load(path string) (*Config, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parse(bs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	cfg.baseDir = filepath.Dir(path)
+	if err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Parse parses and validates a YAML or JSON configuration. Relative
+// file paths are relative to the current directory.
+func Parse(bs []byte) (*Config, error) {
+	cfg, err := parse(bs)
+	if err != nil {
+		return nil, err
+	}
+	if err = cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func parse(bs []byte) (*Config, error) {
+	var cfg Config
+	if err := yaml.UnmarshalStrict(bs, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing config: %s", err)
+	}
+	return &cfg, nil
+}
+
+// Validate checks that c describes servers that can be built.
+func (c *Config) Validate() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Address != "" && net.ParseIP(c.Address) == nil {
+		problem("address: %q is not an IP address", c.Address)
+	}
+	for _, p := range []struct {
+		name string
+		port int
+	}{{"dhcp", c.Ports.DHCP}, {"tftp", c.Ports.TFTP}, {"pxe", c.Ports.PXE}, {"http", c.Ports.HTTP}, {"https", c.Ports.HTTPS}} {
+		if p.port < 0 || p.port > 65535 {
+			problem("ports.%s: %d is not a valid port", p.name, p.port)
+		}
+	}
+	var names []string
+	for name := range c.Firmware {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := FirmwareNames[name]; !ok {
+			problem("firmware.%s: unknown firmware, must be one of %s", name, strings.Join(firmwareNames(), ", "))
+		}
+		if c.Firmware[name] == "" {
+			problem("firmware.%s: missing path", name)
+		}
+	}
+	names = names[:0]
+	for name := range c.Grub {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch FirmwareNames[name] {
+		case constants.FirmwareEFI32, constants.FirmwareEFI64, constants.FirmwareEFIBC, constants.FirmwareEfiArm64:
+		default:
+			problem("grub.%s: not an EFI firmware, must be one of efi-arm64, efi32, efi64, efibc", name)
+		}
+		if g := c.Grub[name]; g == nil || g.Grub == "" {
+			problem("grub.%s.grub: missing path", name)
+		}
+	}
+	names = names[:0]
+	for name := range c.Loaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch FirmwareNames[name] {
+		case constants.FirmwareEFI32, constants.FirmwareEFI64, constants.FirmwareEFIBC, constants.FirmwareEfiArm64:
+		default:
+			problem("loaders.%s: not an EFI firmware, must be one of efi-arm64, efi32, efi64, efibc", name)
+		}
+		switch c.Loaders[name] {
+		case types.LoaderIpxe:
+		case types.LoaderGrub:
+			if c.Grub[name] == nil {
+				problem("loaders.%s: grub requires grub.%s", name, name)
+			}
+		default:
+			problem("loaders.%s: unknown loader %q, must be ipxe or grub", name, c.Loaders[name])
+		}
+	}
+	names = names[:0]
+	for mac := range c.MachineLoaders {
+		names = append(names, mac)
+	}
+	sort.Strings(names)
+	for _, mac := range names {
+		if _, err := net.ParseMAC(mac); err != nil {
+			problem("machine-loaders.%s: %q is not a MAC address", mac, mac)
+		}
+		if l := c.MachineLoaders[mac]; l != types.LoaderIpxe && l != types.LoaderGrub {
+			problem("machine-loaders.%s: unknown loader %q, must be ipxe or grub", mac, l)
+		}
+	}
+
+	c.Booter.validate("booter", problem)
+	if c.FileTokenLifetime < 0 {
+		problem("file-token-lifetime: must not be negative")
+	}
+	if c.UploadMaxSize < 0 {
+		problem("upload-max-size: must not be negative")
+	}
+	if c.UploadMaxSize > 0 && c.FileTokenLifetime == 0 {
+		problem("upload-max-size: requires file-token-lifetime")
+	}
+	for b, field := &c.Booter, "booter"; b != nil; b, field = b.Fallback, field+".fallback" {
+		if b.API != nil && b.API.BindMAC && c.FileTokenLifetime == 0 {
+			problem("%s.api.bind-mac: requires file-token-lifetime", field)
+		}
+	}
+	if c.ShutdownTimeout < 0 {
+		problem("shutdown-timeout: must not be negative")
+	}
+
+	if t := c.TLS; t != nil {
+		switch {
+		case (t.Cert != "" || t.Key != "") && (t.CACert != "" || t.CAKey != ""):
+			problem("tls: cert and key can't be combined with ca-cert and ca-key")
+		case t.Cert != "" || t.Key != "":
+			if t.Cert == "" || t.Key == "" {
+				problem("tls: cert and key must be set together")
+			}
+		case t.CACert != "" || t.CAKey != "":
+			if t.CACert == "" || t.CAKey == "" {
+				problem("tls: ca-cert and ca-key must be set together")
+			}
+		default:
+			problem("tls: one of cert and key, or ca-cert and ca-key must be set")
+		}
+		if len(t.Hosts) > 0 && t.CACert == "" {
+			problem("tls.hosts: only used with ca-cert and ca-key")
+		}
+	}
+
+	if v6 := c.DHCPv6; v6 != nil {
+		if ip := net.ParseIP(v6.Address); ip == nil || ip.To4() != nil {
+			problem("dhcpv6.address: %q is not an IPv6 address", v6.Address)
+		}
+		if v6.Port < 0 || v6.Port > 65535 {
+			problem("dhcpv6.port: %d is not a valid port", v6.Port)
+		}
+		switch {
+		case v6.API != nil && (v6.HTTPBootURL != "" || v6.IpxeBootURL != ""):
+			problem("dhcpv6: api can't be combined with http-boot-url or ipxe-boot-url")
+		case v6.API != nil:
+			v6.API.validate("dhcpv6.api", problem)
+			if v6.API.Version == 2 {
+				problem("dhcpv6.api.version: only version 1 is supported")
+			}
+			if v6.API.KeysFile != "" || v6.API.URLTTL != 0 || v6.API.BindMAC || v6.API.BindIP {
+				problem("dhcpv6.api: keys-file, url-ttl, bind-mac and bind-ip are only supported by the booter")
+			}
+		case v6.HTTPBootURL == "" && v6.IpxeBootURL == "":
+			problem("dhcpv6: one of api, http-boot-url or ipxe-boot-url must be set")
+		}
+		for i, dns := range v6.DNS {
+			if net.ParseIP(dns) == nil {
+				problem("dhcpv6.dns[%d]: %q is not an IP address", i, dns)
+			}
+		}
+		if ip := net.ParseIP(v6.Pool.Start); ip == nil || ip.To4() != nil {
+			problem("dhcpv6.pool.start: %q is not an IPv6 address", v6.Pool.Start)
+		}
+		if v6.Pool.Size == 0 {
+			problem("dhcpv6.pool.size: must be greater than zero")
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func (a *APIBooter) validate(field string, problem func(string, ...interface{})) {
+	u, err := url.Parse(a.URL)
+	switch {
+	case a.URL == "":
+		problem("%s.url: missing", field)
+	case err != nil || !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https"):
+		problem("%s.url: %q is not an http or https URL", field, a.URL)
+	}
+	if a.Timeout < 0 {
+		problem("%s.timeout: must not be negative", field)
+	}
+	if a.Version != 0 && a.Version != 1 && a.Version != 2 {
+		problem("%s.version: unsupported API version %d", field, a.Version)
+	}
+	if a.KeyRotation < 0 {
+		problem("%s.key-rotation: must not be negative", field)
+	}
+	if a.KeyRotation != 0 && a.KeysFile == "" {
+		problem("%s.key-rotation: requires keys-file", field)
+	}
+	if a.URLTTL < 0 {
+		problem("%s.url-ttl: must not be negative", field)
+	}
+	auth := 0
+	for _, set := range []bool{a.BearerToken != "", a.BearerTokenFile != "", a.Username != "" || a.Password != ""} {
+		if set {
+			auth++
+		}
+	}
+	if auth > 1 {
+		problem("%s: only one of bearer-token, bearer-token-file or username/password can be set", field)
+	}
+	if (a.Cert == "") != (a.Key == "") {
+		problem("%s: cert and key must be set together", field)
+	}
+	if a.Proxy != "" {
+		if u, err := url.Parse(a.Proxy); err != nil || !u.IsAbs() {
+			problem("%s.proxy: %q is not a URL", field, a.Proxy)
+		}
+	}
+}
+
+// clientOptions reads the files that a refers to, and returns the
+// options to build its HTTP clients with.
+func (a *APIBooter) clientOptions(c *Config) ([]utils.HTTPClientOption, error) {
+	var opts []utils.HTTPClientOption
+	keys := make([]string, 0, len(a.Headers))
+	for k := range a.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		opts = append(opts, utils.WithHeader(k, a.Headers[k]))
+	}
+	switch {
+	case a.BearerToken != "":
+		opts = append(opts, utils.WithBearerToken(a.BearerToken))
+	case a.BearerTokenFile != "":
+		bs, err := os.ReadFile(c.path(a.BearerTokenFile))
+		if err != nil {
+			return nil, fmt.Errorf("bearer-token-file: %s", err)
+		}
+		opts = append(opts, utils.WithBearerToken(strings.TrimSpace(string(bs))))
+	case a.Username != "" || a.Password != "":
+		opts = append(opts, utils.WithBasicAuth(a.Username, a.Password))
+	}
+	if a.CA != "" {
+		pool, err := utils.LoadCertPool(c.path(a.CA))
+		if err != nil {
+			return nil, fmt.Errorf("ca: %s", err)
+		}
+		opts = append(opts, utils.WithRootCAs(pool))
+	}
+	if a.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.path(a.Cert), c.path(a.Key))
+		if err != nil {
+			return nil, fmt.Errorf("cert: %s", err)
+		}
+		opts = append(opts, utils.WithClientCertificate(cert))
+	}
+	if a.Proxy != "" {
+		u, err := url.Parse(a.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %s", err)
+		}
+		opts = append(opts, utils.WithProxy(u))
+	}
+	return opts, nil
+}
+
+// bootable reports whether spec says what to boot.
+func bootable(spec *types.Spec) bool {
+	return spec != nil && (spec.Kernel != "" || spec.Efi != "" || len(spec.UKI) > 0 || spec.Menu != nil || spec.IpxeTemplate != "")
+}
+
+// validate reports the problems of b, using field as the name of b in
+// messages.
+func (b *Booter) validate(field string, problem func(string, ...interface{})) {
+	switch n := b.count(); {
+	case n == 0:
+		problem("%s: no booter configured, set one of static, api, rules, rules-file, dir or iso", field)
+	case n > 1:
+		problem("%s: only one of static, api, rules, rules-file, dir or iso can be set", field)
+	}
+	if spec := b.Static; spec != nil && !bootable(spec) {
+		problem("%s.static: one of kernel, efi, uki, menu or ipxe-template must be set", field)
+	}
+	if b.Uploads != "" && (b.Static == nil || len(b.StaticArch) > 0) {
+		problem("%s.uploads: only supported with static, without static-arch", field)
+	}
+	archs := make([]string, 0, len(b.StaticArch))
+	for name := range b.StaticArch {
+		archs = append(archs, name)
+	}
+	sort.Strings(archs)
+	for _, name := range archs {
+		if _, err := constants.ParseArchitecture(name); err != nil {
+			problem("%s.static-arch.%s: %s", field, name, err)
+		}
+		if spec := b.StaticArch[name]; !bootable(spec) {
+			problem("%s.static-arch.%s: one of kernel, efi, uki, menu or ipxe-template must be set", field, name)
+		}
+	}
+	if b.API != nil {
+		b.API.validate(field+".api", problem)
+	}
+	if b.ISO != nil && b.ISO.Path == "" {
+		problem("%s.iso.path: missing path", field)
+	}
+	for i, rule := range b.Rules {
+		if _, err := booters.RulesBooter([]booters.Rule{rule}); err != nil {
+			problem("%s.rules[%d]: %s", field, i, strings.TrimPrefix(err.Error(), "rule #0: "))
+		}
+	}
+
+	if b.Fallback != nil {
+		b.Fallback.validate(field+".fallback", problem)
+	}
+	macs := make([]string, 0, len(b.Overrides))
+	for mac := range b.Overrides {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+	for _, mac := range macs {
+		if _, err := net.ParseMAC(mac); err != nil {
+			problem("%s.overrides.%s: %q is not a MAC address", field, mac, mac)
+		}
+		if spec := b.Overrides[mac]; !bootable(spec) {
+			problem("%s.overrides.%s: one of kernel, efi, uki, menu or ipxe-template must be set", field, mac)
+		}
+	}
+	for i, mac := range b.Deny {
+		if _, err := net.ParseMAC(mac); err != nil {
+			problem("%s.deny[%d]: %q is not a MAC address", field, i, mac)
+		}
+	}
+}
+
+func (b *Booter) count() int {
+	n := 0
+	if b.Static != nil || len(b.StaticArch) > 0 {
+		n++
+	}
+	if b.API != nil {
+		n++
+	}
+	if len(b.Rules) > 0 {
+		n++
+	}
+	if b.RulesFile != "" {
+		n++
+	}
+	if b.Dir != "" {
+		n++
+	}
+	if b.ISO != nil {
+		n++
+	}
+	return n
+}
+
+func firmwareNames() []string {
+	var ret []string
+	for name := range FirmwareNames {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (c *Config) path(p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(c.baseDir, p)
+}
+
+// NewBooter builds the Booter described by c.Booter.
+func (c *Config) NewBooter() (types.Booter, error) {
+	return c.Booter.build(c)
+}
+
+// build builds the Booter described by b, resolving paths relative to
+// c's directory.
+func (b *Booter) build(c *Config) (types.Booter, error) {
+	booter, err := b.buildBase(c)
+	if err != nil {
+		return nil, err
+	}
+	if b.Fallback != nil {
+		fallback, err := b.Fallback.build(c)
+		if err != nil {
+			return nil, err
+		}
+		booter = booters.FallbackBooter(booter, fallback)
+	}
+	if len(b.Overrides) > 0 {
+		if booter, err = booters.OverrideBooter(booter, b.Overrides); err != nil {
+			return nil, err
+		}
+	}
+	if b.Once != "" {
+		if booter, err = booters.OnceBooter(booter, c.path(b.Once)); err != nil {
+			return nil, err
+		}
+	}
+	if len(b.Deny) > 0 {
+		if booter, err = booters.DenyListBooter(booter, b.Deny); err != nil {
+			return nil, err
+		}
+	}
+	return booter, nil
+}
+
+func (b *Booter) buildBase(c *Config) (types.Booter, error) {
+	switch {
+	case len(b.StaticArch) > 0:
+		archs := make(map[constants.Architecture]*types.Spec, len(b.StaticArch))
+		for name, spec := range b.StaticArch {
+			arch, err := constants.ParseArchitecture(name)
+			if err != nil {
+				return nil, fmt.Errorf("static-arch.%s: %s", name, err)
+			}
+			archs[arch] = spec
+		}
+		return booters.ArchStaticBooter(b.Static, archs)
+	case b.Static != nil:
+		return booters.StaticBooterWithUploads(b.Static, c.path(b.Uploads))
+	case b.API != nil:
+		opts, err := b.API.clientOptions(c)
+		if err != nil {
+			return nil, fmt.Errorf("api.%s", err)
+		}
+		apiOpts := booters.APIOptions{
+			Version: b.API.Version,
+			Timeout: time.Duration(b.API.Timeout),
+			Client:  opts,
+			URLTTL:  time.Duration(b.API.URLTTL),
+			BindMAC: b.API.BindMAC,
+			BindIP:  b.API.BindIP,
+		}
+		if apiOpts.Version == 0 {
+			apiOpts.Version = 1
+		}
+		if b.API.KeysFile != "" {
+			if apiOpts.Keys, err = utils.LoadKeySet(c.path(b.API.KeysFile), time.Duration(b.API.KeyRotation)); err != nil {
+				return nil, fmt.Errorf("api.keys-file: %s", err)
+			}
+		}
+		return booters.NewAPIBooter(b.API.URL, apiOpts)
+	case len(b.Rules) > 0:
+		return booters.RulesBooter(b.Rules)
+	case b.RulesFile != "":
+		rules, err := booters.LoadRules(c.path(b.RulesFile))
+		if err != nil {
+			return nil, fmt.Errorf("rules-file: %s", err)
+		}
+		return booters.RulesBooter(rules)
+	case b.Dir != "":
+		return booters.DirBooter(c.path(b.Dir))
+	case b.ISO != nil:
+		return booters.ISOBooter(c.path(b.ISO.Path), b.ISO.Cmdline)
+	}
+	return nil, errors.New("no booter configured")
+}
+
+// Server builds the Server described by c. Its Log and Debug fields
+// are left for the caller to fill.
+func (c *Config) Server() (*server.Server, error) {
+	booter, err := c.NewBooter()
+	if err != nil {
+		return nil, err
+	}
+	ipxe := server.DefaultFirmwares()
+	for name, path := range c.Firmware {
+		bs, err := os.ReadFile(c.path(path))
+		if err != nil {
+			return nil, fmt.Errorf("firmware.%s: %s", name, err)
+		}
+		ipxe[FirmwareNames[name]] = bs
+	}
+	var grub map[constants.Firmware]*server.GrubLoader
+	for name, g := range c.Grub {
+		l := &server.GrubLoader{}
+		if l.Grub, err = os.ReadFile(c.path(g.Grub)); err != nil {
+			return nil, fmt.Errorf("grub.%s.grub: %s", name, err)
+		}
+		if g.Shim != "" {
+			if l.Shim, err = os.ReadFile(c.path(g.Shim)); err != nil {
+				return nil, fmt.Errorf("grub.%s.shim: %s", name, err)
+			}
+		}
+		if grub == nil {
+			grub = map[constants.Firmware]*server.GrubLoader{}
+		}
+		grub[FirmwareNames[name]] = l
+	}
+	var loaders map[constants.Firmware]string
+	for name, l := range c.Loaders {
+		if loaders == nil {
+			loaders = map[constants.Firmware]string{}
+		}
+		loaders[FirmwareNames[name]] = l
+	}
+	var policy func(types.Machine) string
+	if len(c.MachineLoaders) > 0 {
+		byMAC := map[string]string{}
+		for mac, l := range c.MachineLoaders {
+			hw, _ := net.ParseMAC(mac)
+			byMAC[hw.String()] = l
+		}
+		policy = func(m types.Machine) string { return byMAC[m.MAC.String()] }
+	}
+
+	s := &server.Server{
+		Address:    c.Address,
+		HTTPPort:   c.Ports.HTTP,
+		DHCPPort:   c.Ports.DHCP,
+		TFTPPort:   c.Ports.TFTP,
+		PXEPort:    c.Ports.PXE,
+		DHCPNoBind: c.DHCPNoBind,
+
+		Grub:         grub,
+		Loaders:      loaders,
+		LoaderPolicy: policy,
+
+		VerifyCacheDir: c.path(c.VerifyCacheDir),
+		VerifyLogOnly:  c.VerifyLogOnly,
+
+		FileTokenLifetime: time.Duration(c.FileTokenLifetime),
+		UploadMaxSize:     c.UploadMaxSize,
+
+		ShutdownTimeout: time.Duration(c.ShutdownTimeout),
+	}
+	if c.TLS != nil {
+		cert, err := c.TLS.certificate(c)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %s", err)
+		}
+		s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		s.HTTPSPort = c.Ports.HTTPS
+	}
+	s.SetBooter(booter)
+	s.SetFirmware(ipxe)
+	return s, nil
+}
+
+// certificate loads or issues the server's certificate.
+func (t *TLS) certificate(c *Config) (tls.Certificate, error) {
+	if t.Cert != "" {
+		return tls.LoadX509KeyPair(c.path(t.Cert), c.path(t.Key))
+	}
+	ca, caKey, err := utils.LoadOrCreateCA(c.path(t.CACert), c.path(t.CAKey))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	hosts := t.Hosts
+	if len(hosts) == 0 && c.Address != "" {
+		hosts = []string{c.Address}
+	}
+	if len(hosts) == 0 {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				hosts = append(hosts, ipnet.IP.String())
+			}
+		}
+	}
+	return utils.IssueCertificate(ca, caKey, hosts, 365*24*time.Hour)
+}
+
+// ServerV6 builds the ServerV6 described by c.DHCPv6, or returns nil
+// if DHCPv6 isn't configured. Its Log and Debug fields are left for
+// the caller to fill.
+func (c *Config) ServerV6() (*server.ServerV6, error) {
+	v6 := c.DHCPv6
+	if v6 == nil {
+		return nil, nil
+	}
+
+	var dns []net.IP
+	for _, a := range v6.DNS {
+		dns = append(dns, net.ParseIP(a))
+	}
+	var preference uint8
+	if v6.Preference != nil {
+		preference = *v6.Preference
+	}
+	preferred, valid := v6.PreferredLifetime, v6.ValidLifetime
+	if preferred == 0 {
+		preferred = DefaultPreferredLifetime
+	}
+	if valid == 0 {
+		valid = DefaultValidLifetime
+	}
+
+	s := server.NewServerV6()
+	s.Address = v6.Address
+	if v6.Port != 0 {
+		s.Port = v6.Port
+	}
+	if v6.API != nil {
+		opts, err := v6.API.clientOptions(c)
+		if err != nil {
+			return nil, fmt.Errorf("dhcpv6.api.%s", err)
+		}
+		s.BootConfig = dhcp6.MakeAPIBootConfiguration(v6.API.URL, time.Duration(v6.API.Timeout), preference, v6.Preference != nil, dns, opts...)
+	} else {
+		s.BootConfig = dhcp6.MakeStaticBootConfiguration(v6.HTTPBootURL, v6.IpxeBootURL, preference, v6.Preference != nil, dns)
+	}
+	s.PacketBuilder = dhcp6.MakePacketBuilder(preferred, valid)
+	s.AddressPool = pool.NewRandomAddressPool(net.ParseIP(v6.Pool.Start), v6.Pool.Size, valid)
+	return s, nil
+}
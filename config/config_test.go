@@ -0,0 +1,381 @@
+// Copyright 2024 Kairos contributors
+
+package config
+
+import (
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kairos-io/netboot/constants"
+	"github.com/kairos-io/netboot/server"
+	"github.com/kairos-io/netboot/types"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "custom.efi"), []byte("custom ipxe"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "netboot.yaml")
+	if err := os.WriteFile(path, []byte(`
+address: 192.168.0.1
+ports:
+  http: 8080
+dhcp-no-bind: true
+firmware:
+  efi64: custom.efi
+booter:
+  static:
+    kernel: /srv/vmlinuz
+    initrd: [/srv/initrd]
+    cmdline: console=ttyS0
+dhcpv6:
+  address: "2001:db8::1"
+  ipxe-boot-url: http://[2001:db8::1]/_/ipxe
+  dns: ["2001:db8::53"]
+  pool:
+    start: "2001:db8::1000"
+    size: 10
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Loading config: %s", err)
+	}
+	s, err := cfg.Server()
+	if err != nil {
+		t.Fatalf("Building server: %s", err)
+	}
+	if s.Address != "192.168.0.1" || s.HTTPPort != 8080 || !s.DHCPNoBind {
+		t.Fatalf("Wrong server settings: %#v", s)
+	}
+	if string(s.Ipxe[constants.FirmwareEFI64]) != "custom ipxe" {
+		t.Fatalf("Firmware path wasn't resolved relative to the config file")
+	}
+	if s.Ipxe[constants.FirmwareX86PC] == nil {
+		t.Fatalf("Unconfigured firmwares should get the bundled iPXE")
+	}
+	spec, err := s.Booter.BootSpec(types.Machine{})
+	if err != nil {
+		t.Fatalf("Getting bootspec: %s", err)
+	}
+	want := &types.Spec{Kernel: "kernel", Initrd: []types.ID{"initrd-0"}, Cmdline: "console=ttyS0"}
+	if !reflect.DeepEqual(spec, want) {
+		t.Fatalf("Wrong spec\nwant: %#v\ngot:  %#v", want, spec)
+	}
+
+	v6, err := cfg.ServerV6()
+	if err != nil {
+		t.Fatalf("Building DHCPv6 server: %s", err)
+	}
+	if v6.Address != "2001:db8::1" || v6.Port != constants.PortDHCPv6 || v6.AddressPool == nil || v6.PacketBuilder.ValidLifetime != DefaultValidLifetime {
+		t.Fatalf("Wrong DHCPv6 server settings: %#v", v6)
+	}
+	if url, _ := v6.BootConfig.GetBootURL(nil, 0); string(url) != "http://[2001:db8::1]/_/ipxe" {
+		t.Fatalf("Wrong DHCPv6 boot URL %q", url)
+	}
+}
+
+func TestParseAPIBooter(t *testing.T) {
+	cfg, err := Parse([]byte(`{"booter": {"api": {"url": "https://api.example/", "timeout": "5s"}}}`))
+	if err != nil {
+		t.Fatalf("Parsing JSON config: %s", err)
+	}
+	if time.Duration(cfg.Booter.API.Timeout) != 5*time.Second {
+		t.Fatalf("Wrong timeout %s", time.Duration(cfg.Booter.API.Timeout))
+	}
+	if v6, err := cfg.ServerV6(); v6 != nil || err != nil {
+		t.Fatalf("Got a DHCPv6 server without asking for one")
+	}
+}
+
+func TestRulesFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "rules.yaml"), []byte(`
+- mac: ["01:02:03"]
+  spec: {kernel: /k}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "netboot.yaml")
+	if err := os.WriteFile(path, []byte("booter: {rules-file: rules.yaml}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Loading config: %s", err)
+	}
+	b, err := cfg.NewBooter()
+	if err != nil {
+		t.Fatalf("Building booter: %s", err)
+	}
+	mac, _ := net.ParseMAC("01:02:03:04:05:06")
+	if spec, err := b.BootSpec(types.Machine{MAC: mac}); spec == nil || err != nil {
+		t.Fatalf("Rule from rules-file didn't match: %v", err)
+	}
+}
+
+func TestComposedBooter(t *testing.T) {
+	cfg, err := Parse([]byte(`
+booter:
+  rules:
+  - {arch: [arm64], spec: {kernel: /arm}}
+  fallback:
+    static: {kernel: /x64}
+  overrides:
+    "01:02:03:04:05:06": {kernel: /special}
+  deny: ["02:02:03:04:05:06"]
+  once: once.json
+`))
+	if err != nil {
+		t.Fatalf("Parsing config: %s", err)
+	}
+	cfg.baseDir = t.TempDir()
+	b, err := cfg.NewBooter()
+	if err != nil {
+		t.Fatalf("Building booter: %s", err)
+	}
+	for _, tc := range []struct {
+		mac    string
+		arch   constants.Architecture
+		kernel types.ID
+	}{
+		{"03:02:03:04:05:06", constants.ArchArm64, "base/fallback-0/rule-0/kernel"},
+		{"03:02:03:04:05:06", constants.ArchX64, "base/fallback-1/kernel"},
+		{"01:02:03:04:05:06", constants.ArchX64, "override-0/kernel"},
+		{"02:02:03:04:05:06", constants.ArchX64, ""},
+	} {
+		mac, _ := net.ParseMAC(tc.mac)
+		spec, err := b.BootSpec(types.Machine{MAC: mac, Arch: tc.arch})
+		if err != nil {
+			t.Fatalf("Getting bootspec for %s: %s", tc.mac, err)
+		}
+		var kernel types.ID
+		if spec != nil {
+			kernel = spec.Kernel
+		}
+		if kernel != tc.kernel {
+			t.Fatalf("Wrong kernel for %s/%s: got %q, want %q", tc.mac, tc.arch, kernel, tc.kernel)
+		}
+	}
+
+	mac, _ := net.ParseMAC("01:02:03:04:05:06")
+	if err = b.(types.BootNotifier).Booted(types.Machine{MAC: mac}); err != nil {
+		t.Fatalf("Recording boot: %s", err)
+	}
+	if spec, err := b.BootSpec(types.Machine{MAC: mac}); spec != nil || err != nil {
+		t.Fatalf("Booted machine should not netboot again, got %v, %v", spec, err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.baseDir, "once.json")); err != nil {
+		t.Fatalf("Once state not saved next to the config: %s", err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "netboot.yaml")
+	if err := os.WriteFile(path, []byte(`
+address: 192.168.0.1
+ports: {https: 8443}
+booter: {static: {kernel: /srv/vmlinuz}}
+tls: {ca-cert: ca.pem, ca-key: ca-key.pem}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Loading config: %s", err)
+	}
+	s, err := cfg.Server()
+	if err != nil {
+		t.Fatalf("Building server: %s", err)
+	}
+	if s.TLSConfig == nil || len(s.TLSConfig.Certificates) != 1 || s.HTTPSPort != 8443 {
+		t.Fatalf("Wrong TLS settings: %#v", s)
+	}
+
+	caPEM, err := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatalf("CA certificate not written next to the config: %s", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		t.Fatalf("CA certificate isn't valid PEM")
+	}
+	verify := func(s *server.Server) {
+		t.Helper()
+		leaf, err := x509.ParseCertificate(s.TLSConfig.Certificates[0].Certificate[0])
+		if err != nil {
+			t.Fatalf("Parsing issued certificate: %s", err)
+		}
+		if _, err = leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: "192.168.0.1"}); err != nil {
+			t.Fatalf("Issued certificate doesn't verify against the CA: %s", err)
+		}
+	}
+	verify(s)
+
+	// The CA is reused, not recreated.
+	if s, err = cfg.Server(); err != nil {
+		t.Fatalf("Building server again: %s", err)
+	}
+	verify(s)
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		config   string
+		problems []string
+	}{
+		{
+			config:   `address: 1.2.3`,
+			problems: []string{`address: "1.2.3" is not an IP address`, "booter: no booter configured, set one of static, api, rules, rules-file, dir or iso"},
+		},
+		{
+			config: `
+ports: {tftp: 70000}
+firmware: {efi65: /x.efi}
+grub: {x86-pc: {grub: /grub.efi}, efi64: {shim: /shim.efi}}
+loaders: {efi32: grub, efi64: pxelinux, x86-pc: ipxe}
+machine-loaders: {"01:02:03:04:05:06": grub, nope: ipxe, "01:02:03:04:05:07": uefi}
+booter:
+  static: {cmdline: foo}
+  api: {url: /relative}`,
+			problems: []string{
+				"ports.tftp: 70000 is not a valid port",
+				"firmware.efi65: unknown firmware, must be one of efi-arm64, efi32, efi64, efibc, x86-ipxe, x86-pc",
+				"grub.efi64.grub: missing path",
+				"grub.x86-pc: not an EFI firmware, must be one of efi-arm64, efi32, efi64, efibc",
+				"loaders.efi32: grub requires grub.efi32",
+				`loaders.efi64: unknown loader "pxelinux", must be ipxe or grub`,
+				"loaders.x86-pc: not an EFI firmware, must be one of efi-arm64, efi32, efi64, efibc",
+				`machine-loaders.01:02:03:04:05:07: unknown loader "uefi", must be ipxe or grub`,
+				`machine-loaders.nope: "nope" is not a MAC address`,
+				"booter: only one of static, api, rules, rules-file, dir or iso can be set",
+				"booter.static: one of kernel, efi, uki, menu or ipxe-template must be set",
+				`booter.api.url: "/relative" is not an http or https URL`,
+			},
+		},
+		{
+			config: `
+booter:
+  api:
+    url: https://api
+    bearer-token: t
+    username: u
+    cert: client.pem
+    proxy: "::"
+    version: 3
+    key-rotation: 1h`,
+			problems: []string{
+				"booter.api.version: unsupported API version 3",
+				"booter.api.key-rotation: requires keys-file",
+				"booter.api: only one of bearer-token, bearer-token-file or username/password can be set",
+				"booter.api: cert and key must be set together",
+				`booter.api.proxy: "::" is not a URL`,
+			},
+		},
+		{
+			config: `
+booter:
+  static: {kernel: /k}
+  fallback: {}
+  overrides:
+    "01:02:03:04:05:06": {cmdline: x}
+    nope: {kernel: /k}
+  deny: ["01:02:03:04:05:06", "zz"]`,
+			problems: []string{
+				"booter.fallback: no booter configured, set one of static, api, rules, rules-file, dir or iso",
+				"booter.overrides.01:02:03:04:05:06: one of kernel, efi, uki, menu or ipxe-template must be set",
+				`booter.overrides.nope: "nope" is not a MAC address`,
+				`booter.deny[1]: "zz" is not a MAC address`,
+			},
+		},
+		{
+			config: `
+booter:
+  static-arch:
+    arm64: {kernel: /k}
+    sparc: {kernel: /k}
+    x64: {message: hi}`,
+			problems: []string{
+				`booter.static-arch.sparc: unknown architecture "sparc"`,
+				"booter.static-arch.x64: one of kernel, efi, uki, menu or ipxe-template must be set",
+			},
+		},
+		{
+			config: `
+booter:
+  rules:
+  - {mac: ["01:02:03"], ignore: true}
+  - {arch: [sparc], spec: {kernel: /k}}
+  - {mac: ["zz"], spec: {kernel: /k}, ignore: true}`,
+			problems: []string{
+				`booter.rules[1]: unknown architecture "sparc"`,
+				"booter.rules[2]: only one of spec and ignore can be set",
+			},
+		},
+		{
+			config: `
+booter: {static: {kernel: /k}}
+dhcpv6: {address: 10.0.0.1, pool: {start: "2001:db8::"}}`,
+			problems: []string{
+				`dhcpv6.address: "10.0.0.1" is not an IPv6 address`,
+				"dhcpv6: one of api, http-boot-url or ipxe-boot-url must be set",
+				"dhcpv6.pool.size: must be greater than zero",
+			},
+		},
+		{
+			config: `
+booter: {api: {url: "http://api"}, uploads: uploads}
+upload-max-size: 1000`,
+			problems: []string{
+				"booter.uploads: only supported with static, without static-arch",
+				"upload-max-size: requires file-token-lifetime",
+			},
+		},
+		{
+			config: `
+booter: {static: {kernel: /k}, fallback: {api: {url: "http://api", bind-mac: true}}}`,
+			problems: []string{
+				"booter.fallback.api.bind-mac: requires file-token-lifetime",
+			},
+		},
+		{
+			config: `
+booter: {static: {kernel: /k}}
+ports: {https: -1}
+file-token-lifetime: -1m
+tls: {cert: server.pem, hosts: [example.com]}`,
+			problems: []string{
+				"ports.https: -1 is not a valid port",
+				"file-token-lifetime: must not be negative",
+				"tls: cert and key must be set together",
+				"tls.hosts: only used with ca-cert and ca-key",
+			},
+		},
+	} {
+		_, err := Parse([]byte(tc.config))
+		var verr *ValidationError
+		if !errors.As(err, &verr) {
+			t.Fatalf("Config %q: want a ValidationError, got %v", tc.config, err)
+		}
+		if !reflect.DeepEqual(verr.Problems, tc.problems) {
+			t.Fatalf("Config %q: wrong problems\nwant: %q\ngot:  %q", tc.config, tc.problems, verr.Problems)
+		}
+	}
+
+	if _, err := Parse([]byte("booter: {static: {kernel: /k}}\nbogus: 1")); err == nil {
+		t.Fatalf("Unknown field was accepted")
+	}
+	if _, err := Parse([]byte(`booter: {api: {url: "http://x", timeout: 5}}`)); err == nil {
+		t.Fatalf("Numeric timeout was accepted")
+	}
+}
@@ -1,5 +1,10 @@
 package constants
 
+import (
+	"fmt"
+	"strings"
+)
+
 // Firmware describes a kind of firmware attempting to boot.
 //
 // This should only be used for selecting the right bootloader within
@@ -18,6 +23,28 @@ const (
 	FirmwareEfiArm64                      // 64-bit ARM processor running EFI
 )
 
+// String returns a short name for the firmware.
+func (f Firmware) String() string {
+	switch f {
+	case FirmwareX86PC:
+		return "x86-pc"
+	case FirmwareEFI32:
+		return "efi32"
+	case FirmwareEFI64:
+		return "efi64"
+	case FirmwareEFIBC:
+		return "efibc"
+	case FirmwareX86Ipxe:
+		return "x86-ipxe"
+	case FirmwarePixiecoreIpxe:
+		return "pixiecore-ipxe"
+	case FirmwareEfiArm64:
+		return "efi-arm64"
+	default:
+		return "unknown"
+	}
+}
+
 // Architecture describes a kind of CPU architecture.
 type Architecture int
 
@@ -35,6 +62,17 @@ func (a Architecture) String() string {
 	}
 }
 
+// ParseArchitecture parses the name of an architecture, as returned
+// by String, case insensitively.
+func ParseArchitecture(s string) (Architecture, error) {
+	for _, a := range []Architecture{ArchIA32, ArchX64, ArchArm64} {
+		if strings.EqualFold(s, a.String()) {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown architecture %q", s)
+}
+
 // Architecture types that Pixiecore knows how to boot.
 //
 // These architectures are self-reported by the booting machine. The
@@ -57,5 +95,6 @@ const (
 	PortDHCPv6 = 547
 	PortTFTP   = 69
 	PortHTTP   = 80
+	PortHTTPS  = 443
 	PortPXE    = 4011
 )
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/kairos-io/netboot/constants"
+	"github.com/kairos-io/netboot/utils"
 )
 
 // BootConfiguration implementation provides values for dhcp options served to dhcp clients
@@ -68,14 +69,18 @@ type APIBootConfiguration struct {
 	UsePreference bool
 }
 
-// MakeAPIBootConfiguration creates a new APIBootConfiguration initialized with provided values
+// MakeAPIBootConfiguration creates a new APIBootConfiguration initialized with provided values.
+// opts configure authentication, TLS and proxying of the API calls.
 func MakeAPIBootConfiguration(url string, timeout time.Duration, preference uint8, usePreference bool,
-	dnsServerAddresses []net.IP) *APIBootConfiguration {
+	dnsServerAddresses []net.IP, opts ...utils.HTTPClientOption) *APIBootConfiguration {
 	if !strings.HasSuffix(url, "/") {
 		url += "/"
 	}
+	// The client only ever talks to the API, so it can send headers
+	// to any host, and can't fail to build.
+	client, _ := utils.NewHTTPClient("", timeout, opts...)
 	ret := &APIBootConfiguration{
-		Client:        &http.Client{Timeout: timeout},
+		Client:        client,
 		URLPrefix:     url + "v1",
 		UsePreference: usePreference,
 	}
@@ -3,12 +3,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/kairos-io/netboot/booters"
 	"github.com/kairos-io/netboot/log"
 	"github.com/kairos-io/netboot/server"
 	"github.com/kairos-io/netboot/types"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 // This runs a quick server that serves iPXE and Debian netboot files.
@@ -50,8 +53,14 @@ func main() {
 	ret.SetDefaultFirmwares()
 	b, _ := booters.StaticBooter(booterSpec)
 	ret.Booter = b
-	err := ret.Serve()
-	if err != nil {
+
+	// On Ctrl-C, give machines that are downloading their kernel a
+	// chance to finish before exiting.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := ret.Serve(ctx)
+	if err != nil && err != context.Canceled {
 		fmt.Println(err)
 	}
 }
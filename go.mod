@@ -10,6 +10,7 @@ require (
 	github.com/rs/zerolog v1.34.0
 	golang.org/x/crypto v0.39.0
 	golang.org/x/net v0.41.0
+	sigs.k8s.io/yaml v1.4.0
 )
 
 require (
@@ -48,43 +48,68 @@ func (s *Server) serveDHCP(conn *dhcp4.Conn) error {
 		}
 
 		s.debug("DHCP", "Got valid request to boot %s (%s)", mach.MAC, mach.Arch)
+		mach.Interface = intf.Name
 
-		spec, err := s.Booter.BootSpec(mach)
-		if err != nil {
-			s.log("DHCP", "Couldn't get bootspec for %s: %s", pkt.HardwareAddr, err)
-			continue
-		}
-		if spec == nil {
-			s.debug("DHCP", "No boot spec for %s, ignoring boot request", pkt.HardwareAddr)
-			s.machineEvent(pkt.HardwareAddr, machineStateIgnored, "Machine should not netboot")
-			continue
+		sess := s.startSession(mach, pkt.TransactionID)
+		span := sess.span("dhcp.offer")
+		span.SetAttribute("dhcp.xid", fmt.Sprintf("%x", pkt.TransactionID))
+		span.SetAttribute("interface", intf.Name)
+		if err = s.bootDHCP(conn, pkt, intf, mach, fwtype); err != nil {
+			span.SetError(err)
 		}
+		span.Finish()
+	}
+}
 
-		s.log("DHCP", "Offering to boot %s", pkt.HardwareAddr)
-		if fwtype == constants.FirmwarePixiecoreIpxe {
-			s.machineEvent(pkt.HardwareAddr, machineStateProxyDHCPIpxe, "Offering to boot iPXE")
-		} else {
-			s.machineEvent(pkt.HardwareAddr, machineStateProxyDHCP, "Offering to boot")
-		}
+// bootDHCP sends a ProxyDHCP offer to boot mach, if its Booter wants
+// it booted.
+func (s *Server) bootDHCP(conn *dhcp4.Conn, pkt *dhcp4.Packet, intf *net.Interface, mach types.Machine, fwtype constants.Firmware) error {
+	spec, err := s.booter().BootSpec(mach)
+	if err != nil {
+		s.log("DHCP", "Couldn't get bootspec for %s: %s", pkt.HardwareAddr, err)
+		return err
+	}
+	if spec == nil {
+		s.debug("DHCP", "No boot spec for %s, ignoring boot request", pkt.HardwareAddr)
+		s.machineEvent(pkt.HardwareAddr, machineStateIgnored, "Machine should not netboot")
+		s.endSession(pkt.HardwareAddr)
+		return nil
+	}
 
-		// Machine should be booted.
-		serverIP, err := interfaceIP(intf)
-		if err != nil {
-			s.log("DHCP", "Want to boot %s on %s, but couldn't get a source address: %s", pkt.HardwareAddr, intf.Name, err)
-			continue
-		}
+	loader, err := s.chooseLoader(mach, fwtype, spec)
+	if err != nil {
+		s.log("DHCP", "Can't boot %s: %s", pkt.HardwareAddr, err)
+		s.machineEvent(pkt.HardwareAddr, machineStateFailed, "Can't boot: %s", err)
+		s.endSession(pkt.HardwareAddr)
+		return err
+	}
+	s.setSessionLoader(pkt.HardwareAddr, loader)
 
-		resp, err := s.offerDHCP(pkt, mach, serverIP, fwtype)
-		if err != nil {
-			s.log("DHCP", "Failed to construct ProxyDHCP offer for %s: %s", pkt.HardwareAddr, err)
-			continue
-		}
+	s.log("DHCP", "Offering to boot %s", pkt.HardwareAddr)
+	if fwtype == constants.FirmwarePixiecoreIpxe {
+		s.machineEvent(pkt.HardwareAddr, machineStateProxyDHCPIpxe, "Offering to boot iPXE")
+	} else {
+		s.machineEvent(pkt.HardwareAddr, machineStateProxyDHCP, "Offering to boot")
+	}
 
-		if err = conn.SendDHCP(resp, intf); err != nil {
-			s.log("DHCP", "Failed to send ProxyDHCP offer for %s: %s", pkt.HardwareAddr, err)
-			continue
-		}
+	// Machine should be booted.
+	serverIP, err := interfaceIP(intf)
+	if err != nil {
+		s.log("DHCP", "Want to boot %s on %s, but couldn't get a source address: %s", pkt.HardwareAddr, intf.Name, err)
+		return err
+	}
+
+	resp, err := s.offerDHCP(pkt, mach, serverIP, fwtype)
+	if err != nil {
+		s.log("DHCP", "Failed to construct ProxyDHCP offer for %s: %s", pkt.HardwareAddr, err)
+		return err
+	}
+
+	if err = conn.SendDHCP(resp, intf); err != nil {
+		s.log("DHCP", "Failed to send ProxyDHCP offer for %s: %s", pkt.HardwareAddr, err)
+		return err
 	}
+	return nil
 }
 
 func (s *Server) isBootDHCP(pkt *dhcp4.Packet) error {
@@ -192,11 +217,22 @@ func (s *Server) validateDHCP(pkt *dhcp4.Packet) (mach types.Machine, fwtype con
 		if guid[0] != 0 {
 			return mach, 0, errors.New("malformed client GUID (option 97), leading byte must be zero")
 		}
+		mach.GUID = guid[1:]
 	default:
 		return mach, 0, errors.New("malformed client GUID (option 97), wrong size")
 	}
+	if vendor, err := pkt.Options.String(dhcp4.OptVendorIdentifier); err == nil {
+		mach.VendorClass = vendor
+	}
+	if hostname, err := pkt.Options.String(dhcp4.OptHostname); err == nil {
+		mach.Hostname = hostname
+	}
 
 	mach.MAC = pkt.HardwareAddr
+	mach.Firmware = fwtype
+	if pkt.RelayAddr != nil && !pkt.RelayAddr.IsUnspecified() {
+		mach.RelayAddr = pkt.RelayAddr
+	}
 	return mach, fwtype, nil
 }
 
@@ -234,7 +270,7 @@ func (s *Server) offerDHCP(pkt *dhcp4.Packet, mach types.Machine, serverIP net.I
 		}
 		resp.Options[dhcp4.OptVendorSpecific] = bs
 		resp.BootServerName = serverIP.String()
-		resp.BootFilename = fmt.Sprintf("%s/%d", mach.MAC, fwtype)
+		resp.BootFilename = s.tftpPath(mach.MAC, fwtype)
 
 	case constants.FirmwareX86Ipxe:
 		// Almost standard PXE, but the boot filename needs to be a URL.
@@ -247,7 +283,7 @@ func (s *Server) offerDHCP(pkt *dhcp4.Packet, mach types.Machine, serverIP net.I
 			return nil, fmt.Errorf("failed to serialize PXE vendor options: %s", err)
 		}
 		resp.Options[dhcp4.OptVendorSpecific] = bs
-		resp.BootFilename = fmt.Sprintf("tftp://%s/%s/%d", serverIP, mach.MAC, fwtype)
+		resp.BootFilename = fmt.Sprintf("tftp://%s/%s", serverIP, s.tftpPath(mach.MAC, fwtype))
 
 	case constants.FirmwareEFI32, constants.FirmwareEFI64, constants.FirmwareEFIBC, constants.FirmwareEfiArm64:
 		// In theory, the response we send for FirmwareX86PC should
@@ -268,13 +304,16 @@ func (s *Server) offerDHCP(pkt *dhcp4.Packet, mach types.Machine, serverIP net.I
 		// and expect to be called again on port 4011 (which is in
 		// pxe.go).
 		resp.BootServerName = serverIP.String()
-		resp.BootFilename = fmt.Sprintf("%s/%d", mach.MAC, fwtype)
+		resp.BootFilename = s.tftpPath(mach.MAC, fwtype)
 
 	case constants.FirmwarePixiecoreIpxe:
 		// We've already gone through one round of chainloading, now
 		// we can finally chainload to HTTP for the actual boot
 		// script.
-		resp.BootFilename = fmt.Sprintf("http://%s:%d/_/ipxe?arch=%d&mac=%s", serverIP, s.HTTPPort, mach.Arch, mach.MAC)
+		resp.BootFilename = fmt.Sprintf("%s/_/ipxe?arch=%d&mac=%s", s.bootURL(serverIP), mach.Arch, mach.MAC)
+		if id := s.sessionParam(s.session(mach.MAC, "")); id != "" {
+			resp.BootFilename += "&session=" + id
+		}
 	default:
 		return nil, fmt.Errorf("unknown firmware type %d", fwtype)
 	}
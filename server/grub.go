@@ -0,0 +1,310 @@
+// Copyright 2024 Kairos contributors
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/kairos-io/netboot/constants"
+	"github.com/kairos-io/netboot/types"
+	"github.com/kairos-io/netboot/utils"
+)
+
+// A GrubLoader boots EFI machines with GRUB instead of iPXE, for
+// machines with Secure Boot enabled, which won't run unsigned iPXE
+// binaries.
+//
+// The machine first gets Shim (or Grub directly, if Shim is nil) over
+// TFTP. Shim then loads Grub from the same TFTP directory, and Grub
+// loads a grub.cfg from there too. The server generates that
+// grub.cfg, which hands over to a config generated over HTTP from the
+// machine's Spec, with linux and initrd commands that fetch the boot
+// files from the server.
+//
+// Grub must be built with the http, efinet and tftp modules, and look
+// for grub.cfg either in the directory it was loaded from or in any
+// directory of the TFTP server. Signed GRUB builds such as Ubuntu's
+// grubnetx64.efi.signed do.
+type GrubLoader struct {
+	// Shim is a signed shim EFI binary, or nil to boot Grub directly.
+	Shim []byte
+	// Grub is the GRUB EFI binary. If Shim is set, Grub must be
+	// signed with a key that Shim trusts.
+	Grub []byte
+}
+
+// grubLoader returns the GrubLoader that boots fwtype, or nil if
+// fwtype boots iPXE.
+func (s *Server) grubLoader(fwtype constants.Firmware) *GrubLoader {
+	if l := s.Grub[fwtype]; l != nil && l.Grub != nil {
+		return l
+	}
+	return nil
+}
+
+// grubArch returns the architecture of machines running the EFI
+// firmware fwtype.
+func grubArch(fwtype constants.Firmware) (constants.Architecture, bool) {
+	switch fwtype {
+	case constants.FirmwareEFI32:
+		return constants.ArchIA32, true
+	case constants.FirmwareEFI64, constants.FirmwareEFIBC:
+		return constants.ArchX64, true
+	case constants.FirmwareEfiArm64:
+		return constants.ArchArm64, true
+	}
+	return 0, false
+}
+
+// grubTFTPPath returns the TFTP filename from which the machine mac
+// gets the first stage of the GrubLoader for fwtype. Shim loads Grub
+// and Grub loads grub.cfg from the same directory.
+func grubTFTPPath(mac net.HardwareAddr, fwtype constants.Firmware, session string) string {
+	if session != "" {
+		return fmt.Sprintf("grub/%s/%d/%s/boot.efi", mac, fwtype, session)
+	}
+	return fmt.Sprintf("grub/%s/%d/boot.efi", mac, fwtype)
+}
+
+// extractGrubInfo parses a path in the directory of a path built by
+// grubTFTPPath, returning the machine's MAC address, firmware, session
+// and the name of the file in the directory.
+func extractGrubInfo(p string) (net.HardwareAddr, constants.Firmware, string, string, error) {
+	elems := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	if (len(elems) != 4 && len(elems) != 5) || elems[0] != "grub" {
+		return nil, 0, "", "", errors.New("not found")
+	}
+	mac, err := net.ParseMAC(elems[1])
+	if err != nil {
+		return nil, 0, "", "", fmt.Errorf("invalid MAC address %q", elems[1])
+	}
+	i, err := strconv.Atoi(elems[2])
+	if err != nil {
+		return nil, 0, "", "", errors.New("not found")
+	}
+	var session string
+	if len(elems) == 5 {
+		session = elems[3]
+	}
+	return mac, constants.Firmware(i), session, elems[len(elems)-1], nil
+}
+
+// isGrubConfig reports whether p is a TFTP path that GRUB looks for
+// its configuration at, e.g. grub/grub.cfg or
+// grub.cfg-01-01-02-03-04-05-06.
+func isGrubConfig(p string) bool {
+	return strings.HasPrefix(path.Base(p), "grub.cfg")
+}
+
+// handleGrubTFTP serves the files of a GrubLoader over TFTP.
+func (s *Server) handleGrubTFTP(p string, clientAddr net.Addr) (io.ReadCloser, int64, error) {
+	mac, fwtype, session, name, err := extractGrubInfo(p)
+	if err != nil {
+		if !isGrubConfig(p) {
+			return nil, 0, fmt.Errorf("unknown path %q", p)
+		}
+		// A GRUB looking for its config somewhere else than where
+		// it was loaded from, it can tell us the rest.
+		cfg := s.grubBootstrap("${net_default_mac}", "${netboot_arch}", "")
+		return ioutil.NopCloser(bytes.NewReader(cfg)), int64(len(cfg)), nil
+	}
+
+	span := s.session(mac, session).span("tftp.transfer")
+	span.SetAttribute("tftp.path", p)
+	span.SetAttribute("client.address", clientAddr.String())
+
+	var bs []byte
+	l := s.grubLoader(fwtype)
+	arch, ok := grubArch(fwtype)
+	switch {
+	case l == nil || !ok:
+		err = fmt.Errorf("no GRUB for firmware type %d", fwtype)
+	case name == "boot.efi" && l.Shim != nil:
+		bs = l.Shim
+	case name == "boot.efi" || (strings.HasPrefix(name, "grub") && strings.HasSuffix(name, ".efi")):
+		bs = l.Grub
+	case isGrubConfig(name):
+		bs = s.grubBootstrap(mac.String(), strconv.Itoa(int(arch)), session)
+	default:
+		err = fmt.Errorf("unknown path %q", p)
+	}
+	if err != nil {
+		span.SetError(err)
+		span.Finish()
+		return nil, 0, err
+	}
+	return &tracedReader{ReadCloser: ioutil.NopCloser(bytes.NewReader(bs)), span: span, size: int64(len(bs))}, int64(len(bs)), nil
+}
+
+// grubBootstrap returns the grub.cfg served over TFTP, which loads the
+// machine's real config from /_/grub. mac and arch are the values of
+// its parameters, or GRUB variables that expand to them.
+func (s *Server) grubBootstrap(mac, arch, session string) []byte {
+	var b bytes.Buffer
+	b.WriteString("set netboot_arch=1\n")
+	b.WriteString(`if [ "${grub_cpu}" = "i386" ]; then set netboot_arch=0; fi` + "\n")
+	b.WriteString(`if [ "${grub_cpu}" = "arm64" ]; then set netboot_arch=2; fi` + "\n")
+	u := fmt.Sprintf("/_/grub?mac=%s&arch=%s", mac, arch)
+	if session != "" {
+		u += "&session=" + url.QueryEscape(session)
+	}
+	fmt.Fprintf(&b, "configfile %s\n", grubQuote(s.grubDevice("${net_default_server}")+u, true))
+	return b.Bytes()
+}
+
+// grubDevice returns the GRUB device that reaches the server's HTTP
+// port at host. GRUB doesn't speak HTTPS, so it's always plain HTTP.
+func (s *Server) grubDevice(host string) string {
+	if s.HTTPPort == 0 || s.HTTPPort == 80 {
+		return fmt.Sprintf("(http,%s)", host)
+	}
+	return fmt.Sprintf("(http,%s)", net.JoinHostPort(host, strconv.Itoa(s.HTTPPort)))
+}
+
+func (s *Server) handleGrub(w http.ResponseWriter, r *http.Request) {
+	mach, spec, params, span, ok := s.bootRequest(w, r, "http.grub")
+	defer span.Finish()
+	if !ok {
+		return
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = strings.Trim(r.Host, "[]")
+	}
+	cfg, err := grubConfig(mach, spec, s.grubDevice(host), s.baseURL(r), params)
+	if err != nil {
+		s.log("HTTP", "Failed to assemble grub config for %s (query %q from %s): %s", mach.MAC, r.URL, r.RemoteAddr, err)
+		span.SetError(err)
+		http.Error(w, "couldn't get a boot script", http.StatusInternalServerError)
+		return
+	}
+	s.log("HTTP", "Sending grub config to %s", r.RemoteAddr)
+	s.machineEvent(mach.MAC, machineStateIpxeScript, "Sent GRUB config")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(cfg)
+}
+
+// grubConfig generates a grub.cfg that boots spec. device is the GRUB
+// device that GRUB fetches the boot files from, baseURL is the scheme
+// and host of the server for URLs in the cmdline, and params are added
+// to every URL pointing back at the server.
+//
+// Specs with a Menu get a GRUB menu. GRUB can't run iPXE scripts, so
+// Specs with an IpxeScript or IpxeTemplate can't be booted.
+func grubConfig(mach types.Machine, spec *types.Spec, device, baseURL string, params url.Values) ([]byte, error) {
+	if spec.IpxeScript != "" || spec.IpxeTemplate != "" {
+		return nil, errors.New("spec has an iPXE script, which GRUB can't run")
+	}
+	var b bytes.Buffer
+	if spec.Menu == nil {
+		b.WriteString("set timeout=0\n")
+	} else {
+		def := 0
+		for i, entry := range spec.Menu.Entries {
+			if entry.Name == spec.Menu.Default {
+				def = i
+			}
+		}
+		timeout := spec.Menu.Timeout
+		if timeout == 0 {
+			timeout = -1
+		}
+		fmt.Fprintf(&b, "set default=%d\n", def)
+		fmt.Fprintf(&b, "set timeout=%d\n", timeout)
+	}
+	if spec.Message != "" {
+		for _, line := range strings.Split(spec.Message, "\n") {
+			fmt.Fprintf(&b, "echo %s\n", grubQuote(line, false))
+		}
+	}
+	if spec.Menu == nil {
+		if err := grubBoot(&b, mach, spec, device, baseURL, params); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+	if len(spec.Menu.Entries) == 0 {
+		return nil, errors.New("menu has no entries")
+	}
+	for _, entry := range spec.Menu.Entries {
+		fmt.Fprintf(&b, "menuentry %s {\n", grubQuote(entry.Name, false))
+		if err := grubBoot(&b, mach, &entry.Spec, device, baseURL, params); err != nil {
+			return nil, fmt.Errorf("menu entry %q: %s", entry.Name, err)
+		}
+		b.WriteString("}\n")
+	}
+	return b.Bytes(), nil
+}
+
+// grubBoot writes the GRUB commands that boot the kernel or EFI image
+// of spec to b, with arguments as for grubConfig.
+func grubBoot(b *bytes.Buffer, mach types.Machine, spec *types.Spec, device, baseURL string, params url.Values) error {
+	fileURL := func(id types.ID, typ string) string {
+		return fmt.Sprintf("%s/_/file?name=%s&type=%s&mac=%s%s", device, url.QueryEscape(string(id)), typ, url.QueryEscape(mach.MAC.String()), extraParams(params))
+	}
+	if spec.Efi == "" && spec.Kernel == "" {
+		return errors.New("spec is missing Kernel")
+	}
+	// Tells the server that the machine is about to boot, like the
+	// iPXE script's imgfetch of the same URL. The reply is a comment,
+	// and GRUB carries on to boot if fetching it fails.
+	booting := fmt.Sprintf("source %s\nboot\n", grubQuote(fmt.Sprintf("%s/_/booting?mac=%s%s", device, url.QueryEscape(mach.MAC.String()), extraParams(params)), false))
+
+	f := func(id string) string {
+		return fmt.Sprintf("%s/_/file?name=%s%s", baseURL, url.QueryEscape(id), extraParams(params))
+	}
+	upload := func(id string) string {
+		return fmt.Sprintf("%s/_/upload?name=%s%s", baseURL, url.QueryEscape(id), extraParams(params))
+	}
+	cmdline, err := utils.ExpandCmdline(spec.Cmdline, template.FuncMap{"ID": f, "Upload": upload}, cmdlineVars(mach, baseURL))
+	if err != nil {
+		return fmt.Errorf("expanding cmdline %q: %s", spec.Cmdline, err)
+	}
+	if spec.Efi != "" {
+		// The EFI binary gets the arguments as load options, but
+		// GRUB has no way to hand it extra files.
+		if len(spec.Initrd) > 0 {
+			return errors.New("GRUB can't pass extra files to an EFI binary")
+		}
+		fmt.Fprintf(b, "chainloader %s", grubQuote(fileURL(spec.Efi, "efi"), false))
+		for _, arg := range strings.Fields(cmdline) {
+			fmt.Fprintf(b, " %s", grubQuote(arg, false))
+		}
+		b.WriteString("\n" + booting)
+		return nil
+	}
+	fmt.Fprintf(b, "linux %s", grubQuote(fileURL(spec.Kernel, "kernel"), false))
+	for _, arg := range strings.Fields(cmdline) {
+		fmt.Fprintf(b, " %s", grubQuote(arg, false))
+	}
+	b.WriteByte('\n')
+	if len(spec.Initrd) > 0 {
+		b.WriteString("initrd")
+		for _, initrd := range spec.Initrd {
+			fmt.Fprintf(b, " %s", grubQuote(fileURL(initrd, "initrd"), false))
+		}
+		b.WriteByte('\n')
+	}
+	b.WriteString(booting)
+	return nil
+}
+
+// grubQuote quotes s as a single word of a GRUB script. If vars is
+// set, GRUB variables in s are expanded.
+func grubQuote(s string, vars bool) string {
+	if vars {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,272 @@
+// Copyright 2024 Kairos contributors
+
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/kairos-io/netboot/booters"
+	"github.com/kairos-io/netboot/constants"
+	"github.com/kairos-io/netboot/types"
+)
+
+func TestGrubTFTP(t *testing.T) {
+	s := &Server{
+		HTTPPort: 8080,
+		Ipxe:     map[constants.Firmware][]byte{constants.FirmwareEFI64: []byte("ipxe")},
+		Grub: map[constants.Firmware]*GrubLoader{
+			constants.FirmwareEFI64: {Shim: []byte("shim"), Grub: []byte("grub")},
+		},
+		Log:   func(subsystem, msg string) {},
+		Debug: func(subsystem, msg string) {},
+	}
+	mac, _ := net.ParseMAC("01:02:03:04:05:06")
+	if p := s.tftpPath(mac, constants.FirmwareEfiArm64); p != "01:02:03:04:05:06/6" {
+		t.Fatalf("Wrong TFTP path for iPXE firmware: %q", p)
+	}
+	p := s.tftpPath(mac, constants.FirmwareEFI64)
+	if p != "grub/01:02:03:04:05:06/2/boot.efi" {
+		t.Fatalf("Wrong TFTP path for GRUB firmware: %q", p)
+	}
+
+	addr := &net.UDPAddr{IP: net.IPv4(192, 168, 0, 10), Port: 1234}
+	get := func(p string) string {
+		t.Helper()
+		f, sz, err := s.handleTFTP(p, addr)
+		if err != nil {
+			t.Fatalf("Getting %q over TFTP: %s", p, err)
+		}
+		defer f.Close()
+		bs, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("Reading %q: %s", p, err)
+		}
+		if int64(len(bs)) != sz {
+			t.Fatalf("Wrong size for %q, got %d bytes, want %d", p, len(bs), sz)
+		}
+		return string(bs)
+	}
+	if got := get(p); got != "shim" {
+		t.Fatalf("Wrong first stage %q, want shim", got)
+	}
+	if got := get("grub/01:02:03:04:05:06/2/grubx64.efi"); got != "grub" {
+		t.Fatalf("Wrong second stage %q, want grub", got)
+	}
+	cfg := get("grub/01:02:03:04:05:06/2/grub.cfg")
+	if want := `configfile "(http,${net_default_server}:8080)/_/grub?mac=01:02:03:04:05:06&arch=1"`; !strings.Contains(cfg, want) {
+		t.Fatalf("Bootstrap grub.cfg doesn't load the machine's config:\n%s", cfg)
+	}
+	cfg = get("/grub/grub.cfg")
+	if want := `configfile "(http,${net_default_server}:8080)/_/grub?mac=${net_default_mac}&arch=${netboot_arch}"`; !strings.Contains(cfg, want) {
+		t.Fatalf("Fallback grub.cfg doesn't load the machine's config:\n%s", cfg)
+	}
+	if _, _, err := s.handleTFTP("grub/01:02:03:04:05:06/6/boot.efi", addr); err == nil {
+		t.Fatalf("Got GRUB for a firmware without GrubLoader")
+	}
+	if got := get("01:02:03:04:05:06/2"); got != "ipxe" {
+		t.Fatalf("Wrong iPXE binary %q", got)
+	}
+}
+
+func TestGrubConfig(t *testing.T) {
+	spec := &types.Spec{
+		Kernel:  "k",
+		Initrd:  []types.ID{"i1", "i2"},
+		Cmdline: `thing={{ ID "f" }} it's`,
+		Message: "Hello",
+	}
+	s := &Server{
+		HTTPPort: 8080,
+		Booter:   booterFunc(func(types.Machine) (*types.Spec, error) { return spec, nil }),
+		Log:      func(subsystem, msg string) {},
+		Debug:    func(subsystem, msg string) {},
+		events:   make(map[string][]machineEvent),
+	}
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/_/grub?mac=01:02:03:04:05:06&arch=1", nil)
+	if err != nil {
+		t.Fatalf("Constructing grub request: %s", err)
+	}
+	req.Host = "192.168.0.1:8080"
+	s.handleGrub(rr, req)
+	if rr.Code != 200 {
+		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
+	}
+	expected := `set timeout=0
+echo 'Hello'
+linux '(http,192.168.0.1:8080)/_/file?name=k&type=kernel&mac=01%3A02%3A03%3A04%3A05%3A06' 'thing=http://192.168.0.1:8080/_/file?name=f' 'it'\''s'
+initrd '(http,192.168.0.1:8080)/_/file?name=i1&type=initrd&mac=01%3A02%3A03%3A04%3A05%3A06' '(http,192.168.0.1:8080)/_/file?name=i2&type=initrd&mac=01%3A02%3A03%3A04%3A05%3A06'
+source '(http,192.168.0.1:8080)/_/booting?mac=01%3A02%3A03%3A04%3A05%3A06'
+boot
+`
+	if rr.Body.String() != expected {
+		t.Fatalf("Wrong grub config\nwant: %s\ngot:  %s", expected, rr.Body.String())
+	}
+
+	spec = &types.Spec{Efi: "e"}
+	rr = httptest.NewRecorder()
+	s.handleGrub(rr, req)
+	expected = `set timeout=0
+chainloader '(http,192.168.0.1:8080)/_/file?name=e&type=efi&mac=01%3A02%3A03%3A04%3A05%3A06'
+source '(http,192.168.0.1:8080)/_/booting?mac=01%3A02%3A03%3A04%3A05%3A06'
+boot
+`
+	if rr.Body.String() != expected {
+		t.Fatalf("Wrong grub config\nwant: %s\ngot:  %s", expected, rr.Body.String())
+	}
+
+	spec = &types.Spec{Menu: &types.Menu{
+		Entries: []types.MenuEntry{
+			{Name: "Install", Spec: types.Spec{Kernel: "k"}},
+			{Name: "Rescue", Spec: types.Spec{Efi: "e"}},
+		},
+		Default: "Rescue",
+	}}
+	rr = httptest.NewRecorder()
+	s.handleGrub(rr, req)
+	expected = `set default=1
+set timeout=-1
+menuentry 'Install' {
+linux '(http,192.168.0.1:8080)/_/file?name=k&type=kernel&mac=01%3A02%3A03%3A04%3A05%3A06'
+source '(http,192.168.0.1:8080)/_/booting?mac=01%3A02%3A03%3A04%3A05%3A06'
+boot
+}
+menuentry 'Rescue' {
+chainloader '(http,192.168.0.1:8080)/_/file?name=e&type=efi&mac=01%3A02%3A03%3A04%3A05%3A06'
+source '(http,192.168.0.1:8080)/_/booting?mac=01%3A02%3A03%3A04%3A05%3A06'
+boot
+}
+`
+	if rr.Body.String() != expected {
+		t.Fatalf("Wrong grub config\nwant: %s\ngot:  %s", expected, rr.Body.String())
+	}
+
+	spec = &types.Spec{IpxeScript: "#!ipxe"}
+	rr = httptest.NewRecorder()
+	s.handleGrub(rr, req)
+	if rr.Code != 500 {
+		t.Fatalf("Got HTTP %d for a spec with an iPXE script, expected 500", rr.Code)
+	}
+}
+
+func TestGrubOnce(t *testing.T) {
+	once, err := booters.OnceBooter(booterFunc(func(types.Machine) (*types.Spec, error) {
+		return &types.Spec{Kernel: "k"}, nil
+	}), filepath.Join(t.TempDir(), "once.json"))
+	if err != nil {
+		t.Fatalf("Creating OnceBooter: %s", err)
+	}
+	s := &Server{
+		Booter: once,
+		Log:    func(subsystem, msg string) {},
+		Debug:  func(subsystem, msg string) {},
+		events: make(map[string][]machineEvent),
+	}
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/_/grub?mac=01:02:03:04:05:06&arch=1", nil)
+	if err != nil {
+		t.Fatalf("Constructing grub request: %s", err)
+	}
+	req.Host = "192.168.0.1"
+	s.handleGrub(rr, req)
+	if rr.Code != 200 {
+		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
+	}
+
+	// Do what GRUB does with the source command of the config.
+	m := regexp.MustCompile(`(?m)^source '\(http,192\.168\.0\.1\)(/_/booting\?[^']*)'$`).FindStringSubmatch(rr.Body.String())
+	if m == nil {
+		t.Fatalf("grub config doesn't report booting:\n%s", rr.Body.String())
+	}
+	req, err = http.NewRequest("GET", m[1], nil)
+	if err != nil {
+		t.Fatalf("Constructing booting request: %s", err)
+	}
+	s.handleBooting(httptest.NewRecorder(), req)
+
+	mac, _ := net.ParseMAC("01:02:03:04:05:06")
+	spec, err := once.BootSpec(types.Machine{MAC: mac, Arch: constants.ArchX64})
+	if err != nil {
+		t.Fatalf("Getting bootspec after booting: %s", err)
+	}
+	if spec != nil {
+		t.Fatalf("Machine booted through GRUB still netboots: %#v", spec)
+	}
+}
+
+func TestChooseLoader(t *testing.T) {
+	mac, _ := net.ParseMAC("01:02:03:04:05:06")
+	s := &Server{
+		Ipxe: map[constants.Firmware][]byte{
+			constants.FirmwareX86PC:    []byte("ipxe"),
+			constants.FirmwareEFI64:    []byte("ipxe"),
+			constants.FirmwareEfiArm64: []byte("ipxe"),
+		},
+		Grub: map[constants.Firmware]*GrubLoader{
+			constants.FirmwareEFI64:    {Grub: []byte("grub")},
+			constants.FirmwareEfiArm64: {Grub: []byte("grub")},
+		},
+		Loaders: map[constants.Firmware]string{constants.FirmwareEfiArm64: types.LoaderIpxe},
+		LoaderPolicy: func(m types.Machine) string {
+			if m.MAC.String() == "01:02:03:04:05:06" {
+				return types.LoaderIpxe
+			}
+			return ""
+		},
+	}
+	other, _ := net.ParseMAC("01:02:03:04:05:07")
+	for _, tc := range []struct {
+		mac    net.HardwareAddr
+		fw     constants.Firmware
+		loader string
+		want   string
+	}{
+		{other, constants.FirmwareX86PC, types.LoaderGrub, types.LoaderIpxe},
+		{other, constants.FirmwareEFI64, "", types.LoaderGrub},
+		{other, constants.FirmwareEfiArm64, "", types.LoaderIpxe},
+		{other, constants.FirmwareEfiArm64, types.LoaderGrub, types.LoaderGrub},
+		{mac, constants.FirmwareEFI64, "", types.LoaderIpxe},
+		{mac, constants.FirmwareEFI64, types.LoaderGrub, types.LoaderGrub},
+		{other, constants.FirmwareEFI32, types.LoaderGrub, ""},
+		{other, constants.FirmwareEFI32, "", ""},
+		{other, constants.FirmwareEFI64, "pxelinux", ""},
+	} {
+		got, err := s.chooseLoader(types.Machine{MAC: tc.mac}, tc.fw, &types.Spec{Loader: tc.loader})
+		if tc.want == "" {
+			if err == nil {
+				t.Fatalf("%s with loader %q: got %q, want an error", tc.fw, tc.loader, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Fatalf("%s/%s with loader %q: got %q, %v, want %q", tc.mac, tc.fw, tc.loader, got, err, tc.want)
+		}
+	}
+
+	// UKIs are EFI binaries, BIOS machines can't boot them.
+	uki := &types.Spec{UKI: []types.ID{"uki"}}
+	if _, err := s.chooseLoader(types.Machine{MAC: other}, constants.FirmwareX86PC, uki); err == nil {
+		t.Fatalf("UKI spec was offered to a BIOS machine")
+	}
+	if got, err := s.chooseLoader(types.Machine{MAC: other}, constants.FirmwareEFI64, uki); err != nil || got != types.LoaderGrub {
+		t.Fatalf("Wrong loader for a UKI spec on EFI: %q, %v", got, err)
+	}
+
+	// The chosen boot chain sticks for the rest of the boot.
+	s.startSession(types.Machine{MAC: mac}, []byte{1, 2, 3, 4})
+	s.setSessionLoader(mac, types.LoaderIpxe)
+	if p := s.tftpPath(mac, constants.FirmwareEFI64); p != "01:02:03:04:05:06/2" {
+		t.Fatalf("Wrong TFTP path for a machine booting iPXE: %q", p)
+	}
+	s.setSessionLoader(mac, types.LoaderGrub)
+	if p := s.tftpPath(mac, constants.FirmwareEFI64); p != "grub/01:02:03:04:05:06/2/boot.efi" {
+		t.Fatalf("Wrong TFTP path for a machine booting GRUB: %q", p)
+	}
+}
@@ -23,21 +23,26 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 	"text/template"
 	"time"
 
 	"github.com/kairos-io/netboot/constants"
+	"github.com/kairos-io/netboot/tracing"
 	"github.com/kairos-io/netboot/types"
 	"github.com/kairos-io/netboot/utils"
 )
 
-func serveHTTP(l net.Listener, handlers ...func(*http.ServeMux)) error {
+func (s *Server) httpServer() *http.Server {
 	mux := http.NewServeMux()
-	for _, h := range handlers {
-		h(mux)
-	}
-	if err := http.Serve(l, mux); err != nil {
+	s.serveHTTP(mux)
+	return &http.Server{Handler: mux}
+}
+
+func serveHTTP(srv *http.Server, l net.Listener) error {
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("HTTP server shut down: %s", err)
 	}
 	return nil
@@ -48,35 +53,69 @@ func (s *Server) serveHTTP(mux *http.ServeMux) {
 	mux.HandleFunc("/_/ipxe", s.handleIpxe)
 	mux.HandleFunc("/_/file", s.handleFile)
 	mux.HandleFunc("/_/booting", s.handleBooting)
+	mux.HandleFunc("/_/upload", s.handleUpload)
+	mux.HandleFunc("/_/grub", s.handleGrub)
 }
 
-func (s *Server) handleIpxe(w http.ResponseWriter, r *http.Request) {
-	overallStart := time.Now()
+// trackHTTP records that the response to r is in flight, until the
+// returned function is called.
+func (s *Server) trackHTTP(r *http.Request, desc string) func() {
+	s.inflightMu.Lock()
+	defer s.inflightMu.Unlock()
+	if s.inflight == nil {
+		s.inflight = make(map[*http.Request]string)
+	}
+	s.inflight[r] = desc
+	return func() {
+		s.inflightMu.Lock()
+		defer s.inflightMu.Unlock()
+		delete(s.inflight, r)
+	}
+}
+
+// inflightHTTP describes the HTTP responses currently in flight.
+func (s *Server) inflightHTTP() []string {
+	s.inflightMu.Lock()
+	defer s.inflightMu.Unlock()
+	var ret []string
+	for _, desc := range s.inflight {
+		ret = append(ret, desc)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// bootRequest does the work common to all the boot script handlers:
+// it identifies the machine from the mac and arch parameters of r, and
+// gets its Spec and the parameters to add to the URLs that point back
+// at the server. If ok is false, it has already replied to r. The
+// caller must finish span.
+func (s *Server) bootRequest(w http.ResponseWriter, r *http.Request, spanName string) (mach types.Machine, spec *types.Spec, params url.Values, span *tracing.Span, ok bool) {
 	macStr := r.URL.Query().Get("mac")
 	if macStr == "" {
 		s.debug("HTTP", "Bad request %q from %s, missing MAC address", r.URL, r.RemoteAddr)
 		http.Error(w, "missing MAC address parameter", http.StatusBadRequest)
-		return
+		return mach, nil, nil, span, false
 	}
 	archStr := r.URL.Query().Get("arch")
 	if archStr == "" {
 		s.debug("HTTP", "Bad request %q from %s, missing architecture", r.URL, r.RemoteAddr)
 		http.Error(w, "missing architecture parameter", http.StatusBadRequest)
-		return
+		return mach, nil, nil, span, false
 	}
 
 	mac, err := net.ParseMAC(macStr)
 	if err != nil {
 		s.debug("HTTP", "Bad request %q from %s, invalid MAC address %q (%s)", r.URL, r.RemoteAddr, macStr, err)
 		http.Error(w, "invalid MAC address", http.StatusBadRequest)
-		return
+		return mach, nil, nil, span, false
 	}
 
 	i, err := strconv.Atoi(archStr)
 	if err != nil {
 		s.debug("HTTP", "Bad request %q from %s, invalid architecture %q (%s)", r.URL, r.RemoteAddr, archStr, err)
 		http.Error(w, "invalid architecture", http.StatusBadRequest)
-		return
+		return mach, nil, nil, span, false
 	}
 	arch := constants.Architecture(i)
 	switch arch {
@@ -84,42 +123,92 @@ func (s *Server) handleIpxe(w http.ResponseWriter, r *http.Request) {
 	default:
 		s.debug("HTTP", "Bad request %q from %s, unknown architecture %q", r.URL, r.RemoteAddr, arch)
 		http.Error(w, "unknown architecture", http.StatusBadRequest)
-		return
+		return mach, nil, nil, span, false
 	}
 
-	mach := types.Machine{
+	mach = types.Machine{
 		MAC:  mac,
 		Arch: arch,
+		IP:   remoteIP(r),
+	}
+
+	sess := s.session(mac, r.URL.Query().Get("session"))
+	sess.identify(&mach)
+	span = sess.span(spanName)
+	span.SetAttribute("client.address", r.RemoteAddr)
+	params = url.Values{}
+	if id := s.sessionParam(sess); id != "" {
+		params.Set("session", id)
 	}
+	if s.FileTokenLifetime > 0 {
+		tok, err := s.tokens.issue(mac, s.FileTokenLifetime)
+		if err != nil {
+			s.log("HTTP", "Couldn't issue a file token for %s: %s", mac, err)
+			span.SetError(err)
+			http.Error(w, "couldn't get a boot script", http.StatusInternalServerError)
+			return mach, nil, nil, span, false
+		}
+		params.Set("token", tok)
+	}
+
 	start := time.Now()
-	spec, err := s.Booter.BootSpec(mach)
+	booter, gen := s.booterGeneration()
+	spec, err = booter.BootSpec(mach)
 	s.debug("HTTP", "Get bootspec for %s took %s", mac, time.Since(start))
 	if err != nil {
 		s.log("HTTP", "Couldn't get a bootspec for %s (query %q from %s): %s", mac, r.URL, r.RemoteAddr, err)
+		span.SetError(err)
 		http.Error(w, "couldn't get a bootspec", http.StatusInternalServerError)
-		return
+		return mach, nil, nil, span, false
 	}
 	if spec == nil {
 		// TODO: make ipxe abort netbooting so it can fall through to
 		// other boot options - unsure if that's possible.
 		s.debug("HTTP", "No boot spec for %s (query %q from %s), ignoring boot request", mac, r.URL, r.RemoteAddr)
 		http.Error(w, "you don't netboot", http.StatusNotFound)
+		return mach, nil, nil, span, false
+	}
+	if err = s.verify.remember(gen, mac, spec); err != nil {
+		s.log("HTTP", "Bad bootspec for %s (query %q from %s): %s", mac, r.URL, r.RemoteAddr, err)
+		span.SetError(err)
+		http.Error(w, "couldn't get a bootspec", http.StatusInternalServerError)
+		return mach, nil, nil, span, false
+	}
+	if spec, err = s.resolveUKI(mach, spec); err != nil {
+		s.log("HTTP", "Can't boot a UKI on %s (query %q from %s): %s", mac, r.URL, r.RemoteAddr, err)
+		span.SetError(err)
+		http.Error(w, "couldn't get a bootspec", http.StatusInternalServerError)
+		return mach, nil, nil, span, false
+	}
+	return mach, spec, params, span, true
+}
+
+func (s *Server) handleIpxe(w http.ResponseWriter, r *http.Request) {
+	overallStart := time.Now()
+	mach, spec, params, span, ok := s.bootRequest(w, r, "http.ipxe")
+	defer span.Finish()
+	if !ok {
 		return
 	}
-	start = time.Now()
-	var script []byte
+	mac := mach.MAC
 
+	start := time.Now()
+	var (
+		script []byte
+		err    error
+	)
 	if spec.Efi != "" {
 		s.log("HTTP", "Constructing ipxe script for %s with Efi", mac)
-		script, err = ipxeScriptEfi(mach, spec, r.Host)
+		script, err = ipxeScriptEfi(mach, spec, s.baseURL(r), params)
 	} else {
 		s.log("HTTP", "Constructing ipxe script for %s", mac)
-		script, err = ipxeScript(mach, spec, r.Host)
+		script, err = ipxeScript(mach, spec, s.baseURL(r), params)
 	}
 
 	s.debug("HTTP", "Construct ipxe script for %s took %s", mac, time.Since(start))
 	if err != nil {
 		s.log("HTTP", "Failed to assemble ipxe script for %s (query %q from %s): %s", mac, r.URL, r.RemoteAddr, err)
+		span.SetError(err)
 		http.Error(w, "couldn't get a boot script", http.StatusInternalServerError)
 		return
 	}
@@ -139,11 +228,56 @@ func (s *Server) handleFile(w http.ResponseWriter, r *http.Request) {
 	if name == "" {
 		s.debug("HTTP", "Bad request %q from %s, missing filename", r.URL, r.RemoteAddr)
 		http.Error(w, "missing filename", http.StatusBadRequest)
+		return
 	}
 
-	f, sz, err := s.Booter.ReadBootFile(types.ID(name))
+	var sessMAC net.HardwareAddr
+	if mac, err := net.ParseMAC(r.URL.Query().Get("mac")); err == nil {
+		sessMAC = mac
+	}
+	if s.FileTokenLifetime > 0 {
+		mac, err := s.tokens.check(r.URL.Query().Get("token"))
+		if err == nil && sessMAC != nil && sessMAC.String() != mac.String() {
+			err = fmt.Errorf("file token belongs to %s", mac)
+		}
+		if err != nil {
+			s.log("HTTP", "Refusing file %q to %s (query %q): %s", name, r.RemoteAddr, r.URL, err)
+			http.Error(w, "file not available to you", http.StatusForbidden)
+			return
+		}
+		// Cmdline URLs have no MAC, the token tells which machine
+		// they were for.
+		sessMAC = mac
+	}
+	span := s.session(sessMAC, r.URL.Query().Get("session")).span("http.file")
+	defer span.Finish()
+	span.SetAttribute("file.name", name)
+	span.SetAttribute("file.type", r.URL.Query().Get("type"))
+	span.SetAttribute("client.address", r.RemoteAddr)
+
+	defer s.trackHTTP(r, fmt.Sprintf("%q to %s", name, r.RemoteAddr))()
+
+	var (
+		f   io.ReadCloser
+		sz  int64
+		err error
+	)
+	if c, ok := s.booter().(types.ClientChecker); ok {
+		if err = c.CheckClient(types.Machine{MAC: sessMAC, IP: remoteIP(r)}, types.ID(name)); err != nil {
+			s.log("HTTP", "Refusing file %q to %s (query %q): %s", name, r.RemoteAddr, r.URL, err)
+			span.SetError(err)
+			http.Error(w, "file not available to you", http.StatusForbidden)
+			return
+		}
+	}
+	if e := s.fileExpectation(sessMAC, types.ID(name)); e != nil {
+		f, sz, err = s.readVerifiedFile(types.ID(name), e)
+	} else {
+		f, sz, err = s.booter().ReadBootFile(types.ID(name))
+	}
 	if err != nil {
 		s.log("HTTP", "Error getting file %q (query %q from %s): %s", name, r.URL, r.RemoteAddr, err)
+		span.SetError(err)
 		http.Error(w, "couldn't get file", http.StatusInternalServerError)
 		return
 	}
@@ -153,20 +287,23 @@ func (s *Server) handleFile(w http.ResponseWriter, r *http.Request) {
 	} else {
 		s.log("HTTP", "Unknown file size for %q, boot will be VERY slow (can your Booter provide file sizes?)", name)
 	}
-	if _, err = io.Copy(w, f); err != nil {
+	n, err := io.Copy(w, f)
+	span.SetAttribute("transfer.bytes", strconv.FormatInt(n, 10))
+	if err != nil {
 		s.log("HTTP", "Copy of %q to %s (query %q) failed: %s", name, r.RemoteAddr, r.URL, err)
+		span.SetError(err)
 		return
 	}
 	s.log("HTTP", "Sent file %q to %s took %s", name, r.RemoteAddr, time.Since(overallStart))
 
 	switch r.URL.Query().Get("type") {
-	case "kernel":
+	case "kernel", "efi":
 		mac, err := net.ParseMAC(r.URL.Query().Get("mac"))
 		if err != nil {
 			s.log("HTTP", "File fetch provided invalid MAC address %q", r.URL.Query().Get("mac"))
 			return
 		}
-		s.machineEvent(mac, machineStateKernel, "Sent kernel %q", name)
+		s.machineEvent(mac, machineStateKernel, "Sent %s %q", r.URL.Query().Get("type"), name)
 	case "initrd":
 		mac, err := net.ParseMAC(r.URL.Query().Get("mac"))
 		if err != nil {
@@ -178,75 +315,322 @@ func (s *Server) handleFile(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleBooting(w http.ResponseWriter, r *http.Request) {
+	var mac net.HardwareAddr
+	if s.FileTokenLifetime > 0 {
+		// Anyone can claim any MAC address in the query, the token
+		// says which machine the boot script was for.
+		tokMAC, err := s.tokens.check(r.URL.Query().Get("token"))
+		if err != nil {
+			s.log("HTTP", "Ignoring boot notification from %s (query %q): %s", r.RemoteAddr, r.URL, err)
+			http.Error(w, "not your boot", http.StatusForbidden)
+			return
+		}
+		mac = tokMAC
+	}
+
 	// Return a no-op boot script, to satisfy iPXE. It won't get used,
 	// the boot script deletes this image immediately after
 	// downloading.
 	fmt.Fprintf(w, "# Booting")
 
-	macStr := r.URL.Query().Get("mac")
-	if macStr == "" {
-		s.debug("HTTP", "Bad request %q from %s, missing MAC address", r.URL, r.RemoteAddr)
+	if mac == nil {
+		macStr := r.URL.Query().Get("mac")
+		if macStr == "" {
+			s.debug("HTTP", "Bad request %q from %s, missing MAC address", r.URL, r.RemoteAddr)
+			return
+		}
+		var err error
+		if mac, err = net.ParseMAC(macStr); err != nil {
+			s.debug("HTTP", "Bad request %q from %s, invalid MAC address %q (%s)", r.URL, r.RemoteAddr, macStr, err)
+			return
+		}
+	}
+	s.machineEvent(mac, machineStateBooted, "Booting into OS")
+	sess := s.session(mac, r.URL.Query().Get("session"))
+	span := sess.span("http.booting")
+	span.SetAttribute("client.address", r.RemoteAddr)
+	if n, ok := s.booter().(types.BootNotifier); ok {
+		mach := types.Machine{MAC: mac}
+		if sess != nil {
+			mach.Arch = sess.machine.Arch
+		}
+		sess.identify(&mach)
+		if err := n.Booted(mach); err != nil {
+			s.log("HTTP", "Failed to record that %s booted: %s", mac, err)
+			span.SetError(err)
+		}
+	}
+	span.Finish()
+	s.endSession(mac)
+}
+
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "uploads must be POST or PUT", http.StatusMethodNotAllowed)
 		return
 	}
-	mac, err := net.ParseMAC(macStr)
+	if s.UploadMaxSize <= 0 || s.FileTokenLifetime <= 0 {
+		http.Error(w, "uploads are disabled", http.StatusNotFound)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		s.debug("HTTP", "Bad request %q from %s, missing filename", r.URL, r.RemoteAddr)
+		http.Error(w, "missing filename", http.StatusBadRequest)
+		return
+	}
+	mac, err := s.tokens.check(r.URL.Query().Get("token"))
+	if err == nil {
+		if c, ok := s.booter().(types.ClientChecker); ok {
+			err = c.CheckClient(types.Machine{MAC: mac, IP: remoteIP(r)}, types.ID(name))
+		}
+	}
 	if err != nil {
-		s.debug("HTTP", "Bad request %q from %s, invalid MAC address %q (%s)", r.URL, r.RemoteAddr, macStr, err)
+		s.log("HTTP", "Refusing upload %q from %s (query %q): %s", name, r.RemoteAddr, r.URL, err)
+		http.Error(w, "upload not allowed", http.StatusForbidden)
 		return
 	}
-	s.machineEvent(mac, machineStateBooted, "Booting into OS")
+
+	span := s.session(mac, r.URL.Query().Get("session")).span("http.upload")
+	defer span.Finish()
+	span.SetAttribute("file.name", name)
+	span.SetAttribute("client.address", r.RemoteAddr)
+	defer s.trackHTTP(r, fmt.Sprintf("upload %q from %s", name, r.RemoteAddr))()
+
+	if r.ContentLength > s.UploadMaxSize {
+		s.log("HTTP", "Refusing upload %q from %s: %d bytes is over the %d bytes limit", name, r.RemoteAddr, r.ContentLength, s.UploadMaxSize)
+		http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, s.UploadMaxSize)
+	if err = s.booter().WriteBootFile(types.ID(name), body); err != nil {
+		span.SetError(err)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			s.log("HTTP", "Refusing upload %q from %s: over the %d bytes limit", name, r.RemoteAddr, s.UploadMaxSize)
+			http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		s.log("HTTP", "Error writing upload %q from %s: %s", name, r.RemoteAddr, err)
+		http.Error(w, "couldn't store upload", http.StatusInternalServerError)
+		return
+	}
+	s.log("HTTP", "Received upload %q from %s", name, r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// ipxeScript generates an iPXE script for a machine.
-func ipxeScript(mach types.Machine, spec *types.Spec, serverHost string) ([]byte, error) {
+// ipxeScript generates an iPXE script for a machine. baseURL is the
+// scheme and host of the server, and params are added to every URL
+// pointing back at it.
+func ipxeScript(mach types.Machine, spec *types.Spec, baseURL string, params url.Values) ([]byte, error) {
 	if spec.IpxeScript != "" {
 		return []byte(spec.IpxeScript), nil
 	}
+	if spec.IpxeTemplate != "" {
+		return ipxeTemplate(mach, spec, baseURL, params)
+	}
+	if spec.Menu != nil {
+		return ipxeMenu(mach, spec.Menu, baseURL, params)
+	}
 
-	if spec.Kernel == "" {
-		return nil, errors.New("spec is missing Kernel")
+	var b bytes.Buffer
+	b.WriteString("#!ipxe\n")
+	if err := ipxeBoot(&b, mach, spec, baseURL, params); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// ipxeTemplate generates an iPXE script for a machine by executing
+// spec.IpxeTemplate, with arguments as for ipxeScript.
+func ipxeTemplate(mach types.Machine, spec *types.Spec, baseURL string, params url.Values) ([]byte, error) {
+	mac := url.QueryEscape(mach.MAC.String())
+	funcs := template.FuncMap{
+		"ID": func(id types.ID) string {
+			return fmt.Sprintf("%s/_/file?name=%s&mac=%s%s", baseURL, url.QueryEscape(string(id)), mac, extraParams(params))
+		},
+		"Upload": func(id types.ID) string {
+			return fmt.Sprintf("%s/_/upload?name=%s%s", baseURL, url.QueryEscape(string(id)), extraParams(params))
+		},
+		"Booting": func() string {
+			return fmt.Sprintf("%s/_/booting?mac=%s%s", baseURL, mac, extraParams(params))
+		},
+	}
+	tmpl, err := template.New("ipxe").Option("missingkey=error").Funcs(funcs).Parse(spec.IpxeTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("parsing iPXE template: %s", err)
+	}
+	data := struct {
+		Machine types.Machine
+		Spec    *types.Spec
+		URL     string
+	}{mach, spec, baseURL}
+	var b bytes.Buffer
+	if err = tmpl.Execute(&b, data); err != nil {
+		return nil, fmt.Errorf("executing iPXE template: %s", err)
 	}
+	return b.Bytes(), nil
+}
 
-	urlTemplate := fmt.Sprintf("http://%s/_/file?name=%%s&type=%%s&mac=%%s", serverHost)
+// ipxeMenu generates an iPXE script that lets the user choose an entry
+// of menu at the console, and boots it.
+func ipxeMenu(mach types.Machine, menu *types.Menu, baseURL string, params url.Values) ([]byte, error) {
+	if len(menu.Entries) == 0 {
+		return nil, errors.New("menu has no entries")
+	}
 	var b bytes.Buffer
 	b.WriteString("#!ipxe\n")
-	u := fmt.Sprintf(urlTemplate, url.QueryEscape(string(spec.Kernel)), "kernel", url.QueryEscape(mach.MAC.String()))
-	fmt.Fprintf(&b, "kernel --name kernel %s\n", u)
+	b.WriteString("menu\n")
+	def := "entry0"
+	for i, entry := range menu.Entries {
+		fmt.Fprintf(&b, "item entry%d %s\n", i, strings.Join(strings.Fields(entry.Name), " "))
+		if entry.Name == menu.Default {
+			def = fmt.Sprintf("entry%d", i)
+		}
+	}
+	b.WriteString("choose --default " + def)
+	if menu.Timeout > 0 {
+		fmt.Fprintf(&b, " --timeout %d", menu.Timeout*1000)
+	}
+	b.WriteString(" selected || exit 1\n")
+	b.WriteString("goto ${selected}\n")
+	for i, entry := range menu.Entries {
+		fmt.Fprintf(&b, ":entry%d\n", i)
+		if err := ipxeBoot(&b, mach, &entry.Spec, baseURL, params); err != nil {
+			return nil, fmt.Errorf("menu entry %q: %s", entry.Name, err)
+		}
+		// Only reached if booting the entry failed.
+		b.WriteString("exit 1\n")
+	}
+	return b.Bytes(), nil
+}
+
+// ipxeBoot writes the iPXE commands that boot the kernel or EFI
+// binary of spec to b.
+func ipxeBoot(b *bytes.Buffer, mach types.Machine, spec *types.Spec, baseURL string, params url.Values) error {
+	image, typ := spec.Kernel, "kernel"
+	if spec.Efi != "" {
+		image, typ = spec.Efi, "efi"
+	}
+	if image == "" {
+		return errors.New("spec is missing Kernel")
+	}
+
+	urlTemplate := fmt.Sprintf("%s/_/file?name=%%s&type=%%s&mac=%%s%s", baseURL, extraParams(params))
+	u := fmt.Sprintf(urlTemplate, url.QueryEscape(string(image)), typ, url.QueryEscape(mach.MAC.String()))
+	fmt.Fprintf(b, "kernel --name %s %s\n", typ, u)
+	var names []string
 	for i, initrd := range spec.Initrd {
+		name := fmt.Sprintf("initrd%d", i)
+		if i < len(spec.InitrdNames) && spec.InitrdNames[i] != "" {
+			name = spec.InitrdNames[i]
+		}
+		if strings.ContainsAny(name, " \t\r\n=\"'") {
+			return fmt.Errorf("invalid initrd name %q", name)
+		}
+		names = append(names, name)
 		u = fmt.Sprintf(urlTemplate, url.QueryEscape(string(initrd)), "initrd", url.QueryEscape(mach.MAC.String()))
-		fmt.Fprintf(&b, "initrd --name initrd%d %s\n", i, u)
+		fmt.Fprintf(b, "initrd --name %s %s\n", name, u)
 	}
 
-	fmt.Fprintf(&b, "imgfetch --name ready http://%s/_/booting?mac=%s ||\n", serverHost, url.QueryEscape(mach.MAC.String()))
+	fmt.Fprintf(b, "imgfetch --name ready %s/_/booting?mac=%s%s ||\n", baseURL, url.QueryEscape(mach.MAC.String()), extraParams(params))
 	b.WriteString("imgfree ready ||\n")
 
-	b.WriteString("boot kernel ")
-	for i := range spec.Initrd {
-		fmt.Fprintf(&b, "initrd=initrd%d ", i)
+	args := []string{"boot", typ}
+	// EFI binaries get the files by name from iPXE, kernels need to
+	// be told which are initrds.
+	if spec.Efi == "" {
+		for _, name := range names {
+			args = append(args, "initrd="+name)
+		}
 	}
 
 	f := func(id string) string {
-		return fmt.Sprintf("http://%s/_/file?name=%s", serverHost, url.QueryEscape(id))
+		return fmt.Sprintf("%s/_/file?name=%s%s", baseURL, url.QueryEscape(id), extraParams(params))
+	}
+	upload := func(id string) string {
+		return fmt.Sprintf("%s/_/upload?name=%s%s", baseURL, url.QueryEscape(id), extraParams(params))
 	}
-	cmdline, err := utils.ExpandCmdline(spec.Cmdline, template.FuncMap{"ID": f})
+	cmdline, err := utils.ExpandCmdline(spec.Cmdline, template.FuncMap{"ID": f, "Upload": upload}, cmdlineVars(mach, baseURL))
 	if err != nil {
-		return nil, fmt.Errorf("expanding cmdline %q: %s", spec.Cmdline, err)
+		return fmt.Errorf("expanding cmdline %q: %s", spec.Cmdline, err)
+	}
+	if cmdline != "" {
+		args = append(args, cmdline)
 	}
-	b.WriteString(cmdline)
+	b.WriteString(strings.Join(args, " "))
 	b.WriteByte('\n')
+	return nil
+}
 
-	return b.Bytes(), nil
+// cmdlineVars returns the variables of the cmdline of mach, which
+// reaches the server at baseURL.
+func cmdlineVars(mach types.Machine, baseURL string) *utils.CmdlineVars {
+	var host string
+	if u, err := url.Parse(baseURL); err == nil {
+		host = u.Hostname()
+	}
+	return utils.NewCmdlineVars(mach, host)
 }
 
 // ipxeScriptEfi generates an iPXE script for a machine that boots via EFI.
-func ipxeScriptEfi(mach types.Machine, spec *types.Spec, serverHost string) ([]byte, error) {
+func ipxeScriptEfi(mach types.Machine, spec *types.Spec, baseURL string, params url.Values) ([]byte, error) {
 	if spec.IpxeScript != "" {
 		return []byte(spec.IpxeScript), nil
 	}
+	if spec.IpxeTemplate != "" {
+		return ipxeTemplate(mach, spec, baseURL, params)
+	}
 
 	var b bytes.Buffer
 	b.WriteString("#!ipxe\n")
-	b.WriteString(fmt.Sprintf("chain --autofree http://%s/_/file?name=%s&type=efi&mac=%s\n", serverHost, spec.Efi, url.QueryEscape(mach.MAC.String())))
-	b.WriteByte('\n')
-
+	if err := ipxeBoot(&b, mach, spec, baseURL, params); err != nil {
+		return nil, err
+	}
 	return b.Bytes(), nil
 }
+
+// baseURL returns the scheme and host that the machine that sent r
+// should use to reach the server: over HTTPS if the server serves it,
+// even if r came in over plain HTTP.
+func (s *Server) baseURL(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	if s.TLSConfig == nil {
+		return "http://" + r.Host
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = strings.Trim(r.Host, "[]")
+	}
+	return "https://" + net.JoinHostPort(host, strconv.Itoa(s.HTTPSPort))
+}
+
+// bootURL returns the scheme, host and port that machines should
+// use to reach the server at serverIP.
+func (s *Server) bootURL(serverIP net.IP) string {
+	if s.TLSConfig != nil {
+		return "https://" + net.JoinHostPort(serverIP.String(), strconv.Itoa(s.HTTPSPort))
+	}
+	return "http://" + net.JoinHostPort(serverIP.String(), strconv.Itoa(s.HTTPPort))
+}
+
+// remoteIP returns the IP address that r came from, or nil if it
+// can't be parsed.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// extraParams encodes params so they can be appended to a URL that
+// already has a query string.
+func extraParams(params url.Values) string {
+	if len(params) == 0 {
+		return ""
+	}
+	return "&" + params.Encode()
+}
@@ -17,14 +17,29 @@ package server
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/kairos-io/netboot/constants"
+	"github.com/kairos-io/netboot/tracing"
 	"github.com/kairos-io/netboot/types"
 )
 
@@ -153,6 +168,212 @@ boot kernel initrd=initrd0 initrd=initrd1 thing=http://localhost:1234/_/file?nam
 	}
 }
 
+func TestIpxeEfi(t *testing.T) {
+	spec := &types.Spec{
+		Efi:         "e",
+		Initrd:      []types.ID{"b", "s"},
+		InitrdNames: []string{"BCD"},
+		Cmdline:     `conf={{ ID "c" }}`,
+	}
+	s := &Server{
+		Booter: booterFunc(func(types.Machine) (*types.Spec, error) { return spec, nil }),
+		events: make(map[string][]machineEvent),
+	}
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=1", nil)
+	if err != nil {
+		t.Fatalf("Constructing ipxe request: %s", err)
+	}
+	req.Host = "localhost:1234"
+	s.handleIpxe(rr, req)
+	if rr.Code != 200 {
+		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
+	}
+	expected := `#!ipxe
+kernel --name efi http://localhost:1234/_/file?name=e&type=efi&mac=01%3A02%3A03%3A04%3A05%3A06
+initrd --name BCD http://localhost:1234/_/file?name=b&type=initrd&mac=01%3A02%3A03%3A04%3A05%3A06
+initrd --name initrd1 http://localhost:1234/_/file?name=s&type=initrd&mac=01%3A02%3A03%3A04%3A05%3A06
+imgfetch --name ready http://localhost:1234/_/booting?mac=01%3A02%3A03%3A04%3A05%3A06 ||
+imgfree ready ||
+boot efi conf=http://localhost:1234/_/file?name=c
+`
+	if rr.Body.String() != expected {
+		t.Fatalf("Wrong iPXE script\nwant: %s\ngot:  %s", expected, rr.Body.String())
+	}
+
+	// Fetching the EFI binary is recorded like fetching a kernel.
+	s.Booter = readBootFile("stuff")
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/_/file?name=e&type=efi&mac=01:02:03:04:05:06", nil)
+	if err != nil {
+		t.Fatalf("Constructing file request: %s", err)
+	}
+	s.handleFile(rr, req)
+	if rr.Code != 200 {
+		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
+	}
+	evts := s.events["01:02:03:04:05:06"]
+	if len(evts) == 0 || evts[len(evts)-1].State != machineStateKernel {
+		t.Fatalf("EFI binary fetch wasn't recorded, events: %v", evts)
+	}
+
+	spec = &types.Spec{Efi: "e", Initrd: []types.ID{"b"}, InitrdNames: []string{"bad name"}}
+	s.Booter = booterFunc(func(types.Machine) (*types.Spec, error) { return spec, nil })
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=1", nil)
+	if err != nil {
+		t.Fatalf("Constructing ipxe request: %s", err)
+	}
+	s.handleIpxe(rr, req)
+	if rr.Code != 500 {
+		t.Fatalf("Got HTTP %d for a bad initrd name, expected 500", rr.Code)
+	}
+}
+
+func TestIpxeMenu(t *testing.T) {
+	booter := func(m types.Machine) (*types.Spec, error) {
+		return &types.Spec{
+			Menu: &types.Menu{
+				Entries: []types.MenuEntry{
+					{Name: "Install", Spec: types.Spec{Kernel: "k", Initrd: []types.ID{"i"}, Cmdline: `conf={{ ID "c" }}`}},
+					{Name: "Rescue shell", Spec: types.Spec{Efi: "e"}},
+				},
+				Default: "Rescue shell",
+				Timeout: 10,
+			},
+		}, nil
+	}
+	s := &Server{
+		Booter: booterFunc(booter),
+		events: make(map[string][]machineEvent),
+	}
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=0", nil)
+	if err != nil {
+		t.Fatalf("Constructing ipxe request: %s", err)
+	}
+	req.Host = "localhost:1234"
+	s.handleIpxe(rr, req)
+	if rr.Code != 200 {
+		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
+	}
+
+	expected := `#!ipxe
+menu
+item entry0 Install
+item entry1 Rescue shell
+choose --default entry1 --timeout 10000 selected || exit 1
+goto ${selected}
+:entry0
+kernel --name kernel http://localhost:1234/_/file?name=k&type=kernel&mac=01%3A02%3A03%3A04%3A05%3A06
+initrd --name initrd0 http://localhost:1234/_/file?name=i&type=initrd&mac=01%3A02%3A03%3A04%3A05%3A06
+imgfetch --name ready http://localhost:1234/_/booting?mac=01%3A02%3A03%3A04%3A05%3A06 ||
+imgfree ready ||
+boot kernel initrd=initrd0 conf=http://localhost:1234/_/file?name=c
+exit 1
+:entry1
+kernel --name efi http://localhost:1234/_/file?name=e&type=efi&mac=01%3A02%3A03%3A04%3A05%3A06
+imgfetch --name ready http://localhost:1234/_/booting?mac=01%3A02%3A03%3A04%3A05%3A06 ||
+imgfree ready ||
+boot efi
+exit 1
+`
+	if rr.Body.String() != expected {
+		t.Fatalf("Wrong iPXE script\nwant: %s\ngot:  %s", expected, rr.Body.String())
+	}
+}
+
+func TestCmdlineVars(t *testing.T) {
+	spec := &types.Spec{
+		Kernel:  "k",
+		Cmdline: `hostname=node-{{ .MAC.Dashed }} id={{ .MAC.Bare }} arch={{ .Arch }} fw={{ .Firmware }} uuid={{ .GUID }} ip={{ .IP }} server={{ .Server }}{{ with .Hostname }} name={{ . }}{{ end }}`,
+	}
+	s := &Server{
+		Booter: booterFunc(func(types.Machine) (*types.Spec, error) { return spec, nil }),
+		events: make(map[string][]machineEvent),
+	}
+	mac := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	s.startSession(types.Machine{
+		MAC:      mac,
+		Arch:     constants.ArchX64,
+		Firmware: constants.FirmwareEFI64,
+		GUID:     []byte{0x33, 0x22, 0x11, 0x00, 0x55, 0x44, 0x77, 0x66, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+		Hostname: "rack1-03",
+	}, nil)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=1", nil)
+	if err != nil {
+		t.Fatalf("Constructing ipxe request: %s", err)
+	}
+	req.Host = "192.168.0.1:1234"
+	req.RemoteAddr = "192.168.0.23:4567"
+	s.handleIpxe(rr, req)
+	if rr.Code != 200 {
+		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
+	}
+	want := "boot kernel hostname=node-01-02-03-04-05-06 id=010203040506 arch=X64 fw=efi64 uuid=00112233-4455-6677-8899-aabbccddeeff ip=192.168.0.23 server=192.168.0.1 name=rack1-03\n"
+	if !strings.HasSuffix(rr.Body.String(), want) {
+		t.Fatalf("Wrong iPXE script, want it to end with %q, got:\n%s", want, rr.Body.String())
+	}
+
+	// Unknown variables are errors, not empty strings.
+	spec = &types.Spec{Kernel: "k", Cmdline: "x={{ .Nope }}"}
+	rr = httptest.NewRecorder()
+	s.handleIpxe(rr, req)
+	if rr.Code != 500 {
+		t.Fatalf("Got HTTP %d for an unknown cmdline variable, expected 500", rr.Code)
+	}
+}
+
+func TestIpxeTemplate(t *testing.T) {
+	spec := &types.Spec{
+		Kernel: "k",
+		IpxeTemplate: `#!ipxe
+echo Booting {{ .Machine.MAC }} from {{ .URL }}
+kernel {{ ID .Spec.Kernel }} conf={{ ID "c" }} log={{ Upload "u" }}
+imgfetch {{ Booting }} ||
+boot
+`,
+	}
+	s := &Server{
+		Booter:            booterFunc(func(types.Machine) (*types.Spec, error) { return spec, nil }),
+		FileTokenLifetime: time.Minute,
+		events:            make(map[string][]machineEvent),
+	}
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=0", nil)
+	if err != nil {
+		t.Fatalf("Constructing ipxe request: %s", err)
+	}
+	req.Host = "localhost:1234"
+	s.handleIpxe(rr, req)
+	if rr.Code != 200 {
+		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
+	}
+	tok := regexp.MustCompile(`token=([^&\s]+)`).FindStringSubmatch(rr.Body.String())
+	if tok == nil {
+		t.Fatalf("No file token in iPXE script %q", rr.Body.String())
+	}
+	expected := strings.ReplaceAll(`#!ipxe
+echo Booting 01:02:03:04:05:06 from http://localhost:1234
+kernel http://localhost:1234/_/file?name=k&mac=01%3A02%3A03%3A04%3A05%3A06&token=TOK conf=http://localhost:1234/_/file?name=c&mac=01%3A02%3A03%3A04%3A05%3A06&token=TOK log=http://localhost:1234/_/upload?name=u&token=TOK
+imgfetch http://localhost:1234/_/booting?mac=01%3A02%3A03%3A04%3A05%3A06&token=TOK ||
+boot
+`, "TOK", tok[1])
+	if rr.Body.String() != expected {
+		t.Fatalf("Wrong iPXE script\nwant: %s\ngot:  %s", expected, rr.Body.String())
+	}
+
+	// Broken templates are server errors.
+	spec = &types.Spec{IpxeTemplate: "{{ .Nope }}"}
+	rr = httptest.NewRecorder()
+	s.handleIpxe(rr, req)
+	if rr.Code != 500 {
+		t.Fatalf("Got HTTP %d for a broken template, expected 500", rr.Code)
+	}
+}
+
 type readBootFile string
 
 func (b readBootFile) BootSpec(m types.Machine) (*types.Spec, error) { return nil, nil }
@@ -162,6 +383,59 @@ func (b readBootFile) ReadBootFile(id types.ID) (io.ReadCloser, int64, error) {
 }
 func (b readBootFile) WriteBootFile(id types.ID, r io.Reader) error { return errors.New("no") }
 
+func TestIpxeHTTPS(t *testing.T) {
+	booter := func(m types.Machine) (*types.Spec, error) {
+		return &types.Spec{Kernel: "k", Cmdline: `f={{ ID "f" }}`}, nil
+	}
+	s := &Server{
+		Booter:    booterFunc(booter),
+		Log:       func(subsystem, msg string) {},
+		Debug:     func(subsystem, msg string) {},
+		events:    make(map[string][]machineEvent),
+		TLSConfig: &tls.Config{},
+		HTTPSPort: 8443,
+		HTTPPort:  8080,
+	}
+
+	// A plain HTTP request is sent over to HTTPS.
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=0", nil)
+	if err != nil {
+		t.Fatalf("Constructing ipxe request: %s", err)
+	}
+	req.Host = "localhost:1234"
+	s.handleIpxe(rr, req)
+	if rr.Code != 200 {
+		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
+	}
+	expected := `#!ipxe
+kernel --name kernel https://localhost:8443/_/file?name=k&type=kernel&mac=01%3A02%3A03%3A04%3A05%3A06
+imgfetch --name ready https://localhost:8443/_/booting?mac=01%3A02%3A03%3A04%3A05%3A06 ||
+imgfree ready ||
+boot kernel f=https://localhost:8443/_/file?name=f
+`
+	if rr.Body.String() != expected {
+		t.Fatalf("Wrong iPXE script\nwant: %s\ngot:  %s", expected, rr.Body.String())
+	}
+
+	// A request that came over HTTPS keeps its host.
+	rr = httptest.NewRecorder()
+	req.TLS = &tls.ConnectionState{}
+	req.Host = "[fe80::1]:443"
+	s.handleIpxe(rr, req)
+	if !strings.Contains(rr.Body.String(), "kernel --name kernel https://[fe80::1]:443/_/file?") {
+		t.Fatalf("Wrong iPXE script for HTTPS request:\n%s", rr.Body.String())
+	}
+
+	if u := s.bootURL(net.IPv4(10, 0, 0, 1)); u != "https://10.0.0.1:8443" {
+		t.Fatalf("Wrong boot URL with TLS, got %q", u)
+	}
+	s.TLSConfig = nil
+	if u := s.bootURL(net.IPv4(10, 0, 0, 1)); u != "http://10.0.0.1:8080" {
+		t.Fatalf("Wrong boot URL without TLS, got %q", u)
+	}
+}
+
 func TestFile(t *testing.T) {
 	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
 	s := &Server{
@@ -201,3 +475,404 @@ func TestFile(t *testing.T) {
 		t.Fatalf("Wrong file contents, want %q, got %q", expected, rr.Body.Bytes())
 	}
 }
+
+func TestBootSession(t *testing.T) {
+	var spans []*tracing.Span
+	booter := func(m types.Machine) (*types.Spec, error) {
+		return &types.Spec{Kernel: "k", Cmdline: `f={{ ID "f" }}`}, nil
+	}
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{
+		Booter:       booterFunc(booter),
+		Log:          log,
+		Debug:        log,
+		SpanExporter: tracing.ExporterFunc(func(s *tracing.Span) { spans = append(spans, s) }),
+		events:       make(map[string][]machineEvent),
+	}
+
+	mac, _ := net.ParseMAC("01:02:03:04:05:06")
+	sess := s.startSession(types.Machine{MAC: mac}, []byte{1, 2, 3, 4})
+	if again := s.startSession(types.Machine{MAC: mac}, []byte{5, 6, 7, 8}); again != sess {
+		t.Fatalf("Second DHCP transaction didn't join the existing session")
+	}
+	id := sess.id.String()
+	if p := s.tftpPath(mac, 0); p != "01:02:03:04:05:06/0/"+id {
+		t.Fatalf("Wrong TFTP path %q", p)
+	}
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=0&session="+id, nil)
+	req.Host = "localhost:1234"
+	s.handleIpxe(rr, req)
+	if rr.Code != 200 {
+		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
+	}
+	expected := `#!ipxe
+kernel --name kernel http://localhost:1234/_/file?name=k&type=kernel&mac=01%3A02%3A03%3A04%3A05%3A06&session=` + id + `
+imgfetch --name ready http://localhost:1234/_/booting?mac=01%3A02%3A03%3A04%3A05%3A06&session=` + id + ` ||
+imgfree ready ||
+boot kernel f=http://localhost:1234/_/file?name=f&session=` + id + `
+`
+	if rr.Body.String() != expected {
+		t.Fatalf("Wrong iPXE script\nwant: %s\ngot:  %s", expected, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/_/booting?mac=01:02:03:04:05:06&session="+id, nil)
+	s.handleBooting(rr, req)
+
+	if len(spans) != 3 {
+		t.Fatalf("Got %d spans, want 3", len(spans))
+	}
+	root := spans[2]
+	if root.Name != "boot" || root.ParentID.IsValid() {
+		t.Fatalf("Last span should be the session root, got %q", root.Name)
+	}
+	for _, span := range spans[:2] {
+		if span.TraceID != root.TraceID || span.ParentID != root.SpanID {
+			t.Fatalf("Span %q is not part of the boot session", span.Name)
+		}
+	}
+	if s.session(mac, "") != nil {
+		t.Fatalf("Session still open after the machine booted")
+	}
+}
+
+type notifyingBooter struct {
+	booterFunc
+	booted []types.Machine
+}
+
+func (b *notifyingBooter) Booted(m types.Machine) error {
+	b.booted = append(b.booted, m)
+	return nil
+}
+
+func TestBootNotifier(t *testing.T) {
+	booter := &notifyingBooter{booterFunc: func(m types.Machine) (*types.Spec, error) {
+		return &types.Spec{Kernel: "k"}, nil
+	}}
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{
+		Booter: booter,
+		Log:    log,
+		Debug:  log,
+		events: make(map[string][]machineEvent),
+	}
+
+	mac, _ := net.ParseMAC("01:02:03:04:05:06")
+	s.startSession(types.Machine{MAC: mac, Arch: constants.ArchX64, VendorClass: "PXEClient"}, []byte{1, 2, 3, 4})
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/_/booting?mac=01:02:03:04:05:06", nil)
+	s.handleBooting(rr, req)
+
+	want := []types.Machine{{MAC: mac, Arch: constants.ArchX64, VendorClass: "PXEClient"}}
+	if !reflect.DeepEqual(booter.booted, want) {
+		t.Fatalf("Wrong boot notifications\nwant: %#v\ngot:  %#v", want, booter.booted)
+	}
+
+	// With file tokens, the token says which machine booted, not the
+	// query.
+	s.FileTokenLifetime = time.Hour
+	booter.booted = nil
+	tok, err := s.tokens.issue(mac, time.Hour)
+	if err != nil {
+		t.Fatalf("Issuing token: %s", err)
+	}
+	for query, code := range map[string]int{
+		"mac=01:02:03:04:05:07":              403,
+		"mac=01:02:03:04:05:07&token=bogus":  403,
+		"mac=01:02:03:04:05:07&token=" + tok: 200,
+	} {
+		rr = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/_/booting?"+query, nil)
+		s.handleBooting(rr, req)
+		if rr.Code != code {
+			t.Fatalf("Got HTTP %d for %q, expected %d", rr.Code, query, code)
+		}
+	}
+	if len(booter.booted) != 1 || booter.booted[0].MAC.String() != mac.String() {
+		t.Fatalf("Wrong boot notifications with file tokens: %#v", booter.booted)
+	}
+}
+
+// filesBooter boots every machine with spec, and serves files.
+type filesBooter struct {
+	spec  *types.Spec
+	files map[types.ID]string
+	reads map[types.ID]int
+}
+
+func (b *filesBooter) BootSpec(m types.Machine) (*types.Spec, error) { return b.spec, nil }
+func (b *filesBooter) ReadBootFile(id types.ID) (io.ReadCloser, int64, error) {
+	b.reads[id]++
+	d, ok := b.files[id]
+	if !ok {
+		return nil, -1, fmt.Errorf("no file with ID %q", id)
+	}
+	// Unknown size, the verified copy's is known.
+	return ioutil.NopCloser(bytes.NewBufferString(d)), -1, nil
+}
+func (b *filesBooter) WriteBootFile(id types.ID, r io.Reader) error { return errors.New("no") }
+
+func TestVerifiedFile(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(s string) string {
+		h := sha512.Sum512([]byte(s))
+		sig, err := priv.Sign(rand.Reader, h[:], &ed25519.Options{Hash: crypto.SHA512})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(sig)
+	}
+	digest := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return "sha256:" + hex.EncodeToString(h[:])
+	}
+
+	booter := &filesBooter{
+		spec: &types.Spec{
+			Kernel: "kernel",
+			Initrd: []types.ID{"initrd", "signed", "forged"},
+			Digests: map[types.ID]string{
+				"kernel": digest("kernel"),
+				"initrd": digest("initrd"),
+			},
+			Signatures: map[types.ID]string{
+				"signed": sign("signed"),
+				"forged": sign("genuine"),
+			},
+			PublicKey: base64.StdEncoding.EncodeToString(pub),
+		},
+		files: map[types.ID]string{
+			"kernel":   "kernel",
+			"initrd":   "tampered initrd",
+			"signed":   "signed",
+			"forged":   "forged",
+			"unlisted": "unlisted",
+		},
+		reads: map[types.ID]int{},
+	}
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{
+		Booter:         booter,
+		Log:            log,
+		Debug:          log,
+		events:         make(map[string][]machineEvent),
+		VerifyCacheDir: t.TempDir(),
+	}
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/_/ipxe?arch=0&mac=01:02:03:04:05:06", nil)
+	s.handleIpxe(rr, req)
+	if rr.Code != 200 {
+		t.Fatalf("Got HTTP %d from ipxe request, expected 200", rr.Code)
+	}
+
+	get := func(name string) (int, string) {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/_/file?name="+name, nil)
+		s.handleFile(rr, req)
+		return rr.Code, rr.Body.String()
+	}
+	for _, name := range []string{"kernel", "kernel", "signed", "signed", "unlisted"} {
+		if code, body := get(name); code != 200 || body != name {
+			t.Fatalf("Wrong response for %q: HTTP %d, %q", name, code, body)
+		}
+	}
+	// Verified files are only read from the Booter once.
+	for _, name := range []types.ID{"kernel", "signed"} {
+		if booter.reads[name] != 1 {
+			t.Fatalf("%q read %d times from the Booter, expected once", name, booter.reads[name])
+		}
+	}
+	for _, name := range []string{"initrd", "forged"} {
+		if code, _ := get(name); code != 500 {
+			t.Fatalf("Got HTTP %d for tampered %q, expected 500", code, name)
+		}
+	}
+
+	s.VerifyLogOnly = true
+	if code, body := get("initrd"); code != 200 || body != "tampered initrd" {
+		t.Fatalf("Wrong response for tampered initrd with VerifyLogOnly: HTTP %d, %q", code, body)
+	}
+	if code, _ := get("initrd"); code != 200 || booter.reads["initrd"] != 3 {
+		t.Fatalf("Tampered initrd was cached")
+	}
+	s.VerifyLogOnly = false
+
+	// The digests of the old Booter don't apply to the files of a new
+	// one.
+	booter.files["kernel"] = "rebuilt kernel"
+	s.SetBooter(booter)
+	if code, body := get("kernel"); code != 200 || body != "rebuilt kernel" {
+		t.Fatalf("Wrong response for the kernel of a new Booter: HTTP %d, %q", code, body)
+	}
+}
+
+// ipBoundBooter only serves its files to 192.0.2.1.
+type ipBoundBooter struct {
+	readBootFile
+}
+
+func (b ipBoundBooter) CheckClient(m types.Machine, id types.ID) error {
+	if !m.IP.Equal(net.IPv4(192, 0, 2, 1)) {
+		return fmt.Errorf("%q isn't for %s", id, m.IP)
+	}
+	return nil
+}
+
+func TestFileClientCheck(t *testing.T) {
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	s := &Server{
+		Booter: ipBoundBooter{readBootFile("stuff")},
+		Log:    log,
+		Debug:  log,
+	}
+	for addr, code := range map[string]int{"192.0.2.1:1234": 200, "192.0.2.2:1234": 403} {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/_/file?name=test", nil)
+		if err != nil {
+			t.Fatalf("Constructing file request: %s", err)
+		}
+		req.RemoteAddr = addr
+		s.handleFile(rr, req)
+		if rr.Code != code {
+			t.Fatalf("Got HTTP %d for request from %s, expected %d", rr.Code, addr, code)
+		}
+	}
+}
+
+func TestFileTokens(t *testing.T) {
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	b := &filesBooter{
+		spec:  &types.Spec{Kernel: "k", Cmdline: `s={{ ID "secret" }}`},
+		files: map[types.ID]string{"k": "kernel", "secret": "hunter2"},
+		reads: map[types.ID]int{},
+	}
+	s := &Server{
+		Booter:            b,
+		Log:               log,
+		Debug:             log,
+		events:            make(map[string][]machineEvent),
+		FileTokenLifetime: time.Hour,
+	}
+	tokenRe := regexp.MustCompile(`token=([^&\s]+)`)
+	script := func() string {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=0", nil)
+		if err != nil {
+			t.Fatalf("Constructing ipxe request: %s", err)
+		}
+		s.handleIpxe(rr, req)
+		if rr.Code != 200 {
+			t.Fatalf("Got HTTP %d from ipxe request, expected 200", rr.Code)
+		}
+		m := tokenRe.FindAllStringSubmatch(rr.Body.String(), -1)
+		// kernel, booting and the cmdline URL.
+		if len(m) != 3 || m[0][1] != m[1][1] || m[0][1] != m[2][1] {
+			t.Fatalf("Script doesn't have the same token in every URL:\n%s", rr.Body.String())
+		}
+		return m[0][1]
+	}
+	fetch := func(query string, code int) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/_/file?"+query, nil)
+		if err != nil {
+			t.Fatalf("Constructing file request: %s", err)
+		}
+		s.handleFile(rr, req)
+		if rr.Code != code {
+			t.Fatalf("Got HTTP %d for %q, expected %d", rr.Code, query, code)
+		}
+	}
+
+	tok := script()
+	fetch("name=k&type=kernel&mac=01%3A02%3A03%3A04%3A05%3A06&token="+tok, 200)
+	fetch("name=secret&token="+tok, 200)
+	fetch("name=secret", 403)
+	fetch("name=secret&token=bogus", 403)
+	fetch("name=k&type=kernel&mac=01%3A02%3A03%3A04%3A05%3A07&token="+tok, 403)
+
+	// A new script replaces the machine's token.
+	newTok := script()
+	fetch("name=secret&token="+tok, 403)
+	fetch("name=secret&token="+newTok, 200)
+
+	expired, err := s.tokens.issue(net.HardwareAddr{1, 2, 3, 4, 5, 7}, time.Nanosecond)
+	if err != nil {
+		t.Fatalf("Issuing token: %s", err)
+	}
+	time.Sleep(time.Millisecond)
+	fetch("name=secret&token="+expired, 403)
+}
+
+type uploadBooter struct {
+	booterFunc
+	uploads map[types.ID]string
+}
+
+func (b *uploadBooter) WriteBootFile(id types.ID, r io.Reader) error {
+	bs, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b.uploads[id] = string(bs)
+	return nil
+}
+
+func TestUpload(t *testing.T) {
+	log := func(subsystem, msg string) { t.Logf("[%s] %s", subsystem, msg) }
+	b := &uploadBooter{
+		booterFunc: func(m types.Machine) (*types.Spec, error) {
+			return &types.Spec{Kernel: "k", Cmdline: `log={{ Upload "log" }}`}, nil
+		},
+		uploads: map[types.ID]string{},
+	}
+	s := &Server{
+		Booter:            b,
+		Log:               log,
+		Debug:             log,
+		events:            make(map[string][]machineEvent),
+		FileTokenLifetime: time.Hour,
+		UploadMaxSize:     10,
+	}
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=0", nil)
+	if err != nil {
+		t.Fatalf("Constructing ipxe request: %s", err)
+	}
+	req.Host = "localhost:1234"
+	s.handleIpxe(rr, req)
+	m := regexp.MustCompile(`log=http://localhost:1234(/_/upload\?name=log&token=\S+)`).FindStringSubmatch(rr.Body.String())
+	if m == nil {
+		t.Fatalf("No upload URL in script:\n%s", rr.Body.String())
+	}
+
+	upload := func(method, path, body string, code int) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Constructing upload request: %s", err)
+		}
+		s.handleUpload(rr, req)
+		if rr.Code != code {
+			t.Fatalf("Got HTTP %d for %s %q, expected %d", rr.Code, method, path, code)
+		}
+	}
+	upload("GET", m[1], "", 405)
+	upload("POST", "/_/upload?name=log", "hello", 403)
+	upload("POST", m[1], "way too large", 413)
+	upload("POST", m[1], "hello", 204)
+	if b.uploads["log"] != "hello" {
+		t.Fatalf("Wrong uploads %v", b.uploads)
+	}
+	s.UploadMaxSize = 0
+	upload("POST", m[1], "hello", 404)
+}
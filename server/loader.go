@@ -0,0 +1,89 @@
+// Copyright 2024 Kairos contributors
+
+package server
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/kairos-io/netboot/constants"
+	"github.com/kairos-io/netboot/types"
+)
+
+// chooseLoader picks the boot chain, types.LoaderIpxe or
+// types.LoaderGrub, that mach loads spec with. For EFI firmwares, the
+// Spec's Loader wins, then LoaderPolicy, then Loaders, and GRUB is
+// the default if the firmware has a GrubLoader. BIOS firmwares always
+// use iPXE, and can't boot Specs with UKIs, which are EFI binaries.
+//
+// It returns an error if the chosen boot chain can't be served, rather
+// than fall back to another one, since a Secure Boot machine wouldn't
+// run an untrusted iPXE anyway.
+func (s *Server) chooseLoader(mach types.Machine, fwtype constants.Firmware, spec *types.Spec) (string, error) {
+	if _, efi := grubArch(fwtype); !efi {
+		// Our own iPXE doesn't say what it runs on, the firmware
+		// that loaded it was checked already.
+		if hasUKI(spec) && fwtype != constants.FirmwarePixiecoreIpxe {
+			return "", fmt.Errorf("spec boots a UKI, which needs EFI firmware, not %s", fwtype)
+		}
+		return types.LoaderIpxe, nil
+	}
+	loader := spec.Loader
+	if loader == "" && s.LoaderPolicy != nil {
+		loader = s.LoaderPolicy(mach)
+	}
+	if loader == "" {
+		loader = s.defaultLoader(fwtype)
+	}
+	switch loader {
+	case types.LoaderIpxe:
+		if bs, _ := s.firmware(fwtype); bs == nil {
+			return "", fmt.Errorf("no iPXE binary for firmware %s", fwtype)
+		}
+	case types.LoaderGrub:
+		if s.grubLoader(fwtype) == nil {
+			return "", fmt.Errorf("no trusted boot chain (shim and GRUB) for firmware %s", fwtype)
+		}
+	default:
+		return "", fmt.Errorf("unknown loader %q", loader)
+	}
+	return loader, nil
+}
+
+// defaultLoader returns the boot chain for fwtype when neither the
+// Spec nor LoaderPolicy picks one.
+func (s *Server) defaultLoader(fwtype constants.Firmware) string {
+	if l := s.Loaders[fwtype]; l != "" {
+		return l
+	}
+	if s.grubLoader(fwtype) != nil {
+		return types.LoaderGrub
+	}
+	return types.LoaderIpxe
+}
+
+// setSessionLoader records the boot chain chosen for mac's current
+// boot.
+func (s *Server) setSessionLoader(mac net.HardwareAddr, loader string) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	if sess := s.sessions[mac.String()]; sess != nil {
+		sess.loader = loader
+	}
+}
+
+// sessionLoader returns the boot chain chosen for mac's current boot,
+// or the default for fwtype if none was.
+func (s *Server) sessionLoader(mac net.HardwareAddr, fwtype constants.Firmware) string {
+	s.sessionsMu.Lock()
+	sess := s.sessions[mac.String()]
+	var loader string
+	if sess != nil {
+		loader = sess.loader
+	}
+	s.sessionsMu.Unlock()
+	if loader == "" {
+		return s.defaultLoader(fwtype)
+	}
+	return loader
+}
@@ -44,6 +44,10 @@ func (m machineState) String() string {
 		return "Sent initrd(s) (HTTP)"
 	case machineStateBooted:
 		return "Booted machine"
+	case machineStateIgnored:
+		return "Ignored machine"
+	case machineStateFailed:
+		return "Can't boot machine"
 	default:
 		return "Unknown"
 	}
@@ -64,6 +68,7 @@ const (
 	machineStateBooted
 
 	machineStateIgnored
+	machineStateFailed
 )
 
 type machineEvent struct {
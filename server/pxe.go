@@ -74,15 +74,23 @@ func (s *Server) servePXE(conn net.PacketConn) error {
 
 		s.machineEvent(pkt.HardwareAddr, machineStatePXE, "Sent PXE configuration")
 
+		span := s.session(pkt.HardwareAddr, "").span("pxe.offer")
+		span.SetAttribute("interface", intf.Name)
+		span.SetAttribute("client.address", addr.String())
+
 		resp, err := s.offerPXE(pkt, serverIP, fwtype)
 		if err != nil {
 			s.log("PXE", "Failed to construct PXE offer for %s (%s): %s", pkt.HardwareAddr, addr, err)
+			span.SetError(err)
+			span.Finish()
 			continue
 		}
 
 		bs, err := resp.Marshal()
 		if err != nil {
 			s.log("PXE", "Failed to marshal PXE offer for %s (%s): %s", pkt.HardwareAddr, addr, err)
+			span.SetError(err)
+			span.Finish()
 			continue
 		}
 
@@ -90,7 +98,9 @@ func (s *Server) servePXE(conn net.PacketConn) error {
 			IfIndex: msg.IfIndex,
 		}, addr); err != nil {
 			s.log("PXE", "Failed to send PXE response to %s (%s): %s", pkt.HardwareAddr, addr, err)
+			span.SetError(err)
 		}
+		span.Finish()
 	}
 }
 
@@ -112,7 +122,7 @@ func (s *Server) validatePXE(pkt *dhcp4.Packet) (fwtype constants.Firmware, err
 		s.debug("PXE", pkt.DebugString())
 		return 0, fmt.Errorf("unsupported client firmware type '%d'", fwt)
 	}
-	if s.Ipxe[fwtype] == nil {
+	if bs, _ := s.firmware(fwtype); bs == nil && s.grubLoader(fwtype) == nil {
 		return 0, fmt.Errorf("unsupported client firmware type match ipxe '%d'", fwt)
 	}
 
@@ -141,7 +151,7 @@ func (s *Server) offerPXE(pkt *dhcp4.Packet, serverIP net.IP, fwtype constants.F
 		RelayAddr:      pkt.RelayAddr,
 		ServerAddr:     serverIP,
 		BootServerName: serverIP.String(),
-		BootFilename:   fmt.Sprintf("%s/%d", pkt.HardwareAddr, fwtype),
+		BootFilename:   s.tftpPath(pkt.HardwareAddr, fwtype),
 		Options: dhcp4.Options{
 			dhcp4.OptServerIdentifier: serverIP,
 			dhcp4.OptVendorIdentifier: []byte("PXEClient"),
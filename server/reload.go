@@ -0,0 +1,164 @@
+// Copyright 2024 Kairos contributors
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/kairos-io/netboot/booters"
+	"github.com/kairos-io/netboot/constants"
+	"github.com/kairos-io/netboot/types"
+	"sigs.k8s.io/yaml"
+)
+
+// DefaultReloadInterval is how often a Reloader checks its files for
+// changes, unless Reloader.Interval says otherwise.
+const DefaultReloadInterval = 2 * time.Second
+
+// A Reloader keeps a Server's boot spec and iPXE binaries in sync with
+// files on disk, swapping them in with SetBooter and SetFirmware
+// whenever they change.
+//
+// Machines that are in the middle of booting when a change is picked
+// up carry on with the new files: StaticBooter file IDs don't change
+// when the spec does.
+type Reloader struct {
+	// SpecPath is a YAML or JSON types.Spec, served to all machines
+	// with booters.StaticBooter. If empty, the Server's Booter is
+	// left alone.
+	SpecPath string
+	// FirmwarePaths maps firmware types to the iPXE binary to serve
+	// them. If empty, the Server's firmwares are left alone.
+	FirmwarePaths map[constants.Firmware]string
+	// Interval between checks for changes. If 0, uses
+	// DefaultReloadInterval.
+	Interval time.Duration
+
+	versions map[string]fileVersion
+}
+
+// fileVersion identifies the content of a file, without having to
+// read it.
+type fileVersion struct {
+	size    int64
+	modTime time.Time
+}
+
+// Load reads all the configured files and installs them into s.
+func (r *Reloader) Load(s *Server) error {
+	_, err := r.reload(s, true)
+	return err
+}
+
+// Watch installs the configured files into s, then keeps checking
+// them for changes until ctx is done.
+//
+// A file that fails to load is logged, and the Server keeps using the
+// previous version until the file is fixed.
+func (r *Reloader) Watch(ctx context.Context, s *Server) error {
+	if err := r.Load(s); err != nil {
+		return err
+	}
+	interval := r.Interval
+	if interval <= 0 {
+		interval = DefaultReloadInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+		changed, err := r.reload(s, false)
+		if err != nil {
+			s.log("Reload", "Keeping previous configuration: %s", err)
+		} else if changed {
+			s.log("Reload", "Reloaded boot configuration")
+		}
+	}
+}
+
+// reload installs the configured files into s if any of them changed
+// since the last call, or unconditionally if force is set.
+func (r *Reloader) reload(s *Server, force bool) (bool, error) {
+	var paths []string
+	if r.SpecPath != "" {
+		paths = append(paths, r.SpecPath)
+	}
+	for _, path := range r.FirmwarePaths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	versions := make(map[string]fileVersion, len(paths))
+	changed := force
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		v := fileVersion{fi.Size(), fi.ModTime()}
+		versions[path] = v
+		if r.versions[path] != v {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	// Build everything before installing anything, so that a broken
+	// file doesn't leave the Server half reloaded.
+	var booter types.Booter
+	if r.SpecPath != "" {
+		spec, err := LoadSpec(r.SpecPath)
+		if err != nil {
+			return false, err
+		}
+		if booter, err = booters.StaticBooter(spec); err != nil {
+			return false, fmt.Errorf("%s: %s", r.SpecPath, err)
+		}
+	}
+	var ipxe map[constants.Firmware][]byte
+	if len(r.FirmwarePaths) > 0 {
+		ipxe = make(map[constants.Firmware][]byte, len(r.FirmwarePaths))
+		for fw, path := range r.FirmwarePaths {
+			bs, err := os.ReadFile(path)
+			if err != nil {
+				return false, err
+			}
+			ipxe[fw] = bs
+		}
+	}
+
+	if booter != nil {
+		s.SetBooter(booter)
+	}
+	if ipxe != nil {
+		s.SetFirmware(ipxe)
+	}
+	r.versions = versions
+	return true, nil
+}
+
+// LoadSpec reads a types.Spec from a YAML or JSON file.
+func LoadSpec(path string) (*types.Spec, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var spec types.Spec
+	if err = yaml.UnmarshalStrict(bs, &spec); err != nil {
+		return nil, fmt.Errorf("parsing spec %s: %s", path, err)
+	}
+	if spec.Kernel == "" && spec.Efi == "" && len(spec.UKI) == 0 && spec.Menu == nil && spec.IpxeTemplate == "" {
+		return nil, fmt.Errorf("spec %s: one of kernel, efi, uki, menu or ipxe-template must be set", path)
+	}
+	return &spec, nil
+}
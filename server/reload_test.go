@@ -0,0 +1,72 @@
+// Copyright 2024 Kairos contributors
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kairos-io/netboot/constants"
+	"github.com/kairos-io/netboot/types"
+)
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	specPath := filepath.Join(dir, "spec.yaml")
+	fwPath := filepath.Join(dir, "ipxe.efi")
+	write := func(path, contents string, mtime time.Time) {
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	write(specPath, "kernel: /boot/vmlinuz\ncmdline: console=ttyS0\n", now)
+	write(fwPath, "ipxe v1", now)
+
+	s := &Server{}
+	r := &Reloader{
+		SpecPath:      specPath,
+		FirmwarePaths: map[constants.Firmware]string{constants.FirmwareEFI64: fwPath},
+	}
+	if err := r.Load(s); err != nil {
+		t.Fatalf("Initial load: %s", err)
+	}
+	spec, err := s.booter().BootSpec(types.Machine{})
+	if err != nil || spec.Cmdline != "console=ttyS0" {
+		t.Fatalf("Wrong initial spec %#v (%v)", spec, err)
+	}
+	if bs, _ := s.firmware(constants.FirmwareEFI64); string(bs) != "ipxe v1" {
+		t.Fatalf("Wrong initial firmware %q", bs)
+	}
+
+	// Nothing changed, nothing reloaded.
+	if changed, err := r.reload(s, false); changed || err != nil {
+		t.Fatalf("Reload without changes: changed=%v, err=%v", changed, err)
+	}
+
+	// A broken spec keeps the previous configuration.
+	write(specPath, "kernel: [", now.Add(time.Second))
+	if _, err = r.reload(s, false); err == nil {
+		t.Fatalf("Broken spec file loaded without error")
+	}
+	if spec, _ = s.booter().BootSpec(types.Machine{}); spec.Cmdline != "console=ttyS0" {
+		t.Fatalf("Broken spec replaced the previous one")
+	}
+
+	write(specPath, "kernel: /boot/vmlinuz\ncmdline: console=tty0\n", now.Add(2*time.Second))
+	write(fwPath, "ipxe v2", now.Add(2*time.Second))
+	if changed, err := r.reload(s, false); !changed || err != nil {
+		t.Fatalf("Reload after changes: changed=%v, err=%v", changed, err)
+	}
+	if spec, _ = s.booter().BootSpec(types.Machine{}); spec.Cmdline != "console=tty0" {
+		t.Fatalf("Spec wasn't reloaded, cmdline is %q", spec.Cmdline)
+	}
+	if bs, _ := s.firmware(constants.FirmwareEFI64); string(bs) != "ipxe v2" {
+		t.Fatalf("Firmware wasn't reloaded, got %q", bs)
+	}
+}
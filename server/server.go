@@ -16,21 +16,31 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kairos-io/netboot/assets"
 	"github.com/kairos-io/netboot/constants"
 	"github.com/kairos-io/netboot/dhcp4"
 	"github.com/kairos-io/netboot/dhcp6"
+	"github.com/kairos-io/netboot/tftp"
+	"github.com/kairos-io/netboot/tracing"
 	"github.com/kairos-io/netboot/types"
 )
 
 // A Server boots machines using a Booter.
 type Server struct {
+	// Booter decides what machines boot. Once Serve() is running,
+	// use SetBooter to change it.
 	Booter types.Booter
 
 	// Address to listen on, or empty for all interfaces.
@@ -38,9 +48,31 @@ type Server struct {
 	// HTTP port for boot services.
 	HTTPPort int
 
+	// TLSConfig, if set, also serves boot services over HTTPS on
+	// HTTPSPort, and points iPXE at that port instead of HTTPPort,
+	// so that boot scripts, cmdlines and files aren't sent in
+	// cleartext. iPXE must trust the server's certificate, e.g. by
+	// embedding its CA with TRUST= when building iPXE.
+	TLSConfig *tls.Config
+	// HTTPS port for boot services, when TLSConfig is set.
+	HTTPSPort int
+
 	// Ipxe lists the supported bootable Firmwares, and their
-	// associated ipxe binary.
+	// associated ipxe binary. Once Serve() is running, use
+	// SetFirmware to change it.
 	Ipxe map[constants.Firmware][]byte
+	// Grub boots machines with the given EFI Firmwares with GRUB
+	// (and optionally shim) instead of iPXE, see GrubLoader.
+	Grub map[constants.Firmware]*GrubLoader
+	// Loaders picks the boot chain, types.LoaderIpxe or
+	// types.LoaderGrub, of machines with the given EFI Firmwares,
+	// unless their Spec or LoaderPolicy says otherwise. Firmwares
+	// not listed boot GRUB if they have a GrubLoader, iPXE
+	// otherwise.
+	Loaders map[constants.Firmware]string
+	// LoaderPolicy, if set, picks the boot chain of machines whose
+	// Spec doesn't, or returns "" to use Loaders.
+	LoaderPolicy func(m types.Machine) string
 
 	// Log receives logs on Pixiecore's operation. If nil, logging
 	// is suppressed.
@@ -48,6 +80,10 @@ type Server struct {
 	// Debug receives extensive logging on Pixiecore's internals. Very
 	// useful for debugging, but very verbose.
 	Debug func(subsystem, msg string)
+	// SpanExporter receives a trace of each machine's boot, with one
+	// span per DHCP, PXE, TFTP and HTTP exchange. If nil, tracing is
+	// disabled.
+	SpanExporter tracing.Exporter
 	// These ports can technically be set for testing, but the
 	// protocols burned in firmware on the client side hardcode these,
 	// so if you change them in production, nothing will work.
@@ -65,26 +101,132 @@ type Server struct {
 	// assets. Used for development of Pixiecore.
 	UIAssetsDir string
 
+	// VerifyCacheDir is where boot files that have a digest or
+	// signature in their Spec are kept once verified, so that they
+	// are fetched and verified only once. If empty, a temporary
+	// directory is used, and removed when Serve returns.
+	VerifyCacheDir string
+	// VerifyLogOnly logs boot files that fail verification and
+	// serves them anyway, instead of refusing to serve them.
+	VerifyLogOnly bool
+
+	// FileTokenLifetime, if non-zero, protects boot files with
+	// tokens. Each iPXE script embeds a new token for the machine
+	// that asked for it in its file URLs, and /_/file only serves
+	// requests with a token that was issued less than
+	// FileTokenLifetime ago. It must be long enough for the booted OS
+	// to fetch the files its cmdline points at.
+	FileTokenLifetime time.Duration
+
+	// UploadMaxSize, if non-zero, accepts uploads of at most that
+	// many bytes at the URLs that the Upload function of cmdlines
+	// expands to, and passes them to the Booter's WriteBootFile.
+	// Uploads are authenticated with the same tokens as boot files,
+	// so FileTokenLifetime must be set too.
+	UploadMaxSize int64
+
+	// ShutdownTimeout is how long Serve lets in-flight transfers
+	// finish once its ctx is done, see Shutdown. If zero, it is
+	// DefaultShutdownTimeout.
+	ShutdownTimeout time.Duration
+
 	errs chan error
 
+	// Guards Booter and Ipxe, which can be swapped while serving.
+	configMu sync.RWMutex
+	// How many times Booter was swapped.
+	booterGen uint64
+
+	runMu sync.Mutex
+	run   *serverRun
+
+	inflightMu sync.Mutex
+	inflight   map[*http.Request]string
+
 	eventsMu sync.Mutex
 	events   map[string][]machineEvent
+
+	sessionsMu sync.Mutex
+	sessions   map[string]*bootSession
+
+	verify fileVerifier
+	tokens fileTokens
+	ukis   ukiCache
 }
 
+// DefaultShutdownTimeout is the default Server.ShutdownTimeout.
+const DefaultShutdownTimeout = 30 * time.Second
+
 // SetDefaultFirmwares sets the default bundled ipxe binaries for the server
 func (s *Server) SetDefaultFirmwares() {
-	s.Ipxe = map[constants.Firmware][]byte{}
-	s.Ipxe[constants.FirmwareX86PC] = assets.MustAsset("undionly.kpxe")
-	s.Ipxe[constants.FirmwareEFI32] = assets.MustAsset("i386.ipxe.efi")
-	s.Ipxe[constants.FirmwareEFI64] = assets.MustAsset("amd64.ipxe.efi")
-	s.Ipxe[constants.FirmwareEFIBC] = assets.MustAsset("amd64.ipxe.efi")
-	s.Ipxe[constants.FirmwareEfiArm64] = assets.MustAsset("arm64.ipxe.efi")
-	s.Ipxe[constants.FirmwareX86Ipxe] = assets.MustAsset("ipxe.pxe")
+	s.SetFirmware(DefaultFirmwares())
+}
+
+// DefaultFirmwares returns the bundled ipxe binaries.
+func DefaultFirmwares() map[constants.Firmware][]byte {
+	return map[constants.Firmware][]byte{
+		constants.FirmwareX86PC:    assets.MustAsset("undionly.kpxe"),
+		constants.FirmwareEFI32:    assets.MustAsset("i386.ipxe.efi"),
+		constants.FirmwareEFI64:    assets.MustAsset("amd64.ipxe.efi"),
+		constants.FirmwareEFIBC:    assets.MustAsset("amd64.ipxe.efi"),
+		constants.FirmwareEfiArm64: assets.MustAsset("arm64.ipxe.efi"),
+		constants.FirmwareX86Ipxe:  assets.MustAsset("ipxe.pxe"),
+	}
+}
+
+// SetBooter atomically replaces the server's Booter. It is safe to
+// call while the server is running: requests already being handled
+// finish with the previous Booter, new ones use b.
+func (s *Server) SetBooter(b types.Booter) {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	s.Booter = b
+	s.booterGen++
+}
+
+// SetFirmware atomically replaces the server's iPXE binaries. It is
+// safe to call while the server is running. The server keeps a copy
+// of ipxe, later changes to the map have no effect.
+func (s *Server) SetFirmware(ipxe map[constants.Firmware][]byte) {
+	m := make(map[constants.Firmware][]byte, len(ipxe))
+	for k, v := range ipxe {
+		m[k] = v
+	}
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	s.Ipxe = m
+}
+
+func (s *Server) booter() types.Booter {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.Booter
+}
+
+// booterGeneration returns the server's Booter, and how many times it
+// was swapped, so that what the server remembers of the Specs of one
+// Booter isn't used with the next.
+func (s *Server) booterGeneration() (types.Booter, uint64) {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.Booter, s.booterGen
+}
+
+func (s *Server) firmware(fwtype constants.Firmware) ([]byte, bool) {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	bs, ok := s.Ipxe[fwtype]
+	return bs, ok
 }
 
 // Serve listens for machines attempting to boot, and uses Booter to
 // help them.
-func (s *Server) Serve() error {
+//
+// Serve runs until a fatal error occurs, Shutdown completes, or ctx
+// is done. Once ctx is done, Serve shuts down like Shutdown, giving
+// in-flight transfers up to ShutdownTimeout to finish, and returns
+// ctx.Err().
+func (s *Server) Serve(ctx context.Context) error {
 	if s.DHCPPort == 0 {
 		s.DHCPPort = constants.PortDHCP
 	}
@@ -97,6 +239,9 @@ func (s *Server) Serve() error {
 	if s.HTTPPort == 0 {
 		s.HTTPPort = constants.PortHTTP
 	}
+	if s.HTTPSPort == 0 {
+		s.HTTPSPort = constants.PortHTTPS
+	}
 
 	newDHCP := dhcp4.NewConn
 	if s.DHCPNoBind {
@@ -128,37 +273,177 @@ func (s *Server) Serve() error {
 		pxe.Close()
 		return err
 	}
+	var https net.Listener
+	if s.TLSConfig != nil {
+		l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.Address, s.HTTPSPort))
+		if err != nil {
+			dhcp.Close()
+			tftp.Close()
+			pxe.Close()
+			http.Close()
+			return err
+		}
+		https = tls.NewListener(l, s.TLSConfig.Clone())
+	}
 
 	s.events = make(map[string][]machineEvent)
-	// 5 buffer slots, one for each goroutine, plus one for
+	// One buffer slot for each goroutine, plus one for
 	// Shutdown(). We only ever pull the first error out, but shutdown
 	// will likely generate some spurious errors from the other
 	// goroutines, and we want them to be able to dump them without
 	// blocking.
-	s.errs = make(chan error, 6)
+	s.errs = make(chan error, 7)
+
+	s.runMu.Lock()
+	s.run = &serverRun{
+		dhcp: dhcp,
+		pxe:  pxe,
+		tftp: s.tftpServer(),
+		http: s.httpServer(),
+	}
+	run := s.run
+	if https != nil {
+		run.https = s.httpServer()
+	}
+	s.runMu.Unlock()
 
 	s.debug("Init", "Starting Pixiecore goroutines")
 
-	go func() { s.errs <- s.serveDHCP(dhcp) }()
-	go func() { s.errs <- s.servePXE(pxe) }()
-	go func() { s.errs <- s.serveTFTP(tftp) }()
-	go func() { s.errs <- serveHTTP(http, s.serveHTTP) }()
+	go func() { s.fail(run, s.serveDHCP(dhcp)) }()
+	go func() { s.fail(run, s.servePXE(pxe)) }()
+	go func() { s.fail(run, s.serveTFTP(run.tftp, tftp)) }()
+	go func() { s.fail(run, serveHTTP(run.http, http)) }()
+	if https != nil {
+		s.debug("HTTP", "Listening for HTTPS requests on %s:%d", s.Address, s.HTTPSPort)
+		go func() { s.fail(run, serveHTTP(run.https, https)) }()
+	}
 
-	// Wait for either a fatal error, or Shutdown().
-	err = <-s.errs
+	// Wait for either a fatal error, Shutdown() or the context to
+	// end.
+	select {
+	case err = <-s.errs:
+	case <-ctx.Done():
+		timeout := s.ShutdownTimeout
+		if timeout == 0 {
+			timeout = DefaultShutdownTimeout
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		// Shutdown logs the transfers it cuts off.
+		s.Shutdown(shutdownCtx)
+		cancel()
+		err = ctx.Err()
+	}
 	dhcp.Close()
 	tftp.Close()
 	pxe.Close()
-	http.Close()
+	run.http.Close()
+	if run.https != nil {
+		run.https.Close()
+	}
+	s.verify.cleanup()
+
+	s.runMu.Lock()
+	s.run = nil
+	s.runMu.Unlock()
 	return err
 }
 
-// Shutdown causes Serve() to exit, cleaning up behind itself.
-func (s *Server) Shutdown() {
+// serverRun holds the sockets and servers of a running Serve().
+type serverRun struct {
+	dhcp *dhcp4.Conn
+	pxe  net.PacketConn
+	tftp *tftp.Server
+	http *http.Server
+	// Nil unless serving HTTPS.
+	https *http.Server
+
+	// Set once Shutdown() starts closing sockets, so that the errors
+	// it causes in the serving goroutines aren't mistaken for
+	// failures.
+	stopping atomic.Bool
+}
+
+// fail reports the exit of one of the serving goroutines.
+func (s *Server) fail(run *serverRun, err error) {
+	if run.stopping.Load() {
+		return
+	}
+	s.errs <- err
+}
+
+// Shutdown gracefully stops Serve(). It immediately stops answering
+// DHCP, PXE, TFTP and HTTP requests, then waits for in-flight TFTP
+// transfers and HTTP responses to complete.
+//
+// If ctx is done before all transfers completed, the remaining ones
+// are cut off, and Shutdown returns an error listing them. Serve()
+// returns once Shutdown is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.runMu.Lock()
+	run := s.run
+	s.runMu.Unlock()
+	if run == nil {
+		return nil
+	}
+	run.stopping.Store(true)
+
+	s.log("Init", "Shutting down, waiting for in-flight transfers")
+	run.dhcp.Close()
+	run.pxe.Close()
+
+	var (
+		wg                         sync.WaitGroup
+		tftpErr, httpErr, httpsErr error
+		cutOffOnce                 sync.Once
+		cutOff                     []string
+	)
+	// Shuts down srv, noting the responses it has to cut off.
+	shutdownHTTP := func(srv *http.Server) error {
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			cutOffOnce.Do(func() { cutOff = s.inflightHTTP() })
+			srv.Close()
+		}
+		return err
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		tftpErr = run.tftp.Shutdown(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		httpErr = shutdownHTTP(run.http)
+	}()
+	if run.https != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			httpsErr = shutdownHTTP(run.https)
+		}()
+	}
+	wg.Wait()
+	if httpErr == nil {
+		httpErr = httpsErr
+	}
+
+	var errs []error
+	if tftpErr != nil {
+		errs = append(errs, tftpErr)
+	}
+	if httpErr != nil {
+		errs = append(errs, fmt.Errorf("aborted %d in-flight HTTP responses: %s", len(cutOff), strings.Join(cutOff, ", ")))
+	}
+	err := errors.Join(errs...)
+	if err != nil {
+		s.log("Init", "Shutdown cut off transfers: %s", err)
+	}
+
 	select {
 	case s.errs <- nil:
 	default:
 	}
+	return err
 }
 
 // ServerV6 boots machines using a Booter.
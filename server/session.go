@@ -0,0 +1,161 @@
+// Copyright 2024 Kairos contributors
+
+package server
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/kairos-io/netboot/tracing"
+	"github.com/kairos-io/netboot/types"
+)
+
+// sessionTimeout is how long a boot session stays open without
+// hearing from the machine. A machine that shows up again after that
+// is considered to be starting a new boot.
+const sessionTimeout = 10 * time.Minute
+
+// A bootSession ties together all the requests a machine makes over
+// DHCP, PXE, TFTP and HTTP in the course of one boot.
+type bootSession struct {
+	id       tracing.TraceID
+	root     *tracing.Span
+	lastSeen time.Time
+
+	// The machine's identity, as learned over DHCP. HTTP requests
+	// only tell us the MAC address and architecture.
+	machine types.Machine
+	// The boot chain chosen for the machine's EFI firmware, see
+	// chooseLoader.
+	loader string
+}
+
+// startSession returns the boot session for mach, starting a new one
+// keyed by the DHCP transaction xid if the machine doesn't have a
+// live session already.
+//
+// A single boot goes through several DHCP transactions (the firmware's
+// and then iPXE's), they all join the session opened by the first one.
+func (s *Server) startSession(mach types.Machine, xid []byte) *bootSession {
+	now := time.Now()
+	mac := mach.MAC
+	k := mac.String()
+
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[string]*bootSession)
+	}
+	s.expireSessions(now)
+	if sess := s.sessions[k]; sess != nil {
+		sess.lastSeen = now
+		// iPXE doesn't always send the identifiers the firmware
+		// did, keep the ones we already know.
+		if sess.machine.GUID == nil {
+			sess.machine.GUID = mach.GUID
+		}
+		if sess.machine.VendorClass == "" {
+			sess.machine.VendorClass = mach.VendorClass
+		}
+		if sess.machine.Hostname == "" {
+			sess.machine.Hostname = mach.Hostname
+		}
+		// The rest describes the latest request.
+		sess.machine.Arch = mach.Arch
+		sess.machine.Firmware = mach.Firmware
+		sess.machine.RelayAddr = mach.RelayAddr
+		sess.machine.Interface = mach.Interface
+		return sess
+	}
+
+	id := tracing.NewTraceID(mac, xid, now)
+	sess := &bootSession{
+		id:       id,
+		root:     tracing.StartSpan(s.SpanExporter, id, "boot"),
+		lastSeen: now,
+		machine:  mach,
+	}
+	sess.root.SetAttribute("hw.mac", k)
+	s.sessions[k] = sess
+	return sess
+}
+
+// session returns the live boot session of mac, or nil. If id is
+// not empty, it must match the session's ID. If mac is nil, the
+// session is looked up by id alone.
+func (s *Server) session(mac net.HardwareAddr, id string) *bootSession {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	var sess *bootSession
+	if mac != nil {
+		sess = s.sessions[mac.String()]
+	} else if id != "" {
+		for _, v := range s.sessions {
+			if v.id.String() == id {
+				sess = v
+				break
+			}
+		}
+	}
+	if sess == nil || (id != "" && sess.id.String() != id) {
+		return nil
+	}
+	sess.lastSeen = time.Now()
+	return sess
+}
+
+// endSession finishes the boot session of mac, if it has one.
+func (s *Server) endSession(mac net.HardwareAddr) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	k := mac.String()
+	if sess := s.sessions[k]; sess != nil {
+		sess.root.Finish()
+		delete(s.sessions, k)
+	}
+}
+
+// expireSessions finishes the sessions that timed out before
+// now. Must be called with sessionsMu held.
+func (s *Server) expireSessions(now time.Time) {
+	for k, sess := range s.sessions {
+		if now.Sub(sess.lastSeen) > sessionTimeout {
+			sess.root.SetError(errors.New("machine stopped booting"))
+			sess.root.Finish()
+			delete(s.sessions, k)
+		}
+	}
+}
+
+// span starts a span named name in the session, or returns nil if
+// there is no session.
+func (sess *bootSession) span(name string) *tracing.Span {
+	if sess == nil {
+		return nil
+	}
+	return sess.root.StartChild(name)
+}
+
+// identify fills in the parts of mach's identity and network
+// context that were learned over DHCP earlier in the session.
+func (sess *bootSession) identify(mach *types.Machine) {
+	if sess == nil {
+		return
+	}
+	mach.GUID = sess.machine.GUID
+	mach.VendorClass = sess.machine.VendorClass
+	mach.Hostname = sess.machine.Hostname
+	mach.Firmware = sess.machine.Firmware
+	mach.RelayAddr = sess.machine.RelayAddr
+	mach.Interface = sess.machine.Interface
+}
+
+// sessionParam returns the session ID to embed in boot URLs, or an empty
+// string if tracing is disabled.
+func (s *Server) sessionParam(sess *bootSession) string {
+	if sess == nil || s.SpanExporter == nil {
+		return ""
+	}
+	return sess.id.String()
+}
@@ -27,65 +27,134 @@ import (
 
 	"github.com/kairos-io/netboot/constants"
 	"github.com/kairos-io/netboot/tftp"
+	"github.com/kairos-io/netboot/tracing"
+	"github.com/kairos-io/netboot/types"
 )
 
-func (s *Server) serveTFTP(l net.PacketConn) error {
-	s.debug("TFTP", "Listening for TFTP requests on %s:%d", s.Address, s.TFTPPort)
-	ts := tftp.Server{
+func (s *Server) tftpServer() *tftp.Server {
+	return &tftp.Server{
 		Handler:     s.handleTFTP,
 		InfoLog:     func(msg string) { s.debug("TFTP", msg) },
 		TransferLog: s.logTFTPTransfer,
 	}
+}
+
+func (s *Server) serveTFTP(ts *tftp.Server, l net.PacketConn) error {
+	s.debug("TFTP", "Listening for TFTP requests on %s:%d", s.Address, s.TFTPPort)
 	err := ts.Serve(l)
-	if err != nil {
+	if err != nil && err != tftp.ErrServerClosed {
 		return fmt.Errorf("TFTP server shut down: %s", err)
 	}
 	return nil
 }
 
-func extractInfo(path string) (net.HardwareAddr, int, error) {
+// tftpPath returns the TFTP filename from which the machine mac gets
+// the iPXE binary for fwtype, or the first stage of its GrubLoader.
+func (s *Server) tftpPath(mac net.HardwareAddr, fwtype constants.Firmware) string {
+	id := s.sessionParam(s.session(mac, ""))
+	if s.grubLoader(fwtype) != nil && s.sessionLoader(mac, fwtype) == types.LoaderGrub {
+		return grubTFTPPath(mac, fwtype, id)
+	}
+	if id != "" {
+		return fmt.Sprintf("%s/%d/%s", mac, fwtype, id)
+	}
+	return fmt.Sprintf("%s/%d", mac, fwtype)
+}
+
+// extractInfo parses a path built by tftpPath.
+func extractInfo(path string) (net.HardwareAddr, int, string, error) {
 	pathElements := strings.Split(path, "/")
-	if len(pathElements) != 2 {
-		return nil, 0, errors.New("not found")
+	if len(pathElements) != 2 && len(pathElements) != 3 {
+		return nil, 0, "", errors.New("not found")
 	}
 
 	mac, err := net.ParseMAC(pathElements[0])
 	if err != nil {
-		return nil, 0, fmt.Errorf("invalid MAC address %q", pathElements[0])
+		return nil, 0, "", fmt.Errorf("invalid MAC address %q", pathElements[0])
 	}
 
 	i, err := strconv.Atoi(pathElements[1])
 	if err != nil {
-		return nil, 0, errors.New("not found")
+		return nil, 0, "", errors.New("not found")
+	}
+
+	var session string
+	if len(pathElements) == 3 {
+		session = pathElements[2]
 	}
 
-	return mac, i, nil
+	return mac, i, session, nil
 }
 
 func (s *Server) logTFTPTransfer(clientAddr net.Addr, path string, err error) {
-	mac, _, pathErr := extractInfo(path)
+	what := "iPXE"
+	mac, _, _, pathErr := extractInfo(path)
+	if pathErr != nil {
+		var name string
+		if mac, _, _, name, pathErr = extractGrubInfo(path); pathErr == nil {
+			what = name
+		} else if isGrubConfig(path) {
+			mac, what, pathErr = nil, "grub.cfg", nil
+		}
+	}
 	if pathErr != nil {
 		s.log("TFTP", "unable to extract mac from request:%v", pathErr)
 		return
 	}
 	if err != nil {
 		s.log("TFTP", "Send of %q to %s failed: %s", path, clientAddr, err)
+	} else if mac == nil {
+		s.log("TFTP", "Sent %q to %s", path, clientAddr)
 	} else {
 		s.log("TFTP", "Sent %q to %s", mac.String(), clientAddr)
-		s.machineEvent(mac, machineStateTFTP, "Sent iPXE to %s", clientAddr)
+		s.machineEvent(mac, machineStateTFTP, "Sent %s to %s", what, clientAddr)
 	}
 }
 
 func (s *Server) handleTFTP(path string, clientAddr net.Addr) (io.ReadCloser, int64, error) {
-	_, i, err := extractInfo(path)
+	if strings.HasPrefix(path, "grub/") || isGrubConfig(path) {
+		return s.handleGrubTFTP(path, clientAddr)
+	}
+	mac, i, session, err := extractInfo(path)
 	if err != nil {
 		return nil, 0, fmt.Errorf("unknown path %q", path)
 	}
 
-	bs, ok := s.Ipxe[constants.Firmware(i)]
+	span := s.session(mac, session).span("tftp.transfer")
+	span.SetAttribute("tftp.path", path)
+	span.SetAttribute("client.address", clientAddr.String())
+
+	bs, ok := s.firmware(constants.Firmware(i))
 	if !ok {
-		return nil, 0, fmt.Errorf("unknown firmware type %d", i)
+		err = fmt.Errorf("unknown firmware type %d", i)
+		span.SetError(err)
+		span.Finish()
+		return nil, 0, err
 	}
 
-	return ioutil.NopCloser(bytes.NewBuffer(bs)), int64(len(bs)), nil
+	return &tracedReader{ReadCloser: ioutil.NopCloser(bytes.NewBuffer(bs)), span: span, size: int64(len(bs))}, int64(len(bs)), nil
+}
+
+// tracedReader finishes span when the transfer of a file is done,
+// recording how much of it was actually read.
+type tracedReader struct {
+	io.ReadCloser
+	span *tracing.Span
+	size int64
+	n    int64
+}
+
+func (r *tracedReader) Read(bs []byte) (int, error) {
+	n, err := r.ReadCloser.Read(bs)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *tracedReader) Close() error {
+	r.span.SetAttribute("transfer.bytes", strconv.FormatInt(r.n, 10))
+	if r.size >= 0 && r.n < r.size {
+		r.span.SetError(fmt.Errorf("transfer interrupted after %d of %d bytes", r.n, r.size))
+	}
+	r.span.Finish()
+	return r.ReadCloser.Close()
 }
@@ -0,0 +1,67 @@
+// Copyright 2024 Kairos contributors
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// fileTokens are the tokens that authorize downloads from /_/file.
+// Each iPXE script gets a new token for the machine that asked for
+// it, which replaces the machine's previous one.
+type fileTokens struct {
+	mu     sync.Mutex
+	tokens map[string]*fileToken
+}
+
+type fileToken struct {
+	mac     net.HardwareAddr
+	expires time.Time
+}
+
+// issue returns a new token for mac, valid for lifetime.
+func (t *fileTokens) issue(mac net.HardwareAddr, lifetime time.Duration) (string, error) {
+	var bs [16]byte
+	if _, err := rand.Read(bs[:]); err != nil {
+		return "", err
+	}
+	tok := base64.RawURLEncoding.EncodeToString(bs[:])
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tokens == nil {
+		t.tokens = map[string]*fileToken{}
+	}
+	for k, v := range t.tokens {
+		if now.After(v.expires) || v.mac.String() == mac.String() {
+			delete(t.tokens, k)
+		}
+	}
+	t.tokens[tok] = &fileToken{mac: mac, expires: now.Add(lifetime)}
+	return tok, nil
+}
+
+// check returns the MAC address that tok was issued to, or an error if
+// tok isn't a live token.
+func (t *fileTokens) check(tok string) (net.HardwareAddr, error) {
+	if tok == "" {
+		return nil, errors.New("missing file token")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v := t.tokens[tok]
+	switch {
+	case v == nil:
+		return nil, errors.New("unknown file token")
+	case time.Now().After(v.expires):
+		delete(t.tokens, tok)
+		return nil, errors.New("expired file token")
+	}
+	return v.mac, nil
+}
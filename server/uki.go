@@ -0,0 +1,297 @@
+// Copyright 2024 Kairos contributors
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"debug/pe"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kairos-io/netboot/constants"
+	"github.com/kairos-io/netboot/types"
+)
+
+// maxCachedUKIs bounds ukiCache, which drops the least recently used
+// entry when it gets full.
+const maxCachedUKIs = 64
+
+// ukiInfo is what a Unified Kernel Image says about itself in its PE
+// header and sections.
+type ukiInfo struct {
+	arch constants.Architecture
+	// The embedded cmdline, from the .cmdline section.
+	cmdline string
+	// The PRETTY_NAME of the embedded os-release, from the .osrel
+	// section, or empty.
+	osRelease string
+}
+
+// ukiCache remembers the ukiInfo of UKIs by ukiKey, so that each is
+// only inspected once.
+type ukiCache struct {
+	mu sync.Mutex
+	// Of ukiCacheEntry, most recently used first.
+	lru   list.List
+	infos map[string]*list.Element
+}
+
+type ukiCacheEntry struct {
+	key  string
+	info *ukiInfo
+}
+
+func (c *ukiCache) get(key string) *ukiInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem := c.infos[key]
+	if elem == nil {
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*ukiCacheEntry).info
+}
+
+func (c *ukiCache) put(key string, info *ukiInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.infos == nil {
+		c.infos = map[string]*list.Element{}
+	}
+	if elem := c.infos[key]; elem != nil {
+		elem.Value.(*ukiCacheEntry).info = info
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.infos[key] = c.lru.PushFront(&ukiCacheEntry{key, info})
+	if c.lru.Len() > maxCachedUKIs {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.infos, oldest.Value.(*ukiCacheEntry).key)
+	}
+}
+
+// hasUKI reports whether spec or one of its menu entries boots a UKI.
+func hasUKI(spec *types.Spec) bool {
+	if len(spec.UKI) > 0 {
+		return true
+	}
+	if spec.Menu != nil {
+		for i := range spec.Menu.Entries {
+			if hasUKI(&spec.Menu.Entries[i].Spec) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolveUKI returns spec, or a copy of it that boots the UKI of spec
+// (or of its menu entries) built for mach's architecture as Efi.
+func (s *Server) resolveUKI(mach types.Machine, spec *types.Spec) (*types.Spec, error) {
+	if spec.Menu != nil {
+		var ret *types.Spec
+		for i := range spec.Menu.Entries {
+			entry, err := s.resolveUKI(mach, &spec.Menu.Entries[i].Spec)
+			if err != nil {
+				return nil, fmt.Errorf("menu entry %q: %s", spec.Menu.Entries[i].Name, err)
+			}
+			if entry == &spec.Menu.Entries[i].Spec {
+				continue
+			}
+			if ret == nil {
+				cp := *spec
+				cp.Menu = &types.Menu{Default: spec.Menu.Default, Timeout: spec.Menu.Timeout}
+				cp.Menu.Entries = append([]types.MenuEntry(nil), spec.Menu.Entries...)
+				ret = &cp
+			}
+			ret.Menu.Entries[i].Spec = *entry
+		}
+		if ret == nil {
+			return spec, nil
+		}
+		return ret, nil
+	}
+	if len(spec.UKI) == 0 {
+		return spec, nil
+	}
+	if spec.Kernel != "" || spec.Efi != "" {
+		return nil, errors.New("spec has both UKIs and a kernel or EFI image")
+	}
+
+	for _, id := range spec.UKI {
+		info, err := s.ukiInfo(mach.MAC, id)
+		if err != nil {
+			return nil, fmt.Errorf("UKI %q: %s", id, err)
+		}
+		if info.arch != mach.Arch {
+			continue
+		}
+		ret := *spec
+		ret.UKI = nil
+		ret.Efi = id
+		// The UKI only gets its embedded cmdline if it's given no
+		// load options, so pass it along with the additions.
+		if info.cmdline != "" {
+			ret.Cmdline = strings.TrimSpace("{{ " + strconv.Quote(info.cmdline) + " }} " + spec.Cmdline)
+			if spec.Cmdline != "" {
+				s.log("HTTP", "UKI %q for %s embeds a cmdline, under Secure Boot it ignores the additions %q", id, mach.MAC, spec.Cmdline)
+			}
+		}
+		osRelease := info.osRelease
+		if osRelease == "" {
+			osRelease = "an unknown OS"
+		}
+		s.log("HTTP", "Booting %s with UKI %q of %s, embedded cmdline %q", mach.MAC, id, osRelease, info.cmdline)
+		return &ret, nil
+	}
+	return nil, fmt.Errorf("no UKI for architecture %s", mach.Arch)
+}
+
+// ukiInfo returns the ukiInfo of the UKI with ID id in the Spec of
+// mac. It's verified like when mac fetches it.
+func (s *Server) ukiInfo(mac net.HardwareAddr, id types.ID) (*ukiInfo, error) {
+	e := s.fileExpectation(mac, id)
+	key, err := s.ukiKey(id, e)
+	if err != nil {
+		return nil, err
+	}
+	if info := s.ukis.get(key); info != nil {
+		return info, nil
+	}
+	var f io.ReadCloser
+	if e != nil {
+		f, _, err = s.readVerifiedFile(id, e)
+	} else {
+		f, _, err = s.booter().ReadBootFile(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, ok := f.(io.ReaderAt)
+	if !ok {
+		// Remote files have to be spooled, debug/pe needs to seek.
+		tmp, err := os.CreateTemp("", "netboot-uki-*")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if _, err = io.Copy(tmp, f); err != nil {
+			return nil, err
+		}
+		r = tmp
+	}
+	info, err := inspectUKI(r)
+	if err != nil {
+		return nil, err
+	}
+	s.ukis.put(key, info)
+	return info, nil
+}
+
+// ukiKey returns the key in ukiCache of the UKI with ID id, which must
+// match e: its digest or signature if it has one, else the name that
+// the Booter gives the file, since IDs can differ from one Spec to the
+// next. Booters can serve other content under the same name once
+// swapped, so names are only valid for the current one.
+func (s *Server) ukiKey(id types.ID, e *fileExpectation) (string, error) {
+	switch {
+	case e != nil && e.sha256 != "":
+		return "sha256:" + e.sha256, nil
+	case e != nil:
+		return "signed:" + e.signedKey(), nil
+	}
+	b, gen := s.booterGeneration()
+	name := string(id)
+	if n, ok := b.(types.FileNamer); ok {
+		var err error
+		if name, err = n.FileName(id); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("name:%d:%s", gen, name), nil
+}
+
+// inspectUKI parses the PE binary in r as a Unified Kernel Image.
+func inspectUKI(r io.ReaderAt) (*ukiInfo, error) {
+	f, err := pe.NewFile(r)
+	if err != nil {
+		return nil, fmt.Errorf("not an EFI binary: %s", err)
+	}
+	defer f.Close()
+	if f.Section(".linux") == nil {
+		return nil, errors.New("not a UKI, it has no .linux section")
+	}
+
+	ret := &ukiInfo{}
+	switch f.Machine {
+	case pe.IMAGE_FILE_MACHINE_I386:
+		ret.arch = constants.ArchIA32
+	case pe.IMAGE_FILE_MACHINE_AMD64:
+		ret.arch = constants.ArchX64
+	case pe.IMAGE_FILE_MACHINE_ARM64:
+		ret.arch = constants.ArchArm64
+	default:
+		return nil, fmt.Errorf("unsupported machine type %#x", f.Machine)
+	}
+	section := func(name string) (string, error) {
+		sec := f.Section(name)
+		if sec == nil {
+			return "", nil
+		}
+		bs, err := sec.Data()
+		if err != nil {
+			return "", fmt.Errorf("reading %s section: %s", name, err)
+		}
+		// Sections are padded with zeros to their aligned size.
+		if sec.VirtualSize > 0 && int(sec.VirtualSize) < len(bs) {
+			bs = bs[:sec.VirtualSize]
+		}
+		return strings.TrimSpace(string(bytes.TrimRight(bs, "\x00"))), nil
+	}
+	if ret.cmdline, err = section(".cmdline"); err != nil {
+		return nil, err
+	}
+	if strings.Contains(ret.cmdline, "\n") {
+		ret.cmdline = strings.Join(strings.Fields(ret.cmdline), " ")
+	}
+	osrel, err := section(".osrel")
+	if err != nil {
+		return nil, err
+	}
+	ret.osRelease = prettyName(osrel)
+	return ret, nil
+}
+
+// prettyName returns the PRETTY_NAME of an os-release file, or its
+// NAME if it has none.
+func prettyName(osrel string) string {
+	vars := map[string]string{}
+	sc := bufio.NewScanner(strings.NewReader(osrel))
+	for sc.Scan() {
+		k, v, ok := strings.Cut(strings.TrimSpace(sc.Text()), "=")
+		if !ok || strings.HasPrefix(k, "#") {
+			continue
+		}
+		if uq, err := strconv.Unquote(v); err == nil {
+			v = uq
+		} else {
+			v = strings.Trim(v, `'"`)
+		}
+		vars[k] = v
+	}
+	if vars["PRETTY_NAME"] != "" {
+		return vars["PRETTY_NAME"]
+	}
+	return vars["NAME"]
+}
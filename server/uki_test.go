@@ -0,0 +1,266 @@
+// Copyright 2024 Kairos contributors
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/pe"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kairos-io/netboot/constants"
+	"github.com/kairos-io/netboot/types"
+)
+
+// makeUKI returns a minimal PE binary for machine, with the given
+// sections.
+func makeUKI(t *testing.T, machine uint16, sections map[string]string) []byte {
+	names := []string{".linux", ".cmdline", ".osrel"}
+	var b bytes.Buffer
+	b.Write([]byte("MZ"))
+	b.Write(make([]byte, 0x3a))
+	binary.Write(&b, binary.LittleEndian, uint32(0x40))
+	b.Write([]byte("PE\x00\x00"))
+	var n uint16
+	for _, name := range names {
+		if _, ok := sections[name]; ok {
+			n++
+		}
+	}
+	binary.Write(&b, binary.LittleEndian, pe.FileHeader{Machine: machine, NumberOfSections: n})
+	data := uint32(b.Len()) + uint32(n)*40
+	var raw bytes.Buffer
+	for _, name := range names {
+		content, ok := sections[name]
+		if !ok {
+			continue
+		}
+		hdr := pe.SectionHeader32{
+			VirtualSize:      uint32(len(content)),
+			SizeOfRawData:    uint32(len(content)) + 8,
+			PointerToRawData: data + uint32(raw.Len()),
+		}
+		copy(hdr.Name[:], name)
+		if err := binary.Write(&b, binary.LittleEndian, hdr); err != nil {
+			t.Fatalf("Writing section header: %s", err)
+		}
+		// With the zero padding of real UKIs.
+		raw.WriteString(content + "\x00\x00\x00\x00\x00\x00\x00\x00")
+	}
+	b.Write(raw.Bytes())
+	return b.Bytes()
+}
+
+type ukiBooter struct {
+	spec  *types.Spec
+	files map[types.ID][]byte
+}
+
+func (b ukiBooter) BootSpec(m types.Machine) (*types.Spec, error) { return b.spec, nil }
+func (b ukiBooter) ReadBootFile(id types.ID) (io.ReadCloser, int64, error) {
+	bs, ok := b.files[id]
+	if !ok {
+		return nil, -1, errors.New("no")
+	}
+	return io.NopCloser(bytes.NewReader(bs)), int64(len(bs)), nil
+}
+func (b ukiBooter) WriteBootFile(id types.ID, r io.Reader) error { return errors.New("no") }
+
+func TestInspectUKI(t *testing.T) {
+	info, err := inspectUKI(bytes.NewReader(makeUKI(t, pe.IMAGE_FILE_MACHINE_ARM64, map[string]string{
+		".linux":   "kernel",
+		".cmdline": "root=/dev/sda1\nquiet\n",
+		".osrel":   "NAME=Foo\nPRETTY_NAME=\"Foo Linux 1.0\"\n",
+	})))
+	if err != nil {
+		t.Fatalf("Inspecting UKI: %s", err)
+	}
+	if info.arch != constants.ArchArm64 || info.cmdline != "root=/dev/sda1 quiet" || info.osRelease != "Foo Linux 1.0" {
+		t.Fatalf("Wrong UKI info: %#v", info)
+	}
+
+	if _, err = inspectUKI(bytes.NewReader(makeUKI(t, pe.IMAGE_FILE_MACHINE_AMD64, map[string]string{".cmdline": "quiet"}))); err == nil {
+		t.Fatalf("EFI binary without a .linux section was accepted as a UKI")
+	}
+	if _, err = inspectUKI(bytes.NewReader([]byte("not a PE binary"))); err == nil {
+		t.Fatalf("Garbage was accepted as a UKI")
+	}
+}
+
+func TestIpxeUKI(t *testing.T) {
+	b := ukiBooter{
+		spec: &types.Spec{
+			UKI:     []types.ID{"arm", "x86"},
+			Initrd:  []types.ID{"addon"},
+			Cmdline: `conf={{ ID "c" }}`,
+		},
+		files: map[types.ID][]byte{
+			"arm": makeUKI(t, pe.IMAGE_FILE_MACHINE_ARM64, map[string]string{".linux": "k", ".cmdline": "console=ttyAMA0"}),
+			"x86": makeUKI(t, pe.IMAGE_FILE_MACHINE_AMD64, map[string]string{".linux": "k", ".cmdline": `console=ttyS0 "x"`}),
+		},
+	}
+	s := &Server{
+		Booter: b,
+		events: make(map[string][]machineEvent),
+	}
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=1", nil)
+	if err != nil {
+		t.Fatalf("Constructing ipxe request: %s", err)
+	}
+	req.Host = "localhost:1234"
+	s.handleIpxe(rr, req)
+	if rr.Code != 200 {
+		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
+	}
+	expected := `#!ipxe
+kernel --name efi http://localhost:1234/_/file?name=x86&type=efi&mac=01%3A02%3A03%3A04%3A05%3A06
+initrd --name initrd0 http://localhost:1234/_/file?name=addon&type=initrd&mac=01%3A02%3A03%3A04%3A05%3A06
+imgfetch --name ready http://localhost:1234/_/booting?mac=01%3A02%3A03%3A04%3A05%3A06 ||
+imgfree ready ||
+boot efi console=ttyS0 "x" conf=http://localhost:1234/_/file?name=c
+`
+	if rr.Body.String() != expected {
+		t.Fatalf("Wrong iPXE script\nwant: %s\ngot:  %s", expected, rr.Body.String())
+	}
+
+	// No UKI for 32-bit machines.
+	rr = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=0", nil)
+	if err != nil {
+		t.Fatalf("Constructing ipxe request: %s", err)
+	}
+	s.handleIpxe(rr, req)
+	if rr.Code != 500 {
+		t.Fatalf("Got HTTP %d for a machine without a UKI, expected 500", rr.Code)
+	}
+}
+
+func TestGrubUKI(t *testing.T) {
+	b := ukiBooter{
+		spec: &types.Spec{
+			UKI:     []types.ID{"arm", "x86"},
+			Cmdline: `conf={{ ID "c" }}`,
+		},
+		files: map[types.ID][]byte{
+			"arm": makeUKI(t, pe.IMAGE_FILE_MACHINE_ARM64, map[string]string{".linux": "k", ".cmdline": "console=ttyAMA0"}),
+			"x86": makeUKI(t, pe.IMAGE_FILE_MACHINE_AMD64, map[string]string{".linux": "k", ".cmdline": "console=ttyS0"}),
+		},
+	}
+	s := &Server{
+		HTTPPort: 8080,
+		Booter:   b,
+		events:   make(map[string][]machineEvent),
+	}
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/_/grub?mac=01:02:03:04:05:06&arch=2", nil)
+	if err != nil {
+		t.Fatalf("Constructing grub request: %s", err)
+	}
+	req.Host = "192.168.0.1:8080"
+	s.handleGrub(rr, req)
+	if rr.Code != 200 {
+		t.Fatalf("Got HTTP %d from request, expected 200", rr.Code)
+	}
+	expected := `set timeout=0
+chainloader '(http,192.168.0.1:8080)/_/file?name=arm&type=efi&mac=01%3A02%3A03%3A04%3A05%3A06' 'console=ttyAMA0' 'conf=http://192.168.0.1:8080/_/file?name=c'
+source '(http,192.168.0.1:8080)/_/booting?mac=01%3A02%3A03%3A04%3A05%3A06'
+boot
+`
+	if rr.Body.String() != expected {
+		t.Fatalf("Wrong grub config\nwant: %s\ngot:  %s", expected, rr.Body.String())
+	}
+}
+
+// nonceUKIBooter hands out a new ID for its UKI in every Spec, like
+// APIBooter does, and counts how often it is read.
+type nonceUKIBooter struct {
+	uki    []byte
+	digest string
+	nonce  int
+	reads  int
+}
+
+func (b *nonceUKIBooter) BootSpec(m types.Machine) (*types.Spec, error) {
+	b.nonce++
+	id := types.ID(fmt.Sprintf("uki-%d", b.nonce))
+	spec := &types.Spec{UKI: []types.ID{id}}
+	if b.digest != "" {
+		spec.Digests = map[types.ID]string{id: b.digest}
+	}
+	return spec, nil
+}
+func (b *nonceUKIBooter) FileName(id types.ID) (string, error) { return "uki", nil }
+func (b *nonceUKIBooter) ReadBootFile(id types.ID) (io.ReadCloser, int64, error) {
+	b.reads++
+	return io.NopCloser(bytes.NewReader(b.uki)), int64(len(b.uki)), nil
+}
+func (b *nonceUKIBooter) WriteBootFile(id types.ID, r io.Reader) error { return errors.New("no") }
+
+func TestUKICache(t *testing.T) {
+	uki := makeUKI(t, pe.IMAGE_FILE_MACHINE_AMD64, map[string]string{".linux": "k"})
+	b := &nonceUKIBooter{uki: uki}
+	s := &Server{
+		Booter:         b,
+		events:         make(map[string][]machineEvent),
+		VerifyCacheDir: t.TempDir(),
+	}
+	ipxe := func() int {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/_/ipxe?mac=01:02:03:04:05:06&arch=1", nil)
+		if err != nil {
+			t.Fatalf("Constructing ipxe request: %s", err)
+		}
+		s.handleIpxe(rr, req)
+		return rr.Code
+	}
+
+	// The UKI has a new ID every time, but the same name.
+	for i := 0; i < 3; i++ {
+		if code := ipxe(); code != 200 {
+			t.Fatalf("Got HTTP %d from request, expected 200", code)
+		}
+	}
+	if b.reads != 1 {
+		t.Fatalf("UKI was read %d times, expected once", b.reads)
+	}
+
+	// UKIs with a digest are read through the verified cache, and
+	// cached by digest.
+	h := sha256.Sum256(uki)
+	b.digest = "sha256:" + hex.EncodeToString(h[:])
+	b.reads = 0
+	for i := 0; i < 3; i++ {
+		if code := ipxe(); code != 200 {
+			t.Fatalf("Got HTTP %d from request, expected 200", code)
+		}
+	}
+	if b.reads != 1 {
+		t.Fatalf("UKI with a digest was read %d times, expected once", b.reads)
+	}
+	b.digest = "sha256:" + strings.Repeat("0", 64)
+	if code := ipxe(); code != 500 {
+		t.Fatalf("Got HTTP %d for a UKI that doesn't match its digest, expected 500", code)
+	}
+
+	// The least recently used entry is dropped once the cache is
+	// full.
+	var c ukiCache
+	c.put("first", &ukiInfo{})
+	c.put("second", &ukiInfo{})
+	c.get("first")
+	for i := 0; i < maxCachedUKIs-1; i++ {
+		c.put(fmt.Sprintf("more-%d", i), &ukiInfo{})
+	}
+	if c.get("first") == nil || c.get("second") != nil {
+		t.Fatalf("Wrong entry dropped from the UKI cache")
+	}
+}
@@ -0,0 +1,317 @@
+// Copyright 2024 Kairos contributors
+
+package server
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kairos-io/netboot/types"
+)
+
+// How long the files of a Spec are remembered after the Spec was
+// handed out.
+const expectationTTL = 24 * time.Hour
+
+// fileVerifier remembers the files of the Spec last handed out to
+// each machine, with their digests and signatures, and caches the
+// files that were verified against them.
+type fileVerifier struct {
+	mu sync.Mutex
+	// The files of the latest Spec of each machine, by MAC address.
+	specs     map[string]*specFiles
+	lastPrune time.Time
+	// Temporary cache directory, if the server has no
+	// VerifyCacheDir.
+	tempDir string
+	// Hex SHA-256 of the cached files that were verified against a
+	// signature, by public key and signature.
+	signed map[string]string
+}
+
+// specFiles are the files of a Spec handed out to a machine.
+type specFiles struct {
+	// The generation of the Booter that handed out the Spec, see
+	// Server.booterGeneration.
+	gen  uint64
+	seen time.Time
+	// What the files with a digest or signature must match, by ID.
+	files map[types.ID]*fileExpectation
+}
+
+type fileExpectation struct {
+	// Hex SHA-256, or empty.
+	sha256    string
+	signature []byte
+	key       ed25519.PublicKey
+}
+
+// signedKey is the key of e in fileVerifier.signed.
+func (e *fileExpectation) signedKey() string {
+	return base64.StdEncoding.EncodeToString(e.key) + ":" + base64.StdEncoding.EncodeToString(e.signature)
+}
+
+// remember records the files of spec, which the Booter of generation
+// gen handed out to mac, replacing those of mac's previous Spec.
+func (v *fileVerifier) remember(gen uint64, mac net.HardwareAddr, spec *types.Spec) error {
+	now := time.Now()
+	files := map[types.ID]*fileExpectation{}
+	if err := expectations(spec, files); err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.specs == nil {
+		v.specs = map[string]*specFiles{}
+	}
+	if now.Sub(v.lastPrune) > time.Hour {
+		for k, f := range v.specs {
+			if now.Sub(f.seen) > expectationTTL {
+				delete(v.specs, k)
+			}
+		}
+		v.lastPrune = now
+	}
+	v.specs[mac.String()] = &specFiles{gen: gen, seen: now, files: files}
+	return nil
+}
+
+// expectations adds what the files of spec and its menu entries must
+// match to exps.
+func expectations(spec *types.Spec, exps map[types.ID]*fileExpectation) error {
+	get := func(id types.ID) *fileExpectation {
+		if exps[id] == nil {
+			exps[id] = &fileExpectation{}
+		}
+		return exps[id]
+	}
+	for id, digest := range spec.Digests {
+		algo, sum, ok := strings.Cut(digest, ":")
+		if bs, err := hex.DecodeString(sum); !ok || algo != "sha256" || err != nil || len(bs) != sha256.Size {
+			return fmt.Errorf("invalid digest %q for %q", digest, id)
+		}
+		get(id).sha256 = strings.ToLower(sum)
+	}
+	if len(spec.Signatures) > 0 {
+		key, err := base64.StdEncoding.DecodeString(spec.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid public key %q", spec.PublicKey)
+		}
+		for id, s := range spec.Signatures {
+			sig, err := base64.StdEncoding.DecodeString(s)
+			if err != nil || len(sig) != ed25519.SignatureSize {
+				return fmt.Errorf("invalid signature %q for %q", s, id)
+			}
+			get(id).signature, get(id).key = sig, key
+		}
+	}
+	if spec.Menu != nil {
+		for i := range spec.Menu.Entries {
+			if err := expectations(&spec.Menu.Entries[i].Spec, exps); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expectation returns what the file with ID id must match when mac
+// fetches it, or nil if nothing. If the latest Spec that the Booter of
+// generation gen handed out to mac isn't known, e.g. because the
+// request has no MAC address like cmdline URLs, it's what the latest
+// Spec that has a digest or signature for id says.
+func (v *fileVerifier) expectation(gen uint64, mac net.HardwareAddr, id types.ID) *fileExpectation {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	current := func(f *specFiles) bool {
+		return f != nil && f.gen == gen && time.Since(f.seen) <= expectationTTL
+	}
+	if mac != nil {
+		if f := v.specs[mac.String()]; current(f) {
+			return f.files[id]
+		}
+	}
+	var latest *specFiles
+	for _, f := range v.specs {
+		if current(f) && f.files[id] != nil && (latest == nil || f.seen.After(latest.seen)) {
+			latest = f
+		}
+	}
+	if latest == nil {
+		return nil
+	}
+	return latest.files[id]
+}
+
+// fileExpectation returns what the file with ID id must match when
+// mac fetches it, or nil if nothing.
+func (s *Server) fileExpectation(mac net.HardwareAddr, id types.ID) *fileExpectation {
+	_, gen := s.booterGeneration()
+	return s.verify.expectation(gen, mac, id)
+}
+
+// cached returns the path of a verified copy of the file that e
+// describes, or "" if there is none.
+func (v *fileVerifier) cached(dir string, e *fileExpectation) string {
+	sum := e.sha256
+	if sum == "" {
+		v.mu.Lock()
+		sum = v.signed[e.signedKey()]
+		v.mu.Unlock()
+	}
+	if sum == "" {
+		return ""
+	}
+	p := filepath.Join(dir, sum)
+	if _, err := os.Stat(p); err != nil {
+		return ""
+	}
+	return p
+}
+
+// verified records that the cached file with hex SHA-256 sum matched
+// e's signature.
+func (v *fileVerifier) verified(e *fileExpectation, sum string) {
+	if e.signature == nil {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.signed == nil {
+		v.signed = map[string]string{}
+	}
+	v.signed[e.signedKey()] = sum
+}
+
+// cleanup removes the temporary cache directory, if any.
+func (v *fileVerifier) cleanup() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.tempDir != "" {
+		os.RemoveAll(v.tempDir)
+		v.tempDir = ""
+	}
+	v.signed = nil
+}
+
+// verifyCacheDir returns the directory verified files are cached in.
+func (s *Server) verifyCacheDir() (string, error) {
+	if s.VerifyCacheDir != "" {
+		return s.VerifyCacheDir, os.MkdirAll(s.VerifyCacheDir, 0700)
+	}
+	s.verify.mu.Lock()
+	defer s.verify.mu.Unlock()
+	if s.verify.tempDir == "" {
+		dir, err := os.MkdirTemp("", "netboot-verified-")
+		if err != nil {
+			return "", err
+		}
+		s.verify.tempDir = dir
+	}
+	return s.verify.tempDir, nil
+}
+
+// readVerifiedFile returns the content of the file with ID id, once
+// it has checked that it matches e. Verified files are cached, and
+// served from the cache afterwards without asking the Booter.
+//
+// If the content doesn't match, readVerifiedFile returns an error,
+// unless VerifyLogOnly is set, in which case it logs the mismatch and
+// returns the content anyway.
+func (s *Server) readVerifiedFile(id types.ID, e *fileExpectation) (io.ReadCloser, int64, error) {
+	dir, err := s.verifyCacheDir()
+	if err != nil {
+		return nil, -1, fmt.Errorf("creating verified file cache: %s", err)
+	}
+	if p := s.verify.cached(dir, e); p != "" {
+		return openFile(p, false)
+	}
+
+	f, _, err := s.booter().ReadBootFile(id)
+	if err != nil {
+		return nil, -1, err
+	}
+	defer f.Close()
+	tmp, err := os.CreateTemp(dir, "download-*")
+	if err != nil {
+		return nil, -1, err
+	}
+	h256, h512 := sha256.New(), sha512.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h256, h512), f)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, -1, err
+	}
+
+	sum := hex.EncodeToString(h256.Sum(nil))
+	var mismatch error
+	if e.sha256 != "" && sum != e.sha256 {
+		mismatch = fmt.Errorf("digest mismatch, got sha256:%s, want sha256:%s", sum, e.sha256)
+	} else if e.signature != nil {
+		if err = ed25519.VerifyWithOptions(e.key, h512.Sum(nil), e.signature, &ed25519.Options{Hash: crypto.SHA512}); err != nil {
+			mismatch = errors.New("signature verification failed")
+		}
+	}
+	if mismatch != nil {
+		if !s.VerifyLogOnly {
+			os.Remove(tmp.Name())
+			return nil, -1, mismatch
+		}
+		s.log("HTTP", "File %q failed verification, serving it anyway: %s", id, mismatch)
+		return openFile(tmp.Name(), true)
+	}
+
+	p := filepath.Join(dir, sum)
+	if err = os.Rename(tmp.Name(), p); err != nil {
+		os.Remove(tmp.Name())
+		return nil, -1, err
+	}
+	s.verify.verified(e, sum)
+	return openFile(p, false)
+}
+
+// openFile opens the file at p, deleting it once closed if remove is
+// set.
+func openFile(p string, remove bool) (io.ReadCloser, int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, -1, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, -1, err
+	}
+	if remove {
+		return &removingFile{f}, fi.Size(), nil
+	}
+	return f, fi.Size(), nil
+}
+
+// removingFile deletes the file when closed.
+type removingFile struct {
+	*os.File
+}
+
+func (f *removingFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
@@ -18,12 +18,16 @@ package tftp
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -48,6 +52,9 @@ const (
 	maxErrorSize = 500
 )
 
+// ErrServerClosed is returned by Serve after a call to Shutdown.
+var ErrServerClosed = errors.New("tftp: Server closed")
+
 // A Handler provides bytes for a file.
 //
 // If size is non-zero, it must be equal to the number of bytes in
@@ -89,6 +96,20 @@ type Server struct {
 	// functionality (e.g. serving TFTP through SOCKS). If nil,
 	// net.Dial is used.
 	Dial func(network, addr string) (net.Conn, error)
+
+	mu        sync.Mutex
+	listener  net.PacketConn
+	closing   bool
+	transfers map[*activeTransfer]struct{}
+	wg        sync.WaitGroup
+}
+
+// activeTransfer is a transfer in flight, which Shutdown may have to
+// cut off.
+type activeTransfer struct {
+	addr net.Addr
+	path string
+	conn net.Conn
 }
 
 // ListenAndServe listens on the UDP network address addr and then
@@ -117,10 +138,21 @@ func (s *Server) Serve(l net.PacketConn) error {
 	if err := l.SetDeadline(time.Time{}); err != nil {
 		return err
 	}
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listener = l
+	s.mu.Unlock()
+
 	buf := make([]byte, 512)
 	for {
 		n, addr, err := l.ReadFrom(buf)
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
 			return err
 		}
 
@@ -130,9 +162,81 @@ func (s *Server) Serve(l net.PacketConn) error {
 			continue
 		}
 
-		go s.transferAndLog(addr, req)
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			return ErrServerClosed
+		}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			s.transferAndLog(addr, req)
+		}()
+	}
+
+}
+
+// Shutdown stops the server from accepting new requests, and waits
+// for in-flight transfers to complete. If ctx is done before that,
+// the remaining transfers are aborted, and Shutdown returns an error
+// listing them.
+//
+// Serve returns ErrServerClosed once Shutdown is called.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	l := s.listener
+	s.mu.Unlock()
+	if l != nil {
+		l.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
 	}
 
+	var aborted []string
+	s.mu.Lock()
+	for t := range s.transfers {
+		aborted = append(aborted, fmt.Sprintf("%q to %s", t.path, t.addr))
+		t.conn.Close()
+	}
+	s.mu.Unlock()
+	<-done
+
+	if len(aborted) == 0 {
+		return nil
+	}
+	sort.Strings(aborted)
+	return fmt.Errorf("aborted %d in-flight TFTP transfers: %s", len(aborted), strings.Join(aborted, ", "))
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+func (s *Server) trackTransfer(t *activeTransfer, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.transfers == nil {
+			s.transfers = make(map[*activeTransfer]struct{})
+		}
+		s.transfers[t] = struct{}{}
+	} else {
+		delete(s.transfers, t)
+	}
 }
 
 func (s *Server) infoLog(msg string, args ...interface{}) {
@@ -166,6 +270,10 @@ func (s *Server) transfer(addr net.Addr, req *rrq) error {
 	}
 	defer conn.Close()
 
+	t := &activeTransfer{addr: addr, path: req.Filename, conn: conn}
+	s.trackTransfer(t, true)
+	defer s.trackTransfer(t, false)
+
 	file, size, err := s.Handler(req.Filename, addr)
 	if err != nil {
 		conn.Write(tftpError("failed to get file"))
@@ -0,0 +1,67 @@
+// Copyright 2024 Kairos contributors
+
+package tftp
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening for TFTP: %s", err)
+	}
+	defer l.Close()
+
+	s := &Server{
+		Handler:      ConstantHandler([]byte(testFile)),
+		InfoLog:      infoLog,
+		TransferLog:  transferLog,
+		WriteTimeout: time.Minute,
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(l) }()
+
+	// Start a transfer, and never acknowledge the first block, so
+	// that it stays in flight. The transfer comes from a different
+	// port than the RRQ went to, so the client can't be a connected
+	// socket.
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening for TFTP replies: %s", err)
+	}
+	defer c.Close()
+	if _, err = c.WriteTo([]byte("\x00\x01slow-file\x00octet\x00"), l.LocalAddr()); err != nil {
+		t.Fatalf("Sending RRQ: %s", err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var buf [1024]byte
+	if _, _, err = c.ReadFrom(buf[:]); err != nil {
+		t.Fatalf("Reading first data block: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = s.Shutdown(ctx)
+	if err == nil || !strings.Contains(err.Error(), `"slow-file"`) {
+		t.Fatalf("Shutdown should have reported the aborted transfer, got %v", err)
+	}
+
+	select {
+	case err = <-served:
+		if err != ErrServerClosed {
+			t.Fatalf("Serve returned %v, want ErrServerClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve didn't return after Shutdown")
+	}
+
+	// Nothing left in flight, a second Shutdown is a no-op.
+	if err = s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Second Shutdown failed: %s", err)
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2024 Kairos contributors
+
+// Package tracing records spans describing the progress of a machine
+// through the boot process.
+//
+// Spans use the OpenTelemetry data model (16 byte trace IDs, 8 byte
+// span IDs, parent links, attributes and a status), so an Exporter can
+// forward them to any OpenTelemetry collector without translating
+// identifiers.
+package tracing
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A TraceID identifies all the spans of one boot session.
+type TraceID [16]byte
+
+// String returns the lowercase hex encoding of t, as used by the W3C
+// trace context format.
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+// IsValid reports whether t is not all zeroes.
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+// ParseTraceID parses the hex encoding of a TraceID.
+func ParseTraceID(s string) (TraceID, error) {
+	var t TraceID
+	bs, err := hex.DecodeString(s)
+	if err != nil || len(bs) != len(t) {
+		return t, fmt.Errorf("invalid trace ID %q", s)
+	}
+	copy(t[:], bs)
+	return t, nil
+}
+
+// NewTraceID derives a TraceID for the boot session started by the
+// DHCP transaction xid of the machine mac.
+func NewTraceID(mac net.HardwareAddr, xid []byte, start time.Time) TraceID {
+	h := sha256.New()
+	h.Write(mac)
+	h.Write(xid)
+	fmt.Fprintf(h, "%d", start.UnixNano())
+	var t TraceID
+	copy(t[:], h.Sum(nil))
+	return t
+}
+
+// A SpanID identifies one span within a trace.
+type SpanID [8]byte
+
+// String returns the lowercase hex encoding of s.
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// IsValid reports whether s is not all zeroes.
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+func newSpanID() SpanID {
+	var s SpanID
+	// crypto/rand only fails if the OS is out of entropy sources,
+	// in which case a zero span ID is the least of our problems.
+	io.ReadFull(rand.Reader, s[:])
+	return s
+}
+
+// An Exporter receives spans once they are finished.
+//
+// ExportSpan is called synchronously from the goroutine serving the
+// client, implementations that talk to the network should queue
+// spans and return quickly.
+type Exporter interface {
+	ExportSpan(span *Span)
+}
+
+// ExporterFunc adapts a function to the Exporter interface.
+type ExporterFunc func(span *Span)
+
+// ExportSpan calls f(span).
+func (f ExporterFunc) ExportSpan(span *Span) { f(span) }
+
+// A Span is a timed operation within a boot session.
+//
+// All methods are safe to call on a nil Span, so callers don't have
+// to care whether tracing is enabled.
+type Span struct {
+	TraceID  TraceID
+	SpanID   SpanID
+	ParentID SpanID
+	Name     string
+	Start    time.Time
+	End      time.Time
+	// Attributes describe the operation, using OpenTelemetry
+	// semantic convention names where one exists.
+	Attributes map[string]string
+	// Error is the description of the failure that ended the span,
+	// or empty if the operation succeeded.
+	Error string
+
+	exporter Exporter
+	mu       sync.Mutex
+	ended    bool
+}
+
+// StartSpan starts a new root span of trace. Finished spans are sent
+// to exporter, which may be nil to discard them.
+func StartSpan(exporter Exporter, trace TraceID, name string) *Span {
+	return &Span{
+		TraceID:    trace,
+		SpanID:     newSpanID(),
+		Name:       name,
+		Start:      time.Now(),
+		Attributes: map[string]string{},
+		exporter:   exporter,
+	}
+}
+
+// StartChild starts a new span whose parent is s.
+func (s *Span) StartChild(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	ret := StartSpan(s.exporter, s.TraceID, name)
+	ret.ParentID = s.SpanID
+	return ret
+}
+
+// SetAttribute records a key/value pair describing the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+// SetError marks the span as failed. A nil err is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Error = err.Error()
+}
+
+// Finish ends the span and hands it to the exporter. Only the first
+// call has any effect.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+	if s.exporter != nil {
+		s.exporter.ExportSpan(s)
+	}
+}
+
+// Traceparent returns the W3C trace context header value for s.
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", s.TraceID, s.SpanID)
+}
+
+// JSONExporter writes every span to w as a single line of JSON, using
+// the field names of the OpenTelemetry JSON protocol encoding.
+func JSONExporter(w io.Writer) Exporter {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return ExporterFunc(func(span *Span) {
+		type attr struct {
+			Key   string `json:"key"`
+			Value struct {
+				StringValue string `json:"stringValue"`
+			} `json:"value"`
+		}
+		type status struct {
+			Code    int    `json:"code"`
+			Message string `json:"message,omitempty"`
+		}
+		out := struct {
+			TraceID      string `json:"traceId"`
+			SpanID       string `json:"spanId"`
+			ParentSpanID string `json:"parentSpanId,omitempty"`
+			Name         string `json:"name"`
+			Start        int64  `json:"startTimeUnixNano,string"`
+			End          int64  `json:"endTimeUnixNano,string"`
+			Attributes   []attr `json:"attributes,omitempty"`
+			Status       status `json:"status"`
+		}{
+			TraceID: span.TraceID.String(),
+			SpanID:  span.SpanID.String(),
+			Name:    span.Name,
+			Start:   span.Start.UnixNano(),
+			End:     span.End.UnixNano(),
+			// STATUS_CODE_OK
+			Status: status{Code: 1},
+		}
+		if span.ParentID.IsValid() {
+			out.ParentSpanID = span.ParentID.String()
+		}
+		span.mu.Lock()
+		keys := make([]string, 0, len(span.Attributes))
+		for k := range span.Attributes {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			a := attr{Key: k}
+			a.Value.StringValue = span.Attributes[k]
+			out.Attributes = append(out.Attributes, a)
+		}
+		if span.Error != "" {
+			// STATUS_CODE_ERROR
+			out.Status = status{Code: 2, Message: span.Error}
+		}
+		span.mu.Unlock()
+
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(out)
+	})
+}
@@ -0,0 +1,85 @@
+// Copyright 2024 Kairos contributors
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSpans(t *testing.T) {
+	var got []*Span
+	exp := ExporterFunc(func(s *Span) { got = append(got, s) })
+
+	mac, _ := net.ParseMAC("01:02:03:04:05:06")
+	id := NewTraceID(mac, []byte{1, 2, 3, 4}, time.Unix(0, 0))
+	if !id.IsValid() {
+		t.Fatalf("NewTraceID returned a zero trace ID")
+	}
+	parsed, err := ParseTraceID(id.String())
+	if err != nil || parsed != id {
+		t.Fatalf("ParseTraceID(%q) = %s, %v", id, parsed, err)
+	}
+
+	root := StartSpan(exp, id, "boot")
+	child := root.StartChild("dhcp")
+	child.SetError(errors.New("boom"))
+	child.Finish()
+	child.Finish()
+	root.Finish()
+
+	if len(got) != 2 {
+		t.Fatalf("Got %d exported spans, want 2", len(got))
+	}
+	if got[0] != child || got[1] != root {
+		t.Fatalf("Spans exported in the wrong order")
+	}
+	if child.TraceID != id || child.ParentID != root.SpanID || root.ParentID.IsValid() {
+		t.Fatalf("Wrong span linkage: root %+v, child %+v", root, child)
+	}
+	if child.Error != "boom" {
+		t.Fatalf("Wrong child error %q", child.Error)
+	}
+
+	// Nil spans are no-ops.
+	var s *Span
+	s.StartChild("x").SetAttribute("a", "b")
+	s.Finish()
+}
+
+func TestJSONExporter(t *testing.T) {
+	var b bytes.Buffer
+	span := StartSpan(JSONExporter(&b), TraceID{1}, "test")
+	span.SetAttribute("b", "2")
+	span.SetAttribute("a", "1")
+	span.SetError(errors.New("failed"))
+	span.Finish()
+
+	var out struct {
+		TraceID    string `json:"traceId"`
+		Name       string `json:"name"`
+		Attributes []struct {
+			Key string `json:"key"`
+		} `json:"attributes"`
+		Status struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(b.Bytes(), &out); err != nil {
+		t.Fatalf("Exported span is not valid JSON: %s\n%s", err, b.String())
+	}
+	if out.TraceID != "01000000000000000000000000000000" || out.Name != "test" {
+		t.Fatalf("Wrong exported span %s", b.String())
+	}
+	if len(out.Attributes) != 2 || out.Attributes[0].Key != "a" {
+		t.Fatalf("Wrong exported attributes %s", b.String())
+	}
+	if out.Status.Code != 2 || out.Status.Message != "failed" {
+		t.Fatalf("Wrong exported status %s", b.String())
+	}
+}
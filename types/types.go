@@ -29,10 +29,39 @@ type Booter interface {
 	// -1 will make the boot process orders of magnitude slower due to
 	// poor ipxe behavior.
 	ReadBootFile(id ID) (io.ReadCloser, int64, error)
-	// WriteBootFile Write the given Reader to an ID given in Spec.
+	// WriteBootFile Write the given Reader to an ID given in Spec,
+	// usually with Upload in the Cmdline.
 	WriteBootFile(id ID, body io.Reader) error
 }
 
+// BootNotifier can be implemented by a Booter that wants to know
+// when a machine is done netbooting.
+type BootNotifier interface {
+	// Booted is called once m has fetched the kernel and initrds of
+	// its Spec and is about to boot them. The server only knows
+	// what the machine told it over DHCP, so fields other than MAC
+	// may be empty.
+	Booted(m Machine) error
+}
+
+// ClientChecker can be implemented by a Booter whose files are only
+// meant for some machines.
+type ClientChecker interface {
+	// CheckClient returns an error if the file with ID id must not
+	// be served to m. Only m's MAC and IP are known. The MAC is the
+	// one that the request's file token was issued to if the server
+	// uses file tokens, and as claimed by the client otherwise.
+	CheckClient(m Machine, id ID) error
+}
+
+// FileNamer can be implemented by a Booter that hands out different
+// IDs for the same file, e.g. because they are signed with a nonce.
+type FileNamer interface {
+	// FileName returns a name for the file with ID id that is the
+	// same for all of its IDs, such as its URL.
+	FileName(id ID) (string, error)
+}
+
 // An ID is an identifier used by Booters to reference files.
 type ID string
 
@@ -40,25 +69,118 @@ type ID string
 type Machine struct {
 	MAC  net.HardwareAddr
 	Arch constants.Architecture
+
+	// GUID is the client machine identifier from DHCP option 97,
+	// without the leading type byte, or nil if the client didn't
+	// send one. The bytes are in wire order, see utils.FormatGUID.
+	GUID []byte
+	// VendorClass is the DHCP vendor class identifier (option 60),
+	// e.g. "PXEClient:Arch:00007:UNDI:003016".
+	VendorClass string
+
+	// Firmware is what the machine booted with when it last asked
+	// over DHCP. Booters should pick kernels based on Arch, this is
+	// for information only.
+	Firmware constants.Firmware
+	// RelayAddr is the address of the DHCP relay agent that
+	// forwarded the machine's request, or nil if it wasn't relayed.
+	RelayAddr net.IP
+	// Interface is the name of the server's network interface that
+	// the machine's DHCP request arrived on, or empty if unknown.
+	Interface string
+	// IP is the address the machine makes HTTP requests from, or nil
+	// if it isn't known yet.
+	IP net.IP
+	// Hostname is the host name the machine sent in its DHCP
+	// request (option 12), or empty if it sent none.
+	Hostname string
 }
 
 // A Spec describes a kernel and associated configuration.
 type Spec struct {
 	// The kernel to boot
-	Kernel ID
-	// Optional init ramdisks for linux kernels
-	Initrd []ID
+	Kernel ID `json:"kernel,omitempty"`
+	// Optional init ramdisks for linux kernels, or extra files for
+	// the EFI binary, such as UKI addons, systemd-boot configs or
+	// Windows boot files, which it can load by name from iPXE.
+	Initrd []ID `json:"initrd,omitempty"`
+	// Optional names of the Initrd files, by index, as the kernel or
+	// EFI binary sees them, e.g. "BCD" or "boot.sdi" for wimboot.
+	// Files with no name are named "initrd<index>".
+	InitrdNames []string `json:"initrd-names,omitempty"`
 
-	// Optional efi binary to boot
+	// Optional efi binary to boot, with Cmdline as its load options.
 	// Either Efi or Kernel must be set
-	Efi ID
+	Efi ID `json:"efi,omitempty"`
+	// Optional Unified Kernel Images (EFI binaries with the kernel,
+	// initrd and cmdline embedded), at most one per architecture, to
+	// boot instead of Kernel or Efi. The server picks the one built
+	// for the machine's architecture and boots it as Efi, with
+	// Initrd as addons and Cmdline appended to its embedded cmdline.
+	// Under Secure Boot, systemd-stub ignores the load options of
+	// UKIs that embed a cmdline, so Cmdline is dropped then: put
+	// what the machine needs in the UKI, or in a signed addon.
+	UKI []ID `json:"uki,omitempty"`
 	// Optional kernel commandline. This string is evaluated as a
 	// text/template template, in which "ID(x)" function is
 	// available. Invoking ID(x) returns a URL that will call
-	// Booter.ReadBootFile(x) when fetched.
-	Cmdline string
+	// Booter.ReadBootFile(x) when fetched. Likewise, Upload(x)
+	// returns a URL that will call Booter.WriteBootFile(x) with the
+	// body of a POST to it, if the server accepts uploads.
+	//
+	// The template is executed with the machine's utils.CmdlineVars,
+	// so that one Spec can give each machine its own cmdline, e.g.
+	// "hostname=node-{{ .MAC.Dashed }}". The arguments of ID and
+	// Upload must be constants for Booters to translate them.
+	Cmdline string `json:"cmdline,omitempty"`
 	// Message to print on the client machine before booting.
-	Message string
+	Message string `json:"message,omitempty"`
+	// Loader is the boot chain that EFI machines load the Spec with,
+	// LoaderIpxe or LoaderGrub. If empty, the server decides. BIOS
+	// machines always use iPXE.
+	Loader string `json:"loader,omitempty"`
+
+	// Optional digests of the Spec's files, by ID, as
+	// "sha256:<hex>". The server refuses to serve a file that
+	// doesn't match its digest.
+	Digests map[ID]string `json:"digests,omitempty"`
+	// Optional detached signatures of the Spec's files, by ID, as
+	// base64 encoded Ed25519ph (RFC 8032) signatures, which are
+	// verified against PublicKey like digests are.
+	Signatures map[ID]string `json:"signatures,omitempty"`
+	// The base64 encoded Ed25519 public key that Signatures are
+	// verified with. Required if Signatures is set.
+	PublicKey string `json:"public-key,omitempty"`
+
+	// Menu, if set, lets the user pick what to boot at the console
+	// among several entries. Kernel, Initrd, Efi and Cmdline must
+	// then be empty.
+	Menu *Menu `json:"menu,omitempty"`
+
+	// IpxeTemplate, if set, is a text/template of the iPXE script
+	// that machines booting with iPXE run, instead of the one the
+	// server generates from the fields above. It is executed with
+	// these fields:
+	//
+	//   - .Machine, the types.Machine being booted
+	//   - .Spec, this Spec
+	//   - .URL, the scheme and host of the server, e.g.
+	//     "http://192.168.0.1:80"
+	//
+	// and these functions:
+	//
+	//   - ID x, a URL that serves Booter.ReadBootFile(x), as in
+	//     Cmdline. x is either a constant, like {{ ID "foo" }}, or one
+	//     of the Spec's IDs, like {{ ID .Spec.Kernel }}.
+	//   - Upload x, a URL that machines upload x to, as in Cmdline.
+	//   - Booting, a URL to fetch just before booting, which tells
+	//     the server that the machine is booting, e.g. with
+	//     "imgfetch {{ Booting }} ||".
+	//
+	// The URLs carry the same file tokens and session as those of a
+	// generated script. Machines booting with GRUB can't boot a Spec
+	// with an IpxeTemplate.
+	IpxeTemplate string `json:"ipxe-template,omitempty"`
 
 	// A raw iPXE script to run. Overrides all of the above.
 	//
@@ -67,10 +189,40 @@ type Spec struct {
 	// them, but there is no guarantee that this will remain
 	// true. When passing a custom iPXE script, it is your
 	// responsibility to make the boot succeed, Pixiecore's
-	// involvement ends when it serves your script.
-	IpxeScript string
+	// involvement ends when it serves your script. Prefer
+	// IpxeTemplate.
+	IpxeScript string `json:"ipxe-script,omitempty"`
 }
 
+// A Menu lists the things a machine can boot.
+type Menu struct {
+	Entries []MenuEntry `json:"entries"`
+	// Default is the Name of the entry that boots when the user
+	// doesn't pick one in time. If empty, it is the first entry.
+	Default string `json:"default,omitempty"`
+	// Timeout is how many seconds the menu waits for the user
+	// before booting Default. If zero, it waits forever.
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// A MenuEntry is one choice of a Menu. Its Spec says what it boots,
+// with IDs from the same Booter as the Spec of the Menu, and can't
+// have a Menu itself.
+type MenuEntry struct {
+	// Name is shown in the menu.
+	Name string `json:"name"`
+	Spec
+}
+
+// Boot chains for Spec.Loader.
+const (
+	// LoaderIpxe boots with iPXE.
+	LoaderIpxe = "ipxe"
+	// LoaderGrub boots with a signed shim and GRUB, which Secure
+	// Boot machines trust.
+	LoaderGrub = "grub"
+)
+
 // IPV6
 
 // IdentityAssociation associates an ip address with a network interface of a client
@@ -4,18 +4,119 @@ package utils
 
 import (
 	"bytes"
+	"encoding/hex"
 	"fmt"
+	"net"
+	"sort"
 	"strings"
 	"text/template"
+	"text/template/parse"
+
+	"github.com/kairos-io/netboot/constants"
+	"github.com/kairos-io/netboot/types"
 )
 
-func ExpandCmdline(tpl string, funcs template.FuncMap) (string, error) {
+// FormatGUID formats a PXE client GUID in the usual UUID notation.
+//
+// PXE clients send their SMBIOS UUID, whose first three fields are
+// little-endian, so those are byte swapped to match what the machine's
+// firmware and dmidecode display.
+func FormatGUID(guid []byte) string {
+	if len(guid) != 16 {
+		return hex.EncodeToString(guid)
+	}
+	b := make([]byte, 16)
+	copy(b, guid)
+	b[0], b[1], b[2], b[3] = b[3], b[2], b[1], b[0]
+	b[4], b[5] = b[5], b[4]
+	b[6], b[7] = b[7], b[6]
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// CmdlineVars are the variables that a Spec's Cmdline template is
+// executed with, e.g. "hostname=node-{{ .MAC.Dashed }}".
+type CmdlineVars struct {
+	// MAC is the machine's MAC address.
+	MAC MAC
+	// Arch is the machine's architecture, e.g. "X64".
+	Arch constants.Architecture
+	// Firmware is what the machine booted with, e.g. "efi64".
+	Firmware constants.Firmware
+	// GUID is the machine's UUID, or empty if it didn't send one.
+	GUID string
+	// IP is the address the machine got, as seen by the server, or
+	// empty if it isn't known.
+	IP string
+	// Hostname is the host name that the machine sent over DHCP, or
+	// empty if it didn't or if it isn't a valid RFC 1123 host name.
+	Hostname string
+	// Server is the address (host, without port) that the machine
+	// reaches the server at.
+	Server string
+}
+
+// A MAC address, formatted as "01:02:03:04:05:06" in templates.
+type MAC net.HardwareAddr
+
+func (m MAC) String() string { return net.HardwareAddr(m).String() }
+
+// Dashed formats m as "01-02-03-04-05-06".
+func (m MAC) Dashed() string { return strings.ReplaceAll(m.String(), ":", "-") }
+
+// Bare formats m as "010203040506".
+func (m MAC) Bare() string { return hex.EncodeToString(m) }
+
+// NewCmdlineVars returns the CmdlineVars of m, which reaches the
+// server at server.
+func NewCmdlineVars(m types.Machine, server string) *CmdlineVars {
+	ret := &CmdlineVars{
+		MAC:      MAC(m.MAC),
+		Arch:     m.Arch,
+		Firmware: m.Firmware,
+		Server:   server,
+	}
+	// The machine says what it likes, and the host name ends up in
+	// boot scripts and cmdlines.
+	if validHostname(m.Hostname) {
+		ret.Hostname = m.Hostname
+	}
+	if len(m.GUID) > 0 {
+		ret.GUID = FormatGUID(m.GUID)
+	}
+	if m.IP != nil {
+		ret.IP = m.IP.String()
+	}
+	return ret
+}
+
+// validHostname reports whether s is a host name as per RFC 1123:
+// dot-separated labels of letters, digits and inner hyphens.
+func validHostname(s string) bool {
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ExpandCmdline executes the cmdline template tpl with funcs and vars,
+// which may be nil if the cmdline references no variables.
+func ExpandCmdline(tpl string, funcs template.FuncMap, vars *CmdlineVars) (string, error) {
 	tmpl, err := template.New("cmdline").Option("missingkey=error").Funcs(funcs).Parse(tpl)
 	if err != nil {
 		return "", fmt.Errorf("parsing cmdline %q: %s", tpl, err)
 	}
 	var out bytes.Buffer
-	if err = tmpl.Execute(&out, nil); err != nil {
+	if err = tmpl.Execute(&out, vars); err != nil {
 		return "", fmt.Errorf("expanding cmdline template %q: %s", tpl, err)
 	}
 	cmdline := strings.TrimSpace(out.String())
@@ -24,3 +125,146 @@ func ExpandCmdline(tpl string, funcs template.FuncMap) (string, error) {
 	}
 	return cmdline, nil
 }
+
+// RewriteTemplateCalls rewrites the calls to the functions funcs in
+// the text/template tpl whose arguments are all constant strings, like
+// {{ ID "foo" }}, to what f returns for them, e.g. `ID "bar"`, or
+// leaves them alone if f returns an empty string. Other calls,
+// including those with non-constant arguments, and the rest of
+// tpl are left alone, so that it can be executed later with data.
+//
+// It lets Booters translate the IDs in a template that the server
+// executes. Calls to functions not in funcs are parse errors.
+func RewriteTemplateCalls(tpl string, funcs []string, f func(fn string, args []string) (string, error)) (string, error) {
+	stubs := template.FuncMap{}
+	for _, fn := range funcs {
+		stubs[fn] = func(...string) string { return "" }
+	}
+	tmpl, err := template.New("template").Funcs(stubs).Parse(tpl)
+	if err != nil {
+		return "", fmt.Errorf("parsing template %q: %s", tpl, err)
+	}
+
+	// Replacements of tpl[start:end], found in any order.
+	type edit struct {
+		start, end int
+		text       string
+	}
+	var (
+		edits   []edit
+		walkErr error
+	)
+	var walk func(parse.Node)
+	walk = func(n parse.Node) {
+		switch n := n.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, c := range n.Nodes {
+				walk(c)
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.TemplateNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			if n == nil {
+				return
+			}
+			for _, c := range n.Cmds {
+				walk(c)
+			}
+		case *parse.ChainNode:
+			walk(n.Node)
+		case *parse.CommandNode:
+			for _, c := range n.Args {
+				walk(c)
+			}
+			ident, ok := n.Args[0].(*parse.IdentifierNode)
+			if !ok || stubs[ident.Ident] == nil {
+				return
+			}
+			var args []string
+			end := int(ident.Pos) + len(ident.Ident)
+			for _, a := range n.Args[1:] {
+				str, ok := a.(*parse.StringNode)
+				if !ok {
+					return
+				}
+				args = append(args, str.Text)
+				end = int(str.Pos) + len(str.Quoted)
+			}
+			text, err := f(ident.Ident, args)
+			if err != nil {
+				if walkErr == nil {
+					walkErr = err
+				}
+				return
+			}
+			if text != "" {
+				edits = append(edits, edit{int(ident.Pos), end, text})
+			}
+		}
+	}
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			walk(t.Tree.Root)
+		}
+	}
+	if walkErr != nil {
+		return "", walkErr
+	}
+
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+	for _, e := range edits {
+		tpl = tpl[:e.start] + e.text + tpl[e.end:]
+	}
+	return tpl, nil
+}
+
+// The functions that cmdlines and iPXE templates can call, see
+// types.Spec.
+var (
+	CmdlineFuncs      = []string{"ID", "Upload"}
+	IpxeTemplateFuncs = []string{"ID", "Upload", "Booting"}
+)
+
+// SpecIDs calls f with each ID that spec and its menu entries
+// reference, including in their cmdline and iPXE template. Templates
+// that don't parse reference nothing.
+func SpecIDs(spec *types.Spec, f func(types.ID)) {
+	for _, id := range append([]types.ID{spec.Kernel, spec.Efi}, spec.Initrd...) {
+		if id != "" {
+			f(id)
+		}
+	}
+	for _, id := range spec.UKI {
+		f(id)
+	}
+	ref := func(fn string, args []string) (string, error) {
+		if fn == "ID" && len(args) == 1 {
+			f(types.ID(args[0]))
+		}
+		return "", nil
+	}
+	RewriteTemplateCalls(spec.Cmdline, CmdlineFuncs, ref)
+	RewriteTemplateCalls(spec.IpxeTemplate, IpxeTemplateFuncs, ref)
+	if spec.Menu != nil {
+		for i := range spec.Menu.Entries {
+			SpecIDs(&spec.Menu.Entries[i].Spec, f)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2024 Kairos contributors
+
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kairos-io/netboot/types"
+)
+
+func TestRewriteTemplateCalls(t *testing.T) {
+	f := func(fn string, args []string) (string, error) {
+		if len(args) == 0 {
+			return "", nil
+		}
+		return fn + ` "` + strings.ToUpper(strings.Join(args, ",")) + `"`, nil
+	}
+	for tpl, want := range map[string]string{
+		`a={{ ID "x" }} b={{ID "y"}}`:                              `a={{ ID "X" }} b={{ID "Y"}}`,
+		`{{ if .Foo }}{{ ID "x" }}{{ else }}{{ ID "y" }}{{ end }}`: `{{ if .Foo }}{{ ID "X" }}{{ else }}{{ ID "Y" }}{{ end }}`,
+		`{{ ID .Spec.Kernel }} {{ printf "%s" (ID "x") }}`:         `{{ ID .Spec.Kernel }} {{ printf "%s" (ID "X") }}`,
+		"{{ ID `x` }} {{ Booting }}":                               `{{ ID "X" }} {{ Booting }}`,
+		`{{ define "t" }}{{ ID "x" }}{{ end }}{{ template "t" }}`:  `{{ define "t" }}{{ ID "X" }}{{ end }}{{ template "t" }}`,
+	} {
+		got, err := RewriteTemplateCalls(tpl, []string{"ID", "Booting"}, f)
+		if err != nil {
+			t.Fatalf("Rewriting %q: %s", tpl, err)
+		}
+		if got != want {
+			t.Fatalf("Wrong rewrite of %q, got %q, want %q", tpl, got, want)
+		}
+	}
+
+	if _, err := RewriteTemplateCalls(`{{ Nope "x" }}`, []string{"ID"}, f); err == nil {
+		t.Fatalf("Call to an unknown function was accepted")
+	}
+}
+
+func TestCmdlineVarsHostname(t *testing.T) {
+	for hostname, want := range map[string]string{
+		"node-1":                "node-1",
+		"node-1.example.com":    "node-1.example.com",
+		"NODE1":                 "NODE1",
+		"":                      "",
+		"-node":                 "",
+		"node-":                 "",
+		"node..example":         "",
+		"node_1":                "",
+		"node 1":                "",
+		"x initrd=evil":         "",
+		"node\nimgexec evil":    "",
+		"{{ .Server }}":         "",
+		strings.Repeat("a", 64): "",
+	} {
+		vars := NewCmdlineVars(types.Machine{Hostname: hostname}, "")
+		if vars.Hostname != want {
+			t.Fatalf("Wrong host name for %q, got %q, want %q", hostname, vars.Hostname, want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2024 Kairos contributors
+
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// An HTTPClientOption configures the clients built by NewHTTPClient.
+type HTTPClientOption func(*httpClientConfig)
+
+type httpClientConfig struct {
+	header    http.Header
+	rootCAs   *x509.CertPool
+	certs     []tls.Certificate
+	proxy     *url.URL
+	tlsConfig *tls.Config
+}
+
+// WithHeader adds a header to requests.
+func WithHeader(key, value string) HTTPClientOption {
+	return func(c *httpClientConfig) {
+		c.header.Add(key, value)
+	}
+}
+
+// WithBearerToken authenticates requests with an OAuth2 style bearer
+// token.
+func WithBearerToken(token string) HTTPClientOption {
+	return WithHeader("Authorization", "Bearer "+token)
+}
+
+// WithBasicAuth authenticates requests with HTTP basic
+// authentication.
+func WithBasicAuth(username, password string) HTTPClientOption {
+	return WithHeader("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
+}
+
+// WithRootCAs verifies servers against pool, instead of the system's
+// certificate authorities.
+func WithRootCAs(pool *x509.CertPool) HTTPClientOption {
+	return func(c *httpClientConfig) {
+		c.rootCAs = pool
+	}
+}
+
+// WithClientCertificate presents cert to servers that ask for a
+// client certificate.
+func WithClientCertificate(cert tls.Certificate) HTTPClientOption {
+	return func(c *httpClientConfig) {
+		c.certs = append(c.certs, cert)
+	}
+}
+
+// WithTLSConfig uses a copy of cfg as the base TLS configuration, for
+// settings the other options don't cover.
+func WithTLSConfig(cfg *tls.Config) HTTPClientOption {
+	return func(c *httpClientConfig) {
+		c.tlsConfig = cfg.Clone()
+	}
+}
+
+// WithProxy sends all requests through the HTTP proxy at proxy,
+// instead of the one set by the HTTP_PROXY and HTTPS_PROXY environment
+// variables.
+func WithProxy(proxy *url.URL) HTTPClientOption {
+	return func(c *httpClientConfig) {
+		c.proxy = proxy
+	}
+}
+
+// NewHTTPClient returns a client configured by opts. A zero timeout
+// means no timeout.
+//
+// Headers set by opts (including credentials) are only sent to the
+// scheme and host of origin, so that they don't leak to other servers
+// that a Booter fetches files from. If origin is empty, they are sent
+// with all requests.
+func NewHTTPClient(origin string, timeout time.Duration, opts ...HTTPClientOption) (*http.Client, error) {
+	cfg := &httpClientConfig{header: http.Header{}}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.tlsConfig != nil {
+		transport.TLSClientConfig = cfg.tlsConfig
+	}
+	if cfg.rootCAs != nil || len(cfg.certs) > 0 {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		if cfg.rootCAs != nil {
+			transport.TLSClientConfig.RootCAs = cfg.rootCAs
+		}
+		transport.TLSClientConfig.Certificates = append(transport.TLSClientConfig.Certificates, cfg.certs...)
+	}
+	if cfg.proxy != nil {
+		transport.Proxy = http.ProxyURL(cfg.proxy)
+	}
+
+	ret := &http.Client{Timeout: timeout, Transport: transport}
+	if len(cfg.header) > 0 {
+		ht := &headerTransport{base: transport, header: cfg.header}
+		if origin != "" {
+			u, err := url.Parse(origin)
+			if err != nil || u.Host == "" {
+				return nil, fmt.Errorf("invalid origin %q", origin)
+			}
+			ht.scheme, ht.host = u.Scheme, u.Host
+		}
+		ret.Transport = ht
+	}
+	return ret, nil
+}
+
+// LoadCertPool reads a bundle of PEM encoded CA certificates.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bs) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// headerTransport adds headers to the requests sent to one origin.
+type headerTransport struct {
+	base   http.RoundTripper
+	header http.Header
+	// Empty to add headers to all requests.
+	scheme, host string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.host != "" && (req.URL.Scheme != t.scheme || req.URL.Host != t.host) {
+		return t.base.RoundTrip(req)
+	}
+	// RoundTrippers must not modify the request they're given.
+	req = req.Clone(req.Context())
+	for k, vs := range t.header {
+		req.Header.Del(k)
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	return t.base.RoundTrip(req)
+}
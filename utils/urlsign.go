@@ -16,11 +16,20 @@
 package utils
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/kairos-io/netboot/types"
 	"golang.org/x/crypto/nacl/secretbox"
@@ -28,6 +37,199 @@ import (
 
 // SignURL constructs an ID from u, signed with key.
 func SignURL(u string, key *[32]byte) (types.ID, error) {
+	return NewKeySet(*key).SignURL(u, SignOptions{})
+}
+
+// GetURL returns the URL contained within id.
+//
+// id must have been created by signURL, with key, or by a KeySet
+// holding key. IDs that expired, or that are bound to a client, are
+// rejected.
+func GetURL(id types.ID, key *[32]byte) (string, error) {
+	return NewKeySet(*key).GetURL(id, &types.Machine{})
+}
+
+// SignOptions restrict who can use a signed ID, and for how long.
+type SignOptions struct {
+	// TTL is how long the ID is valid for, or 0 for forever.
+	TTL time.Duration
+	// MAC and IP, if set, bind the ID to the machine with that MAC
+	// or IP address.
+	MAC net.HardwareAddr
+	IP  net.IP
+}
+
+// urlClaims is the signed content of IDs with SignOptions. IDs
+// without options hold the bare URL, as they always did.
+type urlClaims struct {
+	URL     string `json:"u"`
+	Expires int64  `json:"e,omitempty"`
+	MAC     string `json:"m,omitempty"`
+	IP      string `json:"i,omitempty"`
+}
+
+// claimsMarker starts the signed content of IDs that hold urlClaims.
+// It can't start a URL.
+const claimsMarker = 0x01
+
+// A KeySet signs IDs with its newest key, and accepts IDs signed with
+// any of its keys, so that keys can be rotated without breaking the
+// IDs handed out just before.
+type KeySet struct {
+	mu sync.Mutex
+	// Newest first.
+	keys [][32]byte
+
+	// Set by LoadKeySet.
+	path        string
+	rotateEvery time.Duration
+	rotated     time.Time
+}
+
+// NewKeySet returns a KeySet that signs with the first of keys.
+func NewKeySet(keys ...[32]byte) *KeySet {
+	return &KeySet{keys: keys}
+}
+
+// RandomKeySet returns a KeySet with a single random key. IDs it
+// signs don't survive a restart.
+func RandomKeySet() (*KeySet, error) {
+	key, err := randomKey()
+	if err != nil {
+		return nil, err
+	}
+	return NewKeySet(key), nil
+}
+
+// LoadKeySet reads a KeySet from the file at path, which holds one
+// base64 encoded 32 byte key per line, newest first. If the file
+// doesn't exist, it is created with a random key, so that IDs stay
+// valid across restarts.
+//
+// If rotateEvery is non-zero, a new key is added to the file when
+// the file is older than that, and all but the previous key are
+// dropped. IDs then stay valid for between one and two rotation
+// periods.
+func LoadKeySet(path string, rotateEvery time.Duration) (*KeySet, error) {
+	ret := &KeySet{path: path, rotateEvery: rotateEvery}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ret, ret.rotate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	ret.rotated = fi.ModTime()
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		bs, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(bs) != 32 {
+			return nil, fmt.Errorf("%s:%d: not a base64 encoded 32 byte key", path, n)
+		}
+		var key [32]byte
+		copy(key[:], bs)
+		ret.keys = append(ret.keys, key)
+	}
+	if err = sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(ret.keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return ret, nil
+}
+
+// Rotate makes a new random key the signing key. The previous key
+// is kept to accept the IDs it signed, older ones are dropped. If
+// the KeySet was loaded from a file, the file is updated.
+func (k *KeySet) Rotate() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.rotate()
+}
+
+// rotate is Rotate, with mu held.
+func (k *KeySet) rotate() error {
+	key, err := randomKey()
+	if err != nil {
+		return err
+	}
+	keys := [][32]byte{key}
+	if len(k.keys) > 0 {
+		keys = append(keys, k.keys[0])
+	}
+	if k.path != "" {
+		var b bytes.Buffer
+		for _, key := range keys {
+			fmt.Fprintln(&b, base64.StdEncoding.EncodeToString(key[:]))
+		}
+		// Write and rename, so that a crash doesn't lose the keys.
+		tmp, err := os.CreateTemp(filepath.Dir(k.path), filepath.Base(k.path)+".tmp*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		if _, err = tmp.Write(b.Bytes()); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err = tmp.Close(); err != nil {
+			return err
+		}
+		if err = os.Rename(tmp.Name(), k.path); err != nil {
+			return err
+		}
+	}
+	k.keys = keys
+	k.rotated = time.Now()
+	return nil
+}
+
+// SignURL constructs an ID from u, signed with k's newest key and
+// restricted by opts.
+func (k *KeySet) SignURL(u string, opts SignOptions) (types.ID, error) {
+	k.mu.Lock()
+	if k.rotateEvery > 0 && time.Since(k.rotated) >= k.rotateEvery {
+		if err := k.rotate(); err != nil {
+			k.mu.Unlock()
+			return "", fmt.Errorf("rotating URL signing keys: %s", err)
+		}
+	}
+	if len(k.keys) == 0 {
+		k.mu.Unlock()
+		return "", errors.New("no URL signing key")
+	}
+	key := k.keys[0]
+	k.mu.Unlock()
+
+	msg := []byte(u)
+	if opts.TTL != 0 || opts.MAC != nil || opts.IP != nil {
+		c := urlClaims{URL: u}
+		if opts.TTL != 0 {
+			c.Expires = time.Now().Add(opts.TTL).Unix()
+		}
+		if opts.MAC != nil {
+			c.MAC = opts.MAC.String()
+		}
+		if opts.IP != nil {
+			c.IP = opts.IP.String()
+		}
+		bs, err := json.Marshal(c)
+		if err != nil {
+			return "", err
+		}
+		msg = append([]byte{claimsMarker}, bs...)
+	}
+
 	var nonce [24]byte
 	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
 		return "", fmt.Errorf("could not read randomness for signing nonce: %s", err)
@@ -42,14 +244,16 @@ func SignURL(u string, key *[32]byte) (types.ID, error) {
 	// simultaneously netboot a million machines. This is one case
 	// where convenience and certainty that you got it right trumps
 	// pure efficiency.
-	out = secretbox.Seal(out, []byte(u), &nonce, key)
+	out = secretbox.Seal(out, msg, &nonce, &key)
 	return types.ID(base64.URLEncoding.EncodeToString(out)), nil
 }
 
-// GetURL returns the URL contained within id.
+// GetURL returns the URL contained within id, which must have been
+// signed by one of k's keys and not have expired.
 //
-// id must have been created by signURL, with key.
-func GetURL(id types.ID, key *[32]byte) (string, error) {
+// If id is bound to a MAC or IP address, client must have it. A nil
+// client skips that check, for callers that already made it.
+func (k *KeySet) GetURL(id types.ID, client *types.Machine) (string, error) {
 	signed, err := base64.URLEncoding.DecodeString(string(id))
 	if err != nil {
 		return "", err
@@ -60,9 +264,47 @@ func GetURL(id types.ID, key *[32]byte) (string, error) {
 
 	var nonce [24]byte
 	copy(nonce[:], signed)
-	out, ok := secretbox.Open(nil, signed[24:], &nonce, key)
+	k.mu.Lock()
+	keys := k.keys
+	k.mu.Unlock()
+	var (
+		out []byte
+		ok  bool
+	)
+	for i := range keys {
+		if out, ok = secretbox.Open(nil, signed[24:], &nonce, &keys[i]); ok {
+			break
+		}
+	}
 	if !ok {
 		return "", errors.New("signature verification failed")
 	}
-	return string(out), nil
+	if len(out) == 0 || out[0] != claimsMarker {
+		return string(out), nil
+	}
+
+	var c urlClaims
+	if err = json.Unmarshal(out[1:], &c); err != nil {
+		return "", fmt.Errorf("invalid signed ID: %s", err)
+	}
+	if c.Expires != 0 && time.Now().Unix() > c.Expires {
+		return "", errors.New("signed ID expired")
+	}
+	if client != nil {
+		if c.MAC != "" && (client.MAC == nil || client.MAC.String() != c.MAC) {
+			return "", fmt.Errorf("signed ID is bound to MAC address %s", c.MAC)
+		}
+		if c.IP != "" && (client.IP == nil || !client.IP.Equal(net.ParseIP(c.IP))) {
+			return "", fmt.Errorf("signed ID is bound to IP address %s", c.IP)
+		}
+	}
+	return c.URL, nil
+}
+
+func randomKey() ([32]byte, error) {
+	var key [32]byte
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return key, fmt.Errorf("failed to get randomness for signing key: %s", err)
+	}
+	return key, nil
 }
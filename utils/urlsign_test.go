@@ -16,9 +16,16 @@
 package utils
 
 import (
+	"bytes"
 	"crypto/rand"
 	"io"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/kairos-io/netboot/types"
 )
 
 func TestSignURL(t *testing.T) {
@@ -50,3 +57,108 @@ func TestSignURL(t *testing.T) {
 		t.Fatalf("Corrupted id %q decoded correctly", id)
 	}
 }
+
+func TestKeySet(t *testing.T) {
+	keys, err := RandomKeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := "http://test.example/foo/bar"
+	mac, _ := net.ParseMAC("01:02:03:04:05:06")
+	ip := net.IPv4(192, 168, 1, 23)
+
+	id, err := keys.SignURL(u, SignOptions{TTL: time.Minute, MAC: mac, IP: ip})
+	if err != nil {
+		t.Fatalf("URL signing failed: %s", err)
+	}
+	for _, tc := range []struct {
+		client *types.Machine
+		ok     bool
+	}{
+		{&types.Machine{MAC: mac, IP: ip}, true},
+		{nil, true},
+		{&types.Machine{MAC: mac}, false},
+		{&types.Machine{IP: ip}, false},
+		{&types.Machine{MAC: mac, IP: net.IPv4(192, 168, 1, 24)}, false},
+	} {
+		u2, err := keys.GetURL(id, tc.client)
+		if tc.ok && (err != nil || u2 != u) {
+			t.Fatalf("GetURL for %v = %q, %v, want %q", tc.client, u2, err, u)
+		}
+		if !tc.ok && err == nil {
+			t.Fatalf("GetURL for %v should have failed", tc.client)
+		}
+	}
+
+	expired, err := keys.SignURL(u, SignOptions{TTL: -time.Second})
+	if err != nil {
+		t.Fatalf("URL signing failed: %s", err)
+	}
+	if _, err = keys.GetURL(expired, nil); err == nil {
+		t.Fatal("Expired ID decoded correctly")
+	}
+
+	// IDs signed with the previous key still work, not older ones.
+	if err = keys.Rotate(); err != nil {
+		t.Fatalf("Rotating keys: %s", err)
+	}
+	if _, err = keys.GetURL(id, nil); err != nil {
+		t.Fatalf("ID signed with the previous key failed: %s", err)
+	}
+	if err = keys.Rotate(); err != nil {
+		t.Fatalf("Rotating keys: %s", err)
+	}
+	if _, err = keys.GetURL(id, nil); err == nil {
+		t.Fatal("ID signed with a dropped key decoded correctly")
+	}
+}
+
+func TestLoadKeySet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	keys, err := LoadKeySet(path, 0)
+	if err != nil {
+		t.Fatalf("Creating key set: %s", err)
+	}
+	u := "http://test.example/foo/bar"
+	id, err := keys.SignURL(u, SignOptions{})
+	if err != nil {
+		t.Fatalf("URL signing failed: %s", err)
+	}
+
+	// IDs survive a restart.
+	keys, err = LoadKeySet(path, 0)
+	if err != nil {
+		t.Fatalf("Loading key set: %s", err)
+	}
+	if u2, err := keys.GetURL(id, nil); err != nil || u2 != u {
+		t.Fatalf("GetURL after reload = %q, %v, want %q", u2, err, u)
+	}
+
+	// A stale file gets rotated on the next signature.
+	old := time.Now().Add(-2 * time.Hour)
+	if err = os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	keys, err = LoadKeySet(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Loading key set: %s", err)
+	}
+	before, _ := os.ReadFile(path)
+	if _, err = keys.SignURL(u, SignOptions{}); err != nil {
+		t.Fatalf("URL signing failed: %s", err)
+	}
+	after, _ := os.ReadFile(path)
+	if bytes.Equal(before, after) || !bytes.HasSuffix(after, before) {
+		t.Fatalf("Key file wasn't rotated:\nbefore: %q\nafter:  %q", before, after)
+	}
+	if _, err = keys.GetURL(id, nil); err != nil {
+		t.Fatalf("ID signed with the previous key failed: %s", err)
+	}
+
+	if err = os.WriteFile(path, []byte("not a key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadKeySet(path, 0); err == nil {
+		t.Fatal("Loading an invalid key file should fail")
+	}
+}